@@ -1,21 +1,605 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/fahlmant/lox/pkg/lox"
 )
 
+// Exit codes, following the BSD sysexits convention
+const (
+	exitOK         = 0
+	exitUsage      = 64
+	exitCompile    = 65
+	exitNoInput    = 66
+	exitSoftware   = 70
+	exitCantCreate = 73
+)
+
+// A golox subcommand, such as golox run
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(args []string) int
+}
+
+// Set up in init, since the usage message lists the commands
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "[-e code] [--backend=tree] [--trace] [--trace-format=text|json] [--profile=file] [--profile-format=text|pprof|folded] [script | -]", "run a script", runCommand},
+		{"repl", "", "start an interactive session", replCommand},
+		{"tokens", "[-e code] [script | -]", "print the tokens a script scans into", tokensCommand},
+		{"ast", "[-e code] [--format=sexpr|json|dot] [script | -]", "print the syntax tree of a script", astCommand},
+		{"check", "[-e code] [script | -]", "report compile errors without running", checkCommand},
+		{"fmt", "[-w | --check | --diff] [script ... | -]", "format scripts in the canonical style", fmtCommand},
+		{"lint", "[--enable=rule,...] [--disable=rule,...] [--rules] [script ... | -]", "report likely mistakes in scripts", lintCommand},
+		{"test", "[-v] [--junit=file] [--cover] [--coverprofile=file] [--coverhtml=file] [path ...]", "run the test_ functions of the *_test.lox scripts in the paths", testCommand},
+		{"debug", "[--dap] [script]", "step through a script, or with --dap serve the Debug Adapter Protocol", debugCommand},
+		{"lsp", "[--stdio]", "start a language server for editors", lspCommand},
+		{"disasm", "[-e code] [script | -]", "print the bytecode of a script", disasmCommand},
+	}
+}
+
 func main() {
+	os.Exit(dispatch(os.Args[1:]))
+}
+
+// Runs the subcommand named by the first argument and returns the exit code
+// For compatibility, golox script runs the script and golox on its own starts the REPL
+func dispatch(args []string) int {
+
+	if len(args) == 0 {
+		return replCommand(nil)
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return exitOK
+	}
+
+	if len(args) == 1 && !strings.HasPrefix(args[0], "-") {
+		return runCommand(args)
+	}
+
+	usage()
+	return exitUsage
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: golox <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "       golox [script]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.help)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Scripts are read from standard input when the script is -")
+}
+
+// Creates the flags for a subcommand, with -e for passing code on the command line
+func newFlags(c string, code *string) *flag.FlagSet {
+	flags := flag.NewFlagSet(c, flag.ContinueOnError)
+	flags.StringVar(code, "e", "", "use `code` instead of reading a script")
+	flags.Usage = func() {
+		for _, command := range commands {
+			if command.name == c {
+				fmt.Fprintf(os.Stderr, "Usage: golox %s %s\n", command.name, command.usage)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
+}
 
-	argLength := len(os.Args)
+// Gets the source to work on from -e, a script, or standard input for -
+// Returns an exit code other than exitOK if there's no source
+func source(flags *flag.FlagSet, code string) (string, int) {
 
-	if argLength > 2 {
-		fmt.Println("Usage: golox [script]")
-	} else if argLength == 2 {
-		lox.RunFile(os.Args[1])
+	if code != "" {
+		if flags.NArg() != 0 {
+			flags.Usage()
+			return "", exitUsage
+		}
+		return code, exitOK
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return "", exitUsage
+	}
+
+	var data []byte
+	var err error
+	if path := flags.Arg(0); path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
 	} else {
-		lox.RunPrompt()
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return "", exitNoInput
+	}
+	return string(data), exitOK
+}
+
+// Turns the error from compiling or running a script into an exit code
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case err == lox.ErrCompile:
+		// The details have already been reported
+		return exitCompile
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return exitSoftware
+	}
+}
+
+func runCommand(args []string) int {
+
+	var code string
+	flags := newFlags("run", &code)
+	backend := flags.String("backend", "tree", "`interpreter` to run with, only tree is supported")
+	trace := flags.Bool("trace", false, "log each statement, call and variable change to standard error")
+	traceFormat := flags.String("trace-format", "text", "`format` of the trace: text or json")
+	profile := flags.String("profile", "", "write a profile of where the time goes to `file`, or standard error for -")
+	profileFormat := flags.String("profile-format", "pprof", "`format` of the profile: text, pprof or folded")
+	optimize := flags.Bool("O", false, "optimize the program before running it")
+	flags.BoolVar(optimize, "optimize", false, "same as -O")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *backend != "tree" {
+		fmt.Fprintf(os.Stderr, "golox run: unsupported backend %q, only the tree-walking interpreter is available\n", *backend)
+		return exitUsage
+	}
+	if *traceFormat != "text" && *traceFormat != "json" {
+		fmt.Fprintf(os.Stderr, "golox run: unknown trace format %q, expected text or json\n", *traceFormat)
+		return exitUsage
+	}
+	if *profileFormat != "text" && *profileFormat != "pprof" && *profileFormat != "folded" {
+		fmt.Fprintf(os.Stderr, "golox run: unknown profile format %q, expected text, pprof or folded\n", *profileFormat)
+		return exitUsage
+	}
+	if *trace && *profile != "" {
+		fmt.Fprintln(os.Stderr, "golox run: --trace and --profile can't be used together, tracing would swamp the profile")
+		return exitUsage
+	}
+	if *optimize && (*trace || *profile != "") {
+		fmt.Fprintln(os.Stderr, "golox run: -O can't be used with --trace or --profile, they follow the program as written")
+		return exitUsage
+	}
+
+	src, status := source(flags, code)
+	if status != exitOK {
+		return status
+	}
+	if *optimize {
+		return exitCode(lox.RunOptimized(src, os.Stdout))
+	}
+	if *trace {
+		return exitCode(lox.RunTraced(src, os.Stdout, os.Stderr, *traceFormat))
+	}
+	if *profile != "" {
+		return runProfiled(flags, code, src, *profile, *profileFormat)
+	}
+	return exitCode(lox.Run(src, os.Stdout))
+}
+
+// Runs the source and writes its profile to the file, or standard error for -
+func runProfiled(flags *flag.FlagSet, code, src, path, format string) int {
+
+	out := os.Stderr
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitCantCreate
+		}
+		defer f.Close()
+		out = f
+	}
+
+	// Name the script in the profile
+	script := flags.Arg(0)
+	if code != "" {
+		script = "-e"
+	}
+	return exitCode(lox.RunProfiled(src, script, os.Stdout, out, format))
+}
+
+func replCommand(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: golox repl")
+		return exitUsage
+	}
+	lox.RunPrompt()
+	return exitOK
+}
+
+func tokensCommand(args []string) int {
+
+	var code string
+	flags := newFlags("tokens", &code)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	src, status := source(flags, code)
+	if status != exitOK {
+		return status
+	}
+	return exitCode(lox.WriteTokens(src, os.Stdout))
+}
+
+func astCommand(args []string) int {
+
+	var code string
+	flags := newFlags("ast", &code)
+	format := flags.String("format", "sexpr", "output `format`: sexpr, json or dot")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	src, status := source(flags, code)
+	if status != exitOK {
+		return status
+	}
+
+	if err := lox.WriteAst(src, *format, os.Stdout); err != nil && err != lox.ErrCompile {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	} else if err != nil {
+		return exitCompile
+	}
+	return exitOK
+}
+
+func checkCommand(args []string) int {
+
+	var code string
+	flags := newFlags("check", &code)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
 	}
+
+	src, status := source(flags, code)
+	if status != exitOK {
+		return status
+	}
+	return exitCode(lox.Check(src))
+}
+
+// Formats scripts, printing the result unless -w, --check or --diff says otherwise
+func fmtCommand(args []string) int {
+
+	var code string
+	flags := newFlags("fmt", &code)
+	write := flags.Bool("w", false, "write the result back to the script instead of printing it")
+	check := flags.Bool("check", false, "list scripts that aren't formatted, and fail if there are any")
+	diff := flags.Bool("diff", false, "print a diff of the changes instead of the result")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	// Format -e code or standard input on their own
+	if code != "" || (flags.NArg() == 1 && flags.Arg(0) == "-") {
+		src, status := source(flags, code)
+		if status != exitOK {
+			return status
+		}
+		return formatSource("<stdin>", src, false, *check, *diff)
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	status := exitOK
+	for _, path := range flags.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = exitNoInput
+			continue
+		}
+		if s := formatSource(path, string(data), *write, *check, *diff); s != exitOK && status == exitOK {
+			status = s
+		}
+	}
+	return status
+}
+
+// Formats one script, returning exit code 1 if --check finds it isn't formatted
+func formatSource(path, src string, write, check, diff bool) int {
+
+	formatted, err := lox.Format(src)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	switch {
+	case check:
+		if formatted != src {
+			fmt.Println(path)
+			if diff {
+				fmt.Print(lox.Diff(path, path+" (formatted)", src, formatted))
+			}
+			return 1
+		}
+	case diff:
+		fmt.Print(lox.Diff(path, path+" (formatted)", src, formatted))
+	case write:
+		if formatted != src {
+			if err := ioutil.WriteFile(path, []byte(formatted), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitSoftware
+			}
+		}
+	default:
+		fmt.Print(formatted)
+	}
+	return exitOK
+}
+
+// Lints scripts, printing each finding as path:line:column: message (rule)
+// Exits with 1 if anything was found
+func lintCommand(args []string) int {
+
+	var code string
+	flags := newFlags("lint", &code)
+	enable := flags.String("enable", "", "comma separated `rules` to check as well as the defaults")
+	disable := flags.String("disable", "", "comma separated `rules` not to check")
+	list := flags.Bool("rules", false, "list the rules and exit")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *list {
+		for _, rule := range lox.LintRules {
+			state := "on"
+			if !rule.Default {
+				state = "off"
+			}
+			fmt.Printf("%-22s %-3s %s\n", rule.Name, state, rule.Help)
+		}
+		return exitOK
+	}
+
+	rules := lox.DefaultLintRules()
+	for _, setting := range []struct {
+		names string
+		on    bool
+	}{{*enable, true}, {*disable, false}} {
+		if setting.names == "" {
+			continue
+		}
+		for _, name := range strings.Split(setting.names, ",") {
+			if !lox.IsLintRule(name) {
+				fmt.Fprintf(os.Stderr, "golox lint: unknown rule %q, see golox lint --rules\n", name)
+				return exitUsage
+			}
+			rules[name] = setting.on
+		}
+	}
+
+	// Lint -e code or standard input on their own
+	if code != "" || (flags.NArg() == 1 && flags.Arg(0) == "-") {
+		src, status := source(flags, code)
+		if status != exitOK {
+			return status
+		}
+		return lintSource("<stdin>", src, rules)
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	status := exitOK
+	for _, path := range flags.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = exitNoInput
+			continue
+		}
+		if s := lintSource(path, string(data), rules); s != exitOK && status == exitOK {
+			status = s
+		}
+	}
+	return status
+}
+
+// Lints one script, returning exit code 1 if anything was found
+func lintSource(path, src string, rules map[string]bool) int {
+
+	diagnostics, err := lox.Lint(src, rules)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	for _, d := range diagnostics {
+		fmt.Printf("%s:%v\n", path, d)
+	}
+	if len(diagnostics) > 0 {
+		return 1
+	}
+	return exitOK
+}
+
+// Runs the tests in test scripts, printing the ones that fail
+// Directories are searched for scripts ending in _test.lox, and files are run as they are
+// Exits with 1 if any test fails
+func testCommand(args []string) int {
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "list every test, not just the ones that fail")
+	junit := flags.String("junit", "", "write the results to `file` in JUnit XML format")
+	cover := flags.Bool("cover", false, "report the share of statements and branches that ran")
+	profile := flags.String("coverprofile", "", "write the coverage of each script to `file` in LCOV format")
+	html := flags.String("coverhtml", "", "write the coverage of each script to `file` as an HTML page")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	scripts, err := testScripts(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitNoInput
+	}
+
+	suite := &lox.TestSuite{Verbose: *verbose}
+	// Writing a coverage file measures coverage too
+	if *cover || *profile != "" || *html != "" {
+		suite.Coverage = lox.NewCoverage()
+	}
+
+	for _, path := range scripts {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitNoInput
+		}
+		suite.RunFile(path, string(data), os.Stdout)
+	}
+
+	if suite.Coverage != nil {
+		suite.Coverage.WriteSummary(os.Stdout)
+	}
+	for _, output := range []struct {
+		path  string
+		write func(io.Writer) error
+	}{{*junit, suite.WriteJUnit}, {*profile, suite.Coverage.WriteLCOV}, {*html, suite.Coverage.WriteHTML}} {
+		if output.path == "" {
+			continue
+		}
+		f, err := os.Create(output.path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitCantCreate
+		}
+		err = output.write(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitCantCreate
+		}
+	}
+
+	if suite.Failed() {
+		return 1
+	}
+	return exitOK
+}
+
+// Returns the scripts to test in the paths, in order
+func testScripts(paths []string) ([]string, error) {
+	var scripts []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			scripts = append(scripts, path)
+			continue
+		}
+		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(p, "_test.lox") {
+				scripts = append(scripts, p)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scripts, nil
+}
+
+// Debugs a script in the terminal, or serves DAP on standard input and output for
+// an editor, which says what script to run
+func debugCommand(args []string) int {
+
+	flags := flag.NewFlagSet("debug", flag.ContinueOnError)
+	dap := flags.Bool("dap", false, "speak the Debug Adapter Protocol over standard input and output")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *dap {
+		if flags.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "golox debug: the editor chooses the script to run with --dap")
+			return exitUsage
+		}
+		if err := lox.ServeDebugAdapter(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "golox debug:", err)
+			return exitSoftware
+		}
+		return exitOK
+	}
+
+	// Commands are read from standard input, so the script has to come from a file
+	if flags.NArg() != 1 || flags.Arg(0) == "-" {
+		fmt.Fprintln(os.Stderr, "Usage: golox debug [--dap] [script]")
+		return exitUsage
+	}
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitNoInput
+	}
+	return exitCode(lox.Debug(string(data), os.Stdin, os.Stdout))
+}
+
+// Serves LSP on standard input and output, the only transport there is
+// --stdio is accepted since editors commonly pass it
+func lspCommand(args []string) int {
+
+	flags := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	flags.Bool("stdio", true, "speak LSP over standard input and output")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: golox lsp [--stdio]")
+		return exitUsage
+	}
+
+	if err := lox.ServeLanguageServer(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "golox lsp:", err)
+		return exitSoftware
+	}
+	return exitOK
+}
+
+// There is no bytecode compiler yet, only the tree-walking interpreter
+func disasmCommand(args []string) int {
+	fmt.Fprintln(os.Stderr, "golox disasm: there is no bytecode backend to disassemble, scripts run on the tree-walking interpreter")
+	return exitUsage
 }
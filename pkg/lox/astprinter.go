@@ -0,0 +1,185 @@
+package lox
+
+import (
+	"strings"
+)
+
+// AstPrinter prints syntax trees as parenthesized S-expressions
+// example: print 1 + 2 * 3; prints as (print (+ 1 (* 2 3)))
+type AstPrinter struct {
+	result string
+}
+
+// Returns the S-expression for an expression
+func (a *AstPrinter) print(expr Expr) string {
+	expr.Accept(a)
+	return a.result
+}
+
+// Returns the S-expression for a statement
+func (a *AstPrinter) printStmt(stmt Stmt) string {
+	stmt.Accept(a)
+	return a.result
+}
+
+// Wraps the name and parts in parentheses, separated by spaces
+// Each part can be an expression, a statement, or text to print as is
+func (a *AstPrinter) parenthesize(name string, parts ...interface{}) error {
+	var b strings.Builder
+	b.WriteString("(" + name)
+	for _, part := range parts {
+		var text string
+		switch p := part.(type) {
+		case Expr:
+			text = a.print(p)
+		case Stmt:
+			text = a.printStmt(p)
+		case string:
+			text = p
+		}
+		// Empty lists, like the arguments of f(), leave nothing to print
+		if text != "" {
+			b.WriteString(" " + text)
+		}
+	}
+	b.WriteString(")")
+
+	a.result = b.String()
+	return nil
+}
+
+// Prints each of the expressions, separated by spaces
+func (a *AstPrinter) list(exprs []Expr) string {
+	var parts []string
+	for _, expr := range exprs {
+		parts = append(parts, a.print(expr))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Prints the lexemes of the tokens, separated by spaces
+func tokenNames(tokens []Token) string {
+	var names []string
+	for _, token := range tokens {
+		names = append(names, token.lexeme)
+	}
+	return strings.Join(names, " ")
+}
+
+func (a *AstPrinter) visitAssign(e Assign) error {
+	return a.parenthesize("=", e.variable.token.lexeme, e.value)
+}
+
+func (a *AstPrinter) visitBinary(e Binary) error {
+	return a.parenthesize(e.operator.lexeme, e.left, e.right)
+}
+
+func (a *AstPrinter) visitCall(e Call) error {
+	return a.parenthesize("call", e.callee, a.list(e.arguments))
+}
+
+func (a *AstPrinter) visitConditional(e Conditional) error {
+	return a.parenthesize("?:", e.condition, e.thenBranch, e.elseBranch)
+}
+
+func (a *AstPrinter) visitGrouping(e Grouping) error {
+	return a.parenthesize("group", e.expression)
+}
+
+func (a *AstPrinter) visitInterpolation(e Interpolation) error {
+	return a.parenthesize("interpolate", a.list(e.parts))
+}
+
+func (a *AstPrinter) visitListLiteral(e ListLiteral) error {
+	return a.parenthesize("list", a.list(e.elements))
+}
+
+func (a *AstPrinter) visitLiteral(e Literal) error {
+	a.result = quoted(valueOf(e.value))
+	return nil
+}
+
+func (a *AstPrinter) visitLogical(e Logical) error {
+	return a.parenthesize(e.operator.lexeme, e.left, e.right)
+}
+
+func (a *AstPrinter) visitMapLiteral(e MapLiteral) error {
+	var entries []interface{}
+	for n := range e.keys {
+		entries = append(entries, "("+a.print(e.keys[n])+" "+a.print(e.values[n])+")")
+	}
+	return a.parenthesize("map", entries...)
+}
+
+func (a *AstPrinter) visitSpawn(e Spawn) error {
+	return a.parenthesize("spawn", e.call)
+}
+
+func (a *AstPrinter) visitUnary(e Unary) error {
+	return a.parenthesize(e.operator.lexeme, e.right)
+}
+
+func (a *AstPrinter) visitVariable(e Variable) error {
+	a.result = e.token.lexeme
+	return nil
+}
+
+func (a *AstPrinter) visitBlockStmt(s BlockStmt) error {
+	var statements []interface{}
+	for _, stmt := range s.statements {
+		statements = append(statements, stmt)
+	}
+	return a.parenthesize("block", statements...)
+}
+
+func (a *AstPrinter) visitExprStmt(s ExprStmt) error {
+	return a.parenthesize("expr", s.expression)
+}
+
+func (a *AstPrinter) visitForInStmt(s ForInStmt) error {
+	return a.parenthesize("for-in", "("+tokenNames(s.names)+")", s.iterable, s.body)
+}
+
+func (a *AstPrinter) visitFuncStmt(s FuncStmt) error {
+	parts := []interface{}{s.name.lexeme, "(" + tokenNames(s.params) + ")"}
+	for _, stmt := range s.body {
+		parts = append(parts, stmt)
+	}
+	return a.parenthesize("fun", parts...)
+}
+
+func (a *AstPrinter) visitIfStmt(s IfStmt) error {
+	if s.elseStmt != nil {
+		return a.parenthesize("if", s.condition, s.branch, s.elseStmt)
+	}
+	return a.parenthesize("if", s.condition, s.branch)
+}
+
+func (a *AstPrinter) visitPrintStmt(s PrintStmt) error {
+	return a.parenthesize("print", s.expression)
+}
+
+func (a *AstPrinter) visitReturnStmt(s ReturnStmt) error {
+	if s.value != nil {
+		return a.parenthesize("return", s.value)
+	}
+	return a.parenthesize("return")
+}
+
+func (a *AstPrinter) visitVarStmt(s VarStmt) error {
+	if s.initializer != nil {
+		return a.parenthesize("var", s.name.lexeme, s.initializer)
+	}
+	return a.parenthesize("var", s.name.lexeme)
+}
+
+func (a *AstPrinter) visitWhileStmt(s WhileStmt) error {
+	return a.parenthesize("while", s.condition, s.body)
+}
+
+func (a *AstPrinter) visitYieldStmt(s YieldStmt) error {
+	if s.value != nil {
+		return a.parenthesize("yield", s.value)
+	}
+	return a.parenthesize("yield")
+}
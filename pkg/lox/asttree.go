@@ -0,0 +1,327 @@
+package lox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Syntax trees can be written out as S-expressions, JSON or Graphviz DOT graphs
+//
+// The JSON schema is one object per node. Every object has a "type", such as
+// "Binary" or "Print", and a "line" when the node has a token to take it from.
+// The other keys depend on the type: child nodes are objects or arrays of objects,
+// and everything else, like operators and names, is a string, number, bool or null.
+// A "Literal" has its value and its "kind": "nil", "bool", "string", "int" or
+// "float". Integers too big for a JSON number to hold exactly are written as strings.
+// The whole program is a "Program" node with the statements in "body".
+// Keys are written in sorted order, so the same source always gives the same output.
+
+// A syntax tree node converted into plain values, ready to be encoded
+type astNode map[string]interface{}
+
+// Formats the syntax tree can be written in
+var astFormats = []string{"sexpr", "json", "dot"}
+
+// WriteAst parses the source and writes its syntax tree to out in the format,
+// which is one of sexpr, json or dot
+// Returns ErrCompile if the source had errors, which are written to errorOutput
+func WriteAst(source, format string, out io.Writer) error {
+
+	if !validAstFormat(format) {
+		return fmt.Errorf("unknown AST format %q, expected one of %s", format, strings.Join(astFormats, ", "))
+	}
+
+	stmts, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "sexpr":
+		printer := &AstPrinter{}
+		for _, stmt := range stmts {
+			fmt.Fprintln(out, printer.printStmt(stmt))
+		}
+		return nil
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(programNode(stmts))
+	case "dot":
+		return writeDot(programNode(stmts), out)
+	}
+	return nil
+}
+
+func validAstFormat(format string) bool {
+	for _, f := range astFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts the statements of a program into a tree of nodes
+func programNode(stmts []Stmt) astNode {
+	builder := &astBuilder{}
+	return astNode{"type": "Program", "body": builder.stmts(stmts)}
+}
+
+// Builds astNodes from syntax trees using the visitor pattern
+type astBuilder struct {
+	result astNode
+}
+
+func (a *astBuilder) expr(expr Expr) interface{} {
+	// Optional children, like a var without an initializer, are null
+	if expr == nil {
+		return nil
+	}
+	expr.Accept(a)
+	return a.result
+}
+
+func (a *astBuilder) stmt(stmt Stmt) interface{} {
+	if stmt == nil {
+		return nil
+	}
+	stmt.Accept(a)
+	return a.result
+}
+
+func (a *astBuilder) exprs(exprs []Expr) []interface{} {
+	nodes := []interface{}{}
+	for _, expr := range exprs {
+		nodes = append(nodes, a.expr(expr))
+	}
+	return nodes
+}
+
+func (a *astBuilder) stmts(stmts []Stmt) []interface{} {
+	nodes := []interface{}{}
+	for _, stmt := range stmts {
+		nodes = append(nodes, a.stmt(stmt))
+	}
+	return nodes
+}
+
+func lexemes(tokens []Token) []interface{} {
+	names := []interface{}{}
+	for _, token := range tokens {
+		names = append(names, token.lexeme)
+	}
+	return names
+}
+
+func (a *astBuilder) visitAssign(e Assign) error {
+	a.result = astNode{"type": "Assign", "line": e.variable.token.line, "name": e.variable.token.lexeme, "value": a.expr(e.value)}
+	return nil
+}
+
+func (a *astBuilder) visitBinary(e Binary) error {
+	a.result = astNode{"type": "Binary", "line": e.operator.line, "operator": e.operator.lexeme, "left": a.expr(e.left), "right": a.expr(e.right)}
+	return nil
+}
+
+func (a *astBuilder) visitCall(e Call) error {
+	a.result = astNode{"type": "Call", "line": e.paren.line, "callee": a.expr(e.callee), "arguments": a.exprs(e.arguments)}
+	return nil
+}
+
+func (a *astBuilder) visitConditional(e Conditional) error {
+	a.result = astNode{"type": "Conditional", "line": e.question.line, "condition": a.expr(e.condition), "then": a.expr(e.thenBranch), "else": a.expr(e.elseBranch)}
+	return nil
+}
+
+func (a *astBuilder) visitGrouping(e Grouping) error {
+	a.result = astNode{"type": "Grouping", "expression": a.expr(e.expression)}
+	return nil
+}
+
+func (a *astBuilder) visitInterpolation(e Interpolation) error {
+	a.result = astNode{"type": "Interpolation", "parts": a.exprs(e.parts)}
+	return nil
+}
+
+func (a *astBuilder) visitListLiteral(e ListLiteral) error {
+	a.result = astNode{"type": "List", "line": e.bracket.line, "elements": a.exprs(e.elements)}
+	return nil
+}
+
+func (a *astBuilder) visitLiteral(e Literal) error {
+	value := e.value
+	// Big integers don't fit in a JSON number without losing digits
+	if b, ok := value.(*big.Int); ok {
+		value = b.String()
+	}
+	a.result = astNode{"type": "Literal", "kind": typeName(valueOf(e.value)), "value": value}
+	return nil
+}
+
+func (a *astBuilder) visitLogical(e Logical) error {
+	a.result = astNode{"type": "Logical", "line": e.operator.line, "operator": e.operator.lexeme, "left": a.expr(e.left), "right": a.expr(e.right)}
+	return nil
+}
+
+func (a *astBuilder) visitMapLiteral(e MapLiteral) error {
+	entries := []interface{}{}
+	for n := range e.keys {
+		entries = append(entries, astNode{"type": "Entry", "key": a.expr(e.keys[n]), "value": a.expr(e.values[n])})
+	}
+	a.result = astNode{"type": "Map", "line": e.brace.line, "entries": entries}
+	return nil
+}
+
+func (a *astBuilder) visitSpawn(e Spawn) error {
+	a.result = astNode{"type": "Spawn", "line": e.keyword.line, "call": a.expr(e.call)}
+	return nil
+}
+
+func (a *astBuilder) visitUnary(e Unary) error {
+	a.result = astNode{"type": "Unary", "line": e.operator.line, "operator": e.operator.lexeme, "right": a.expr(e.right)}
+	return nil
+}
+
+func (a *astBuilder) visitVariable(e Variable) error {
+	a.result = astNode{"type": "Variable", "line": e.token.line, "name": e.token.lexeme}
+	return nil
+}
+
+func (a *astBuilder) visitBlockStmt(s BlockStmt) error {
+	a.result = astNode{"type": "Block", "line": s.brace.line, "body": a.stmts(s.statements)}
+	return nil
+}
+
+func (a *astBuilder) visitExprStmt(s ExprStmt) error {
+	a.result = astNode{"type": "Expression", "line": s.start.line, "expression": a.expr(s.expression)}
+	return nil
+}
+
+func (a *astBuilder) visitForInStmt(s ForInStmt) error {
+	a.result = astNode{"type": "ForIn", "line": s.keyword.line, "names": lexemes(s.names), "iterable": a.expr(s.iterable), "body": a.stmt(s.body)}
+	return nil
+}
+
+func (a *astBuilder) visitFuncStmt(s FuncStmt) error {
+	a.result = astNode{"type": "Function", "line": s.name.line, "name": s.name.lexeme, "params": lexemes(s.params), "body": a.stmts(s.body), "generator": s.isGenerator}
+	if s.doc != "" {
+		a.result["doc"] = s.doc
+	}
+	return nil
+}
+
+func (a *astBuilder) visitIfStmt(s IfStmt) error {
+	a.result = astNode{"type": "If", "line": s.keyword.line, "condition": a.expr(s.condition), "then": a.stmt(s.branch), "else": a.stmt(s.elseStmt)}
+	return nil
+}
+
+func (a *astBuilder) visitPrintStmt(s PrintStmt) error {
+	a.result = astNode{"type": "Print", "line": s.keyword.line, "expression": a.expr(s.expression)}
+	return nil
+}
+
+func (a *astBuilder) visitReturnStmt(s ReturnStmt) error {
+	a.result = astNode{"type": "Return", "line": s.keyword.line, "value": a.expr(s.value)}
+	return nil
+}
+
+func (a *astBuilder) visitVarStmt(s VarStmt) error {
+	a.result = astNode{"type": "Var", "line": s.name.line, "name": s.name.lexeme, "initializer": a.expr(s.initializer)}
+	if s.doc != "" {
+		a.result["doc"] = s.doc
+	}
+	return nil
+}
+
+func (a *astBuilder) visitWhileStmt(s WhileStmt) error {
+	a.result = astNode{"type": "While", "line": s.keyword.line, "condition": a.expr(s.condition), "body": a.stmt(s.body)}
+	return nil
+}
+
+func (a *astBuilder) visitYieldStmt(s YieldStmt) error {
+	a.result = astNode{"type": "Yield", "line": s.keyword.line, "value": a.expr(s.value)}
+	return nil
+}
+
+// Writes the tree as a Graphviz digraph
+// Each node is labelled with its type and plain values, and each edge with the key
+// the child is under
+func writeDot(root astNode, out io.Writer) error {
+
+	var b strings.Builder
+	b.WriteString("digraph ast {\n\tnode [shape=box];\n")
+
+	count := 0
+	var write func(node astNode) string
+	write = func(node astNode) string {
+		id := fmt.Sprintf("n%d", count)
+		count++
+
+		var keys []string
+		for key := range node {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		// Plain values go in the label, child nodes are written after it
+		type edge struct {
+			label string
+			child astNode
+		}
+		label := []string{fmt.Sprint(node["type"])}
+		var edges []edge
+		for _, key := range keys {
+			switch value := node[key].(type) {
+			case astNode:
+				edges = append(edges, edge{key, value})
+			case []interface{}:
+				for n, element := range value {
+					if child, ok := element.(astNode); ok {
+						edges = append(edges, edge{fmt.Sprintf("%s[%d]", key, n), child})
+					} else {
+						label = append(label, fmt.Sprintf("%s[%d]: %v", key, n, element))
+					}
+				}
+			default:
+				if key == "type" || (value == nil && node["type"] != "Literal") {
+					continue
+				}
+				if key == "value" {
+					// Show literal values the way they'd be written in Lox
+					if s, ok := value.(string); ok && node["kind"] == "string" {
+						value = fmt.Sprintf("%q", s)
+					} else if value == nil {
+						value = "nil"
+					}
+				}
+				label = append(label, fmt.Sprintf("%s: %v", key, value))
+			}
+		}
+
+		fmt.Fprintf(&b, "\t%s [label=%s];\n", id, dotQuote(strings.Join(label, "\n")))
+		for _, e := range edges {
+			child := write(e.child)
+			fmt.Fprintf(&b, "\t%s -> %s [label=%s];\n", id, child, dotQuote(e.label))
+		}
+		return id
+	}
+	write(root)
+
+	b.WriteString("}\n")
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// Quotes a string for use as a DOT label
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,146 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const astSource = `var x = -1;
+print x + 2 * 3;
+`
+
+// Literals of every kind, and statements that only have a keyword for their line
+const astKindsSource = `print false ? nil : 100000000000000000000;
+if (true) { "a"; } else while (false) print 1.0;
+`
+
+func TestWriteAstSexpr(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteAst(astSource, "sexpr", &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "(var x (- 1))\n(print (+ x (* 2 3)))\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestWriteAstJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteAst(astSource, "json", &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var program struct {
+		Type string
+		Body []struct {
+			Type        string
+			Line        int
+			Name        string
+			Initializer struct {
+				Type     string
+				Operator string
+				Right    struct {
+					Type  string
+					Value interface{}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(out.Bytes(), &program); err != nil {
+		t.Fatal(err)
+	}
+
+	if program.Type != "Program" || len(program.Body) != 2 {
+		t.Fatalf("unexpected program: %s", out.String())
+	}
+	v := program.Body[0]
+	if v.Type != "Var" || v.Line != 1 || v.Name != "x" || v.Initializer.Type != "Unary" ||
+		v.Initializer.Operator != "-" || v.Initializer.Right.Value != float64(1) {
+		t.Errorf("unexpected var node: %+v", v)
+	}
+	if p := program.Body[1]; p.Type != "Print" || p.Line != 2 {
+		t.Errorf("unexpected print node: %+v", p)
+	}
+
+	// The same source always gives the same output
+	var again bytes.Buffer
+	WriteAst(astSource, "json", &again)
+	if again.String() != out.String() {
+		t.Error("JSON output is not stable")
+	}
+}
+
+func TestWriteAstJSONKinds(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteAst(astKindsSource, "json", &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// Collect each literal's kind and value, and the line of every statement
+	var program interface{}
+	if err := json.Unmarshal(out.Bytes(), &program); err != nil {
+		t.Fatal(err)
+	}
+	var literals []string
+	lines := map[string]interface{}{}
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if n["type"] == "Literal" {
+				literals = append(literals, fmt.Sprintf("%v %v", n["kind"], n["value"]))
+			} else if n["type"] != "Program" {
+				lines[n["type"].(string)] = n["line"]
+			}
+			for _, child := range n {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range n {
+				walk(child)
+			}
+		}
+	}
+	walk(program)
+
+	sort.Strings(literals)
+	want := []string{"bool false", "bool false", "bool true", "float 1", "int 100000000000000000000", "nil <nil>", "string a"}
+	sort.Strings(want)
+	if strings.Join(literals, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got literals %v, want %v", literals, want)
+	}
+	for _, node := range []string{"Print", "Conditional", "If", "Block", "Expression", "While"} {
+		if lines[node] == nil {
+			t.Errorf("expected a line on the %s node", node)
+		}
+	}
+}
+
+func TestWriteAstDot(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteAst(astSource, "dot", &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"digraph ast {",
+		`n0 [label="Program"];`,
+		`n1 [label="Var\nline: 1\nname: x"];`,
+		`n0 -> n1 [label="body[0]"];`,
+		`[label="Literal\nkind: int\nvalue: 1"];`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestWriteAstUnknownFormat(t *testing.T) {
+	if err := WriteAst(astSource, "xml", &bytes.Buffer{}); err == nil || err == ErrCompile {
+		t.Errorf("got %v, want an unknown format error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package lox
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// Runs the source once per iteration, parsing it up front so only running is measured
+func benchmarkScript(b *testing.B, source string) {
+	stmts, err := parseSource(source)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := NewInterpreter(ioutil.Discard).Interpret(stmts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A call per step, each with its own scope for the parameter
+func BenchmarkRecursion(b *testing.B) {
+	benchmarkScript(b, `fun fib(n) {
+  if (n < 2) return n;
+  return fib(n - 1) + fib(n - 2);
+}
+print fib(20);
+`)
+}
+
+// Local variables read and written from nested blocks, with a new block scope each
+// time round the loops
+func BenchmarkLoops(b *testing.B) {
+	benchmarkScript(b, `{
+  var total = 0;
+  for (var i = 0; i < 300; i = i + 1) {
+    for (var j = 0; j < 100; j = j + 1) {
+      var product = i * j;
+      total = total + product;
+    }
+  }
+  print total;
+}
+`)
+}
+
+// Variables captured by closures, read from a scope further out each call
+func BenchmarkClosures(b *testing.B) {
+	benchmarkScript(b, `fun counter() {
+  var count = 0;
+  fun increment() {
+    count = count + 1;
+    return count;
+  }
+  return increment;
+}
+{
+  var next = counter();
+  for (var i = 0; i < 20000; i = i + 1) next();
+  print next();
+}
+`)
+}
@@ -0,0 +1,281 @@
+package lox
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Native functions defined in the global scope of every interpreter
+var builtins = map[string]LoxCallable{
+	"assert":       Assert{},
+	"assertEqual":  AssertEqual{},
+	"assertThrows": AssertThrows{},
+	"channel":      MakeChannel{},
+	"clock":        Clock{},
+	"close":        Close{},
+	"iter":         Iter{},
+	"join":         Join{},
+	"len":          Len{},
+	"next":         Next{},
+	"range":        Range{},
+	"recv":         Recv{},
+	"select":       Select{},
+	"send":         Send{},
+}
+
+// range(end), range(start, end) or range(start, end, step)
+// Returns an iterator over the numbers from start (default 0) up to but not including end
+// The numbers are produced as they are needed rather than all up front
+type Range struct{}
+
+func (r Range) arity() int {
+	return 3
+}
+
+func (r Range) arityRange() (int, int) {
+	return 1, 3
+}
+
+func (r Range) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+
+	// Fill in the defaults for any arguments left off
+	values := []Value{intValue(0), {}, intValue(1)}
+	switch len(arguments) {
+	case 1:
+		values[1] = arguments[0]
+	case 2:
+		values[0], values[1] = arguments[0], arguments[1]
+	case 3:
+		values[0], values[1], values[2] = arguments[0], arguments[1], arguments[2]
+	}
+
+	for _, value := range values {
+		if !value.isNumber() {
+			return Value{}, fmt.Errorf("range expects numbers, got %s", typeName(value))
+		}
+	}
+	if numbersEqual(values[2], intValue(0)) {
+		return Value{}, fmt.Errorf("range step can't be zero")
+	}
+
+	return objectValue(&rangeIterator{current: values[0], end: values[1], step: values[2]}), nil
+}
+
+func (r Range) String() string {
+	return "<native fn>"
+}
+
+// iter(value) returns an iterator over a list, map, string or function, the same
+// as the one a for-in loop would use
+type Iter struct{}
+
+func (i Iter) arity() int {
+	return 1
+}
+
+func (i Iter) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	iterator, err := iterate(arguments[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return objectValue(iterator), nil
+}
+
+func (i Iter) String() string {
+	return "<native fn>"
+}
+
+// next(iterator) advances an iterator and returns its next value, or nil if it is finished
+type Next struct{}
+
+func (n Next) arity() int {
+	return 1
+}
+
+func (n Next) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	iterator, ok := arguments[0].object.(Iterator)
+	if !ok {
+		return Value{}, fmt.Errorf("next expects an iterator, got %s", typeName(arguments[0]))
+	}
+
+	value, ok, err := iterator.next(interpreter)
+	if err != nil || !ok {
+		return Value{}, err
+	}
+	return value, nil
+}
+
+func (n Next) String() string {
+	return "<native fn>"
+}
+
+// len(value) returns the number of elements in a list or map, or characters in a string
+type Len struct{}
+
+func (l Len) arity() int {
+	return 1
+}
+
+func (l Len) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	if arguments[0].kind == stringKind {
+		return intValue(int64(utf8.RuneCountInString(arguments[0].str))), nil
+	}
+	switch v := arguments[0].object.(type) {
+	case *LoxList:
+		return intValue(int64(len(v.elements))), nil
+	case *LoxMap:
+		return intValue(int64(len(v.keys))), nil
+	}
+	return Value{}, fmt.Errorf("len expects a string, list or map, got %s", typeName(arguments[0]))
+}
+
+func (l Len) String() string {
+	return "<native fn>"
+}
+
+// channel() or channel(capacity) returns a new channel for passing values between tasks
+// Without a capacity, sending waits until another task receives the value
+type MakeChannel struct{}
+
+func (m MakeChannel) arity() int {
+	return 1
+}
+
+func (m MakeChannel) arityRange() (int, int) {
+	return 0, 1
+}
+
+func (m MakeChannel) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	capacity := int64(0)
+	if len(arguments) == 1 {
+		if arguments[0].kind != intKind || arguments[0].int() < 0 {
+			return Value{}, fmt.Errorf("channel capacity must be a non-negative int")
+		}
+		capacity = arguments[0].int()
+	}
+	return objectValue(&Channel{scheduler: interpreter.scheduler, capacity: int(capacity)}), nil
+}
+
+func (m MakeChannel) String() string {
+	return "<native fn>"
+}
+
+// Gets the channel passed as an argument to a channel builtin
+func channelArgument(name string, argument Value) (*Channel, error) {
+	c, ok := argument.object.(*Channel)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a channel, got %s", name, typeName(argument))
+	}
+	return c, nil
+}
+
+// send(channel, value) sends a value, waiting for room in the channel
+type Send struct{}
+
+func (s Send) arity() int {
+	return 2
+}
+
+func (s Send) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	c, err := channelArgument("send", arguments[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{}, c.send(interpreter.task, arguments[1])
+}
+
+func (s Send) String() string {
+	return "<native fn>"
+}
+
+// recv(channel) waits for a value from the channel
+// Returns nil once the channel is closed and everything sent has been received
+type Recv struct{}
+
+func (r Recv) arity() int {
+	return 1
+}
+
+func (r Recv) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	c, err := channelArgument("recv", arguments[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return c.recv(interpreter.task)
+}
+
+func (r Recv) String() string {
+	return "<native fn>"
+}
+
+// close(channel) closes the channel, so receivers get nil once it is empty
+type Close struct{}
+
+func (c Close) arity() int {
+	return 1
+}
+
+func (c Close) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	ch, err := channelArgument("close", arguments[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{}, ch.close()
+}
+
+func (c Close) String() string {
+	return "<native fn>"
+}
+
+// select(channel, ...) waits until any of the channels has a value to receive
+// Returns a list of the index of the channel that was received from and the value
+type Select struct{}
+
+func (s Select) arity() int {
+	return 1
+}
+
+func (s Select) arityRange() (int, int) {
+	return 1, 255
+}
+
+func (s Select) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	var channels []*Channel
+	for _, argument := range arguments {
+		c, err := channelArgument("select", argument)
+		if err != nil {
+			return Value{}, err
+		}
+		channels = append(channels, c)
+	}
+
+	index, value, err := selectRecv(interpreter.scheduler, interpreter.task, channels)
+	if err != nil {
+		return Value{}, err
+	}
+	return objectValue(&LoxList{elements: []Value{intValue(int64(index)), value}}), nil
+}
+
+func (s Select) String() string {
+	return "<native fn>"
+}
+
+// join(task) waits for a task to finish and returns what its function returned
+// If the task failed, join fails with the same error
+type Join struct{}
+
+func (j Join) arity() int {
+	return 1
+}
+
+func (j Join) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	t, ok := arguments[0].object.(*Task)
+	if !ok {
+		return Value{}, fmt.Errorf("join expects a task, got %s", typeName(arguments[0]))
+	}
+	return interpreter.scheduler.join(interpreter.task, t)
+}
+
+func (j Join) String() string {
+	return "<native fn>"
+}
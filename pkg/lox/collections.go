@@ -0,0 +1,154 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// A list of values, created with [a, b, c]
+// Lists are passed around by reference
+type LoxList struct {
+	elements []Value
+}
+
+func (l *LoxList) String() string {
+	var parts []string
+	for _, element := range l.elements {
+		parts = append(parts, quoted(element))
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// A map from keys to values, created with {key: value}
+// Maps remember the order keys were added in, so iterating over them is predictable
+// Maps are passed around by reference
+type LoxMap struct {
+	keys    []Value
+	entries map[interface{}]mapEntry
+}
+
+type mapEntry struct {
+	key   Value
+	value Value
+	// Position of the key in keys
+	index int
+}
+
+// Wraps a *big.Int so it can be used as a Go map key
+type bigKey struct {
+	digits string
+}
+
+// Returns a new, empty map
+func NewLoxMap() *LoxMap {
+	return &LoxMap{entries: make(map[interface{}]mapEntry)}
+}
+
+// Converts a value into something usable as a Go map key
+// Numbers that are equal with == give the same key, so 1 and 1.0 are the same entry,
+// as are a *big.Int and the float with the same whole value. NaN isn't equal to
+// anything, itself included, so it can't be a key
+func mapKey(key Value) (interface{}, error) {
+	switch key.kind {
+	case nilKind, boolKind, stringKind, intKind:
+		return key.unwrap(), nil
+	case bigKind:
+		return bigKey{key.big().String()}, nil
+	case floatKind:
+		k := key.float()
+		if math.IsNaN(k) {
+			return nil, fmt.Errorf("NaN can't be used as a map key")
+		}
+		if k == math.Trunc(k) && k >= math.MinInt64 && k < math.MaxInt64 {
+			return int64(k), nil
+		}
+		// Whole floats too big for an int64 key the same as the *big.Int they equal
+		if !math.IsInf(k, 0) && k == math.Trunc(k) {
+			whole, _ := big.NewFloat(k).Int(nil)
+			return bigKey{whole.String()}, nil
+		}
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s can't be used as a map key", typeName(key))
+}
+
+// Sets the value for a key, adding the key if it isn't in the map yet
+func (m *LoxMap) Set(key, value Value) error {
+	k, err := mapKey(key)
+	if err != nil {
+		return err
+	}
+
+	if entry, ok := m.entries[k]; ok {
+		entry.value = value
+		m.entries[k] = entry
+		return nil
+	}
+
+	m.entries[k] = mapEntry{key: key, value: value, index: len(m.keys)}
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+// Gets the value for a key, and whether the key is in the map
+func (m *LoxMap) Get(key Value) (Value, bool) {
+	k, err := mapKey(key)
+	if err != nil {
+		return Value{}, false
+	}
+
+	entry, ok := m.entries[k]
+	return entry.value, ok
+}
+
+func (m *LoxMap) String() string {
+	var parts []string
+	for _, key := range m.keys {
+		value, _ := m.Get(key)
+		parts = append(parts, quoted(key)+": "+quoted(value))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// Formats a value inside a collection, putting quotes around strings
+func quoted(v Value) string {
+	if v.kind == stringKind {
+		return fmt.Sprintf("%q", v.str)
+	}
+	return v.String()
+}
+
+// Returns the name of a value's type for error messages
+func typeName(v Value) string {
+	switch v.kind {
+	case nilKind:
+		return "nil"
+	case boolKind:
+		return "bool"
+	case stringKind:
+		return "string"
+	case intKind, bigKind:
+		return "int"
+	case floatKind:
+		return "float"
+	}
+	switch v.object.(type) {
+	case *LoxList:
+		return "list"
+	case *LoxMap:
+		return "map"
+	case *Generator:
+		return "generator"
+	case *Channel:
+		return "channel"
+	case *Task:
+		return "task"
+	case Iterator:
+		return "iterator"
+	case LoxCallable:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v.object)
+}
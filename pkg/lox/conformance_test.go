@@ -0,0 +1,141 @@
+package lox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Annotations understood in testdata scripts, following the format of the
+// Crafting Interpreters test suite
+//
+//	print 1; // expect: 1
+//	a + "b"; // expect runtime error: bad operand for binary +: ...
+//	var = 1; // Error at '=': Expect variable name
+//	// [line 3] Error at end: Expect ; after value
+var (
+	expectOutput       = regexp.MustCompile(`// expect: ?(.*)`)
+	expectRuntimeError = regexp.MustCompile(`// expect runtime error: (.+)`)
+	expectError        = regexp.MustCompile(`// (Error.*)`)
+	expectLineError    = regexp.MustCompile(`// \[line (\d+)\] (Error.*)`)
+)
+
+// What running a test script should produce
+type expectation struct {
+	output       []string
+	errors       []string
+	runtimeError string
+}
+
+// Reads the expected output and errors out of the annotations in a script
+func parseExpectations(source string) expectation {
+	var e expectation
+
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+
+		if m := expectOutput.FindStringSubmatch(text); m != nil {
+			e.output = append(e.output, m[1])
+		} else if m := expectRuntimeError.FindStringSubmatch(text); m != nil {
+			// Runtime errors report the line they happened on
+			e.runtimeError = fmt.Sprintf("error at line %d: %s", line, m[1])
+		} else if m := expectLineError.FindStringSubmatch(text); m != nil {
+			lineNum, _ := strconv.Atoi(m[1])
+			e.errors = append(e.errors, fmt.Sprintf("[line %d] %s", lineNum, m[2]))
+		} else if m := expectError.FindStringSubmatch(text); m != nil {
+			e.errors = append(e.errors, fmt.Sprintf("[line %d] %s", line, m[1]))
+		}
+	}
+
+	return e
+}
+
+// Splits output into lines, dropping the trailing newline
+func outputLines(b *bytes.Buffer) []string {
+	text := strings.TrimSuffix(b.String(), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// Runs every script under testdata and compares what it does with its annotations
+func TestConformance(t *testing.T) {
+
+	// Task output has to come out in the same order every run
+	deterministicTasks = true
+	defer func() { deterministicTasks = false }()
+
+	var scripts []string
+	err := filepath.WalkDir("testdata", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(path) == ".lox" {
+			scripts = append(scripts, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, script := range scripts {
+		script := script
+		t.Run(filepath.ToSlash(strings.TrimPrefix(script, "testdata"+string(filepath.Separator))), func(t *testing.T) {
+			source, err := os.ReadFile(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := parseExpectations(string(source))
+
+			// Capture what the script prints and any compile errors it reports
+			var out, errs bytes.Buffer
+			errorOutput = &errs
+			defer func() { errorOutput = os.Stderr }()
+
+			runErr := Run(string(source), &out)
+
+			// Compare the printed output line by line
+			actual := outputLines(&out)
+			for n := 0; n < len(expected.output) || n < len(actual); n++ {
+				switch {
+				case n >= len(actual):
+					t.Errorf("missing output line %d: want %q", n+1, expected.output[n])
+				case n >= len(expected.output):
+					t.Errorf("unexpected output line %d: %q", n+1, actual[n])
+				case actual[n] != expected.output[n]:
+					t.Errorf("output line %d: got %q, want %q", n+1, actual[n], expected.output[n])
+				}
+			}
+
+			// Compare compile errors
+			actualErrors := outputLines(&errs)
+			if strings.Join(actualErrors, "\n") != strings.Join(expected.errors, "\n") {
+				t.Errorf("compile errors:\ngot:\n%s\nwant:\n%s", strings.Join(actualErrors, "\n"), strings.Join(expected.errors, "\n"))
+			}
+			if len(expected.errors) > 0 && runErr != ErrCompile {
+				t.Errorf("expected a compile error, got %v", runErr)
+			}
+
+			// Compare the runtime error
+			if len(expected.errors) == 0 {
+				actualRuntime := ""
+				if runErr != nil {
+					actualRuntime = runErr.Error()
+				}
+				if actualRuntime != expected.runtimeError {
+					t.Errorf("runtime error: got %q, want %q", actualRuntime, expected.runtimeError)
+				}
+			}
+		})
+	}
+}
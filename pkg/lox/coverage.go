@@ -0,0 +1,471 @@
+package lox
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Coverage records which statements of a script ran, how often each function was
+// called, and which way each branch went. The branches are the two arms of an if
+// (the else arm counts even when there's no else), whether a loop's body ran or the
+// loop ended, and whether the right side of an and, or or ?? was evaluated or
+// skipped.
+//
+// Everything that could run is found before the script runs, so code that never
+// ran is reported too. Coverage from several runs of the same script adds up.
+
+// Coverage records what ran in the scripts run with it
+type Coverage struct {
+	mu    sync.Mutex
+	files []*fileCoverage
+}
+
+// What ran in one script
+type fileCoverage struct {
+	mu     sync.Mutex
+	path   string
+	source string
+	// Number of times each statement ran, keyed by the statement's first token
+	statements map[Token]int
+	functions  map[Token]*functionCoverage
+	branches   map[Token]*branchCoverage
+}
+
+type functionCoverage struct {
+	name  string
+	line  int
+	calls int
+}
+
+// A point where the program goes one of two ways
+type branchCoverage struct {
+	line int
+	// What the arms are, such as "then" and "else"
+	arms [2]string
+	// Times each arm was taken
+	taken [2]int
+}
+
+// Arms of each kind of branch
+var (
+	ifArms      = [2]string{"then", "else"}
+	loopArms    = [2]string{"body", "exit"}
+	logicalArms = [2]string{"right side", "short-circuit"}
+)
+
+// NewCoverage returns a Coverage with nothing recorded
+func NewCoverage() *Coverage {
+	return &Coverage{}
+}
+
+// Run runs the source like Run, recording what ran under path
+// Returns ErrCompile if the source had errors, or the error that stopped the program
+func (c *Coverage) Run(source, path string, out io.Writer) error {
+	stmts, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+	i := NewInterpreter(out)
+	i.coverage = c.file(path, source, stmts)
+	return i.Interpret(stmts)
+}
+
+// Returns the coverage of a script, adding it with everything in the statements
+// marked as not run if it's new
+func (c *Coverage) file(path, source string, stmts []Stmt) *fileCoverage {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range c.files {
+		if f.path == path {
+			return f
+		}
+	}
+
+	f := &fileCoverage{
+		path:       path,
+		source:     source,
+		statements: map[Token]int{},
+		functions:  map[Token]*functionCoverage{},
+		branches:   map[Token]*branchCoverage{},
+	}
+	var add func(stmts []Stmt)
+	add = func(stmts []Stmt) {
+		for _, stmt := range stmts {
+			f.addStmt(stmt)
+			inspectStmt(stmt, add)
+		}
+	}
+	add(stmts)
+	c.files = append(c.files, f)
+	return f
+}
+
+// Adds a statement, and the branches in it, as not run
+func (f *fileCoverage) addStmt(stmt Stmt) {
+
+	if _, ok := stmt.(BlockStmt); !ok {
+		f.statements[stmtToken(stmt)] = 0
+	}
+
+	var exprs []Expr
+	switch s := stmt.(type) {
+	case ExprStmt:
+		exprs = append(exprs, s.expression)
+	case ForInStmt:
+		f.addBranch(s.keyword, loopArms)
+		exprs = append(exprs, s.iterable)
+	case FuncStmt:
+		f.functions[s.name] = &functionCoverage{name: s.name.lexeme, line: s.name.line}
+	case IfStmt:
+		f.addBranch(s.keyword, ifArms)
+		exprs = append(exprs, s.condition)
+	case PrintStmt:
+		exprs = append(exprs, s.expression)
+	case ReturnStmt:
+		exprs = append(exprs, s.value)
+	case VarStmt:
+		exprs = append(exprs, s.initializer)
+	case WhileStmt:
+		f.addBranch(s.keyword, loopArms)
+		exprs = append(exprs, s.condition)
+	case YieldStmt:
+		exprs = append(exprs, s.value)
+	}
+
+	for _, expr := range exprs {
+		inspectExpr(expr, func(e Expr) {
+			if l, ok := e.(Logical); ok {
+				f.addBranch(l.operator, logicalArms)
+			}
+		})
+	}
+}
+
+func (f *fileCoverage) addBranch(at Token, arms [2]string) {
+	f.branches[at] = &branchCoverage{line: startLine(at), arms: arms}
+}
+
+// Calls f with an expression and every expression inside it
+func inspectExpr(expr Expr, f func(Expr)) {
+
+	if expr == nil {
+		return
+	}
+	f(expr)
+
+	var inside []Expr
+	switch e := expr.(type) {
+	case Assign:
+		inside = []Expr{e.value}
+	case Binary:
+		inside = []Expr{e.left, e.right}
+	case Call:
+		inside = append([]Expr{e.callee}, e.arguments...)
+	case Conditional:
+		inside = []Expr{e.condition, e.thenBranch, e.elseBranch}
+	case Grouping:
+		inside = []Expr{e.expression}
+	case Interpolation:
+		inside = e.parts
+	case ListLiteral:
+		inside = e.elements
+	case Logical:
+		inside = []Expr{e.left, e.right}
+	case MapLiteral:
+		inside = append(append(inside, e.keys...), e.values...)
+	case Spawn:
+		inside = []Expr{e.call}
+	case Unary:
+		inside = []Expr{e.right}
+	}
+	for _, e := range inside {
+		inspectExpr(e, f)
+	}
+}
+
+// Called before each statement runs
+func (f *fileCoverage) statement(stmt Stmt) {
+	if _, ok := stmt.(BlockStmt); ok {
+		return
+	}
+	f.mu.Lock()
+	f.statements[stmtToken(stmt)]++
+	f.mu.Unlock()
+}
+
+// Called when a function is called
+func (f *fileCoverage) call(name Token) {
+	f.mu.Lock()
+	if function, ok := f.functions[name]; ok {
+		function.calls++
+	}
+	f.mu.Unlock()
+}
+
+// Called when a branch goes one way, 0 for the first arm and 1 for the second
+func (f *fileCoverage) branch(at Token, arm int) {
+	f.mu.Lock()
+	if b, ok := f.branches[at]; ok {
+		b.taken[arm]++
+	}
+	f.mu.Unlock()
+}
+
+// Returns the most times a statement on each line ran, for lines with statements
+func (f *fileCoverage) lines() map[int]int {
+	lines := map[int]int{}
+	for token, count := range f.statements {
+		line := startLine(token)
+		if n, ok := lines[line]; !ok || count > n {
+			lines[line] = count
+		}
+	}
+	return lines
+}
+
+// Returns the branches, in the order they appear in the source
+func (f *fileCoverage) sortedBranches() []*branchCoverage {
+	var tokens []Token
+	for token := range f.branches {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(a, b int) bool {
+		if startLine(tokens[a]) != startLine(tokens[b]) {
+			return startLine(tokens[a]) < startLine(tokens[b])
+		}
+		return tokens[a].column < tokens[b].column
+	})
+	var list []*branchCoverage
+	for _, token := range tokens {
+		list = append(list, f.branches[token])
+	}
+	return list
+}
+
+// Returns the number of statements that ran and the number there are, and the same
+// for the arms of branches
+func (f *fileCoverage) counts() (statementsRun, statements, armsTaken, arms int) {
+	for _, count := range f.statements {
+		statements++
+		if count > 0 {
+			statementsRun++
+		}
+	}
+	for _, b := range f.branches {
+		for _, taken := range b.taken {
+			arms++
+			if taken > 0 {
+				armsTaken++
+			}
+		}
+	}
+	return
+}
+
+// Returns part as a percentage of whole, counting nothing out of nothing as all of it
+func percent(part, whole int) float64 {
+	if whole == 0 {
+		return 100
+	}
+	return 100 * float64(part) / float64(whole)
+}
+
+// WriteSummary writes the share of statements and branches that ran in each script,
+// and in all of them if there are several
+func (c *Coverage) WriteSummary(out io.Writer) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var totals [4]int
+	for _, f := range c.files {
+		f.mu.Lock()
+		statementsRun, statements, armsTaken, arms := f.counts()
+		f.mu.Unlock()
+		fmt.Fprintf(out, "coverage: %.1f%% of statements, %.1f%% of branches in %s\n", percent(statementsRun, statements), percent(armsTaken, arms), f.path)
+		totals[0] += statementsRun
+		totals[1] += statements
+		totals[2] += armsTaken
+		totals[3] += arms
+	}
+	if len(c.files) > 1 {
+		fmt.Fprintf(out, "coverage: %.1f%% of statements, %.1f%% of branches in total\n", percent(totals[0], totals[1]), percent(totals[2], totals[3]))
+	}
+}
+
+// WriteLCOV writes what ran in the LCOV tracefile format read by genhtml and most
+// coverage services
+func (c *Coverage) WriteLCOV(out io.Writer) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range c.files {
+		f.mu.Lock()
+		fmt.Fprintf(&b, "TN:\nSF:%s\n", f.path)
+
+		var functions []*functionCoverage
+		for _, function := range f.functions {
+			functions = append(functions, function)
+		}
+		sort.Slice(functions, func(a, b int) bool { return functions[a].line < functions[b].line })
+		functionsHit := 0
+		for _, function := range functions {
+			fmt.Fprintf(&b, "FN:%d,%s\n", function.line, function.name)
+		}
+		for _, function := range functions {
+			fmt.Fprintf(&b, "FNDA:%d,%s\n", function.calls, function.name)
+			if function.calls > 0 {
+				functionsHit++
+			}
+		}
+		fmt.Fprintf(&b, "FNF:%d\nFNH:%d\n", len(functions), functionsHit)
+
+		branchesHit, branches := 0, 0
+		for block, branch := range f.sortedBranches() {
+			ran := branch.taken[0]+branch.taken[1] > 0
+			for arm, taken := range branch.taken {
+				// A branch that was never reached is written as -
+				count := "-"
+				if ran {
+					count = fmt.Sprint(taken)
+				}
+				fmt.Fprintf(&b, "BRDA:%d,%d,%d,%s\n", branch.line, block, arm, count)
+				branches++
+				if taken > 0 {
+					branchesHit++
+				}
+			}
+		}
+		fmt.Fprintf(&b, "BRF:%d\nBRH:%d\n", branches, branchesHit)
+
+		lines := f.lines()
+		var numbers []int
+		for line := range lines {
+			numbers = append(numbers, line)
+		}
+		sort.Ints(numbers)
+		linesHit := 0
+		for _, line := range numbers {
+			fmt.Fprintf(&b, "DA:%d,%d\n", line, lines[line])
+			if lines[line] > 0 {
+				linesHit++
+			}
+		}
+		fmt.Fprintf(&b, "LF:%d\nLH:%d\nend_of_record\n", len(numbers), linesHit)
+		f.mu.Unlock()
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// A line of source in the HTML report
+type coverageLine struct {
+	Number int
+	Text   string
+	// covered, partial, uncovered, or empty for lines with nothing to run
+	Class string
+	Count string
+	// Describes the branches on the line
+	Title string
+}
+
+type coverageFile struct {
+	Path                 string
+	Statements, Branches string
+	Lines                []coverageLine
+}
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>golox coverage</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table.summary td, table.summary th { padding: 0.2em 1em; text-align: left; }
+pre { font-size: 90%; line-height: 1.4; }
+pre span.line { display: block; min-height: 1.4em; }
+.number, .count { display: inline-block; text-align: right; color: #888; padding-right: 1em; }
+.number { width: 4em; }
+.count { width: 5em; }
+.covered { background: #dfd; }
+.partial { background: #ffd; }
+.uncovered { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Coverage</h1>
+<table class="summary">
+<tr><th>Script</th><th>Statements</th><th>Branches</th></tr>
+{{range $n, $f := .}}<tr><td><a href="#file{{$n}}">{{$f.Path}}</a></td><td>{{$f.Statements}}</td><td>{{$f.Branches}}</td></tr>
+{{end}}</table>
+{{range $n, $f := .}}
+<h2 id="file{{$n}}">{{$f.Path}}</h2>
+<pre>{{range $f.Lines}}<span class="line {{.Class}}"{{if .Title}} title="{{.Title}}"{{end}}><span class="number">{{.Number}}</span><span class="count">{{.Count}}</span>{{.Text}}</span>{{end}}</pre>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes a page showing the source of each script, with the lines that ran
+// in green, the lines that didn't in red, and lines with a branch that only went one
+// way in yellow
+func (c *Coverage) WriteHTML(out io.Writer) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var files []coverageFile
+	for _, f := range c.files {
+		f.mu.Lock()
+		statementsRun, statements, armsTaken, arms := f.counts()
+		file := coverageFile{
+			Path:       f.path,
+			Statements: fmt.Sprintf("%.1f%%", percent(statementsRun, statements)),
+			Branches:   fmt.Sprintf("%.1f%%", percent(armsTaken, arms)),
+		}
+
+		// Lines with a statement that didn't run, or a branch arm not taken, are partial
+		lines := f.lines()
+		missed := map[int]bool{}
+		for token, count := range f.statements {
+			missed[startLine(token)] = missed[startLine(token)] || count == 0
+		}
+		titles := map[int][]string{}
+		for _, b := range f.sortedBranches() {
+			for arm, taken := range b.taken {
+				titles[b.line] = append(titles[b.line], fmt.Sprintf("%s %d", b.arms[arm], taken))
+				missed[b.line] = missed[b.line] || taken == 0
+			}
+		}
+
+		for n, text := range strings.Split(strings.TrimSuffix(f.source, "\n"), "\n") {
+			line := coverageLine{Number: n + 1, Text: text, Title: strings.Join(titles[n+1], ", ")}
+			if count, ok := lines[n+1]; ok {
+				line.Count = fmt.Sprint(count)
+				switch {
+				case count == 0:
+					line.Class = "uncovered"
+				case missed[n+1]:
+					line.Class = "partial"
+				default:
+					line.Class = "covered"
+				}
+			}
+			file.Lines = append(file.Lines, line)
+		}
+		f.mu.Unlock()
+		files = append(files, file)
+	}
+
+	return coverageTemplate.Execute(out, files)
+}
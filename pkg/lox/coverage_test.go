@@ -0,0 +1,78 @@
+package lox
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const coverageSource = `fun sign(n) {
+  if (n < 0) return -1;
+  return 1;
+}
+var a = sign(2) > 0 or sign(-2) > 0;
+for (x in []) print x;
+`
+
+func TestCoverage(t *testing.T) {
+
+	c := NewCoverage()
+	if err := c.Run(coverageSource, "sign.lox", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var lcov strings.Builder
+	if err := c.WriteLCOV(&lcov); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:sign.lox
+FN:1,sign
+FNDA:1,sign
+FNF:1
+FNH:1
+BRDA:2,0,0,0
+BRDA:2,0,1,1
+BRDA:5,1,0,0
+BRDA:5,1,1,1
+BRDA:6,2,0,0
+BRDA:6,2,1,1
+BRF:6
+BRH:3
+DA:1,1
+DA:2,1
+DA:3,1
+DA:5,1
+DA:6,1
+LF:5
+LH:5
+end_of_record
+`
+	if lcov.String() != want {
+		t.Errorf("expected LCOV\n%s\ngot\n%s", want, lcov.String())
+	}
+
+	// Running again adds to what was recorded
+	c = NewCoverage()
+	c.Run(coverageSource, "sign.lox", ioutil.Discard)
+	c.Run(coverageSource, "sign.lox", ioutil.Discard)
+	var summary strings.Builder
+	c.WriteSummary(&summary)
+	if got := summary.String(); got != "coverage: 71.4% of statements, 50.0% of branches in sign.lox\n" {
+		t.Errorf("unexpected summary %q", got)
+	}
+
+	var html strings.Builder
+	if err := c.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<span class="line partial" title="then 0, else 2"><span class="number">2</span><span class="count">2</span>  if (n &lt; 0) return -1;</span>`,
+		`<span class="line covered"><span class="number">3</span>`,
+		`<td>71.4%</td><td>50.0%</td>`,
+	} {
+		if !strings.Contains(html.String(), want) {
+			t.Errorf("expected %s in the HTML report", want)
+		}
+	}
+}
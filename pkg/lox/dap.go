@@ -0,0 +1,460 @@
+package lox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The debug adapter speaks the Debug Adapter Protocol, so editors can drive the
+// debugger. Messages are JSON framed with a Content-Length header, like the
+// language server's.
+//
+// A session goes: initialize, launch with the path of the script, setBreakpoints,
+// then configurationDone, which starts the program. The program runs on its own
+// goroutine while requests are handled, and there is a single thread, with id 1.
+// What the program prints is sent to the client as output events.
+
+type debugAdapter struct {
+	in *bufio.Reader
+
+	// Guards writing messages, and the state shared with the program's goroutine
+	mu  sync.Mutex
+	out io.Writer
+	seq int
+	// Set while the program is stopped
+	isStopped bool
+	// Scopes and values the client can expand, numbered from 1 by variablesReference
+	// The numbers only last until the program carries on
+	references []interface{}
+
+	debugger *Debugger
+	// Tells the stopped program how to carry on
+	resume chan stepMode
+	// Closed when the program has finished
+	finished chan struct{}
+
+	path        string
+	stmts       []Stmt
+	stopOnEntry bool
+	// Lines with a statement on them, where breakpoints can be set
+	lines map[int]bool
+}
+
+// Requests that let the stopped program carry on, and how
+var dapSteps = map[string]stepMode{
+	"continue": stepContinue,
+	"next":     stepOver,
+	"stepIn":   stepIn,
+	"stepOut":  stepOut,
+}
+
+// A message read from the client, which is always a request
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	Line      int    `json:"line"`
+	Condition string `json:"condition"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// ServeDebugAdapter answers Debug Adapter Protocol requests read from in, writing
+// replies and events to out, until the client disconnects or in ends
+func ServeDebugAdapter(in io.Reader, out io.Writer) error {
+
+	a := &debugAdapter{in: bufio.NewReader(in), out: out, resume: make(chan stepMode)}
+	a.debugger = newDebugger(a.stopped, a.warn)
+
+	for {
+		request, err := a.read()
+		if err == io.EOF {
+			a.stop()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		body, err := a.handle(request)
+		response := map[string]interface{}{
+			"type":        "response",
+			"request_seq": request.Seq,
+			"command":     request.Command,
+			"success":     err == nil,
+		}
+		if err != nil {
+			response["message"] = err.Error()
+		} else if body != nil {
+			response["body"] = body
+		}
+		if err := a.send(response); err != nil {
+			return err
+		}
+
+		// The program carries on after the reply, so any events it sends come after it
+		if mode, ok := dapSteps[request.Command]; ok && err == nil {
+			a.carryOn(mode)
+		}
+		switch request.Command {
+		case "initialize":
+			a.event("initialized", nil)
+		case "configurationDone":
+			a.start()
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+func (a *debugAdapter) read() (dapRequest, error) {
+
+	var request dapRequest
+	headers, err := textproto.NewReader(a.in).ReadMIMEHeader()
+	if err != nil {
+		return request, err
+	}
+	length, err := strconv.Atoi(headers.Get("Content-Length"))
+	if err != nil {
+		return request, fmt.Errorf("bad Content-Length header: %v", err)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(a.in, body); err != nil {
+		return request, err
+	}
+	err = json.Unmarshal(body, &request)
+	return request, err
+}
+
+// Writes a message, numbering it
+func (a *debugAdapter) send(message map[string]interface{}) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	message["seq"] = a.seq
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(a.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (a *debugAdapter) event(name string, body interface{}) error {
+	message := map[string]interface{}{"type": "event", "event": name}
+	if body != nil {
+		message["body"] = body
+	}
+	return a.send(message)
+}
+
+// Sends what the program prints as output events
+type dapOutput struct {
+	adapter *debugAdapter
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	err := o.adapter.event("output", map[string]string{"category": "stdout", "output": string(p)})
+	return len(p), err
+}
+
+// Runs the request, returning the body of the response
+func (a *debugAdapter) handle(request dapRequest) (interface{}, error) {
+
+	// Only the parts of the arguments each command needs are filled in
+	var args struct {
+		Program            string          `json:"program"`
+		StopOnEntry        bool            `json:"stopOnEntry"`
+		Source             dapSource       `json:"source"`
+		Breakpoints        []dapBreakpoint `json:"breakpoints"`
+		FrameID            int             `json:"frameId"`
+		VariablesReference int             `json:"variablesReference"`
+		Expression         string          `json:"expression"`
+	}
+	if len(request.Arguments) > 0 {
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	switch request.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		return nil, a.launch(args.Program, args.StopOnEntry)
+	case "setBreakpoints":
+		return a.setBreakpoints(args.Breakpoints), nil
+	case "configurationDone":
+		if a.stmts == nil {
+			return nil, fmt.Errorf("there is no program to run, launch one first")
+		}
+		return nil, nil
+	case "threads":
+		return map[string]interface{}{"threads": []map[string]interface{}{{"id": 1, "name": "main"}}}, nil
+	case "pause":
+		a.debugger.pause()
+		return nil, nil
+	case "disconnect", "terminate":
+		a.stop()
+		return nil, nil
+	}
+
+	// Everything else needs the program to be stopped
+	a.mu.Lock()
+	stopped := a.isStopped
+	a.mu.Unlock()
+	if !stopped {
+		return nil, fmt.Errorf("the program is running")
+	}
+
+	switch request.Command {
+	case "continue":
+		return map[string]bool{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut":
+		return nil, nil
+	case "stackTrace":
+		return a.stackTrace(), nil
+	case "scopes":
+		return a.scopes(args.FrameID)
+	case "variables":
+		return a.variables(args.VariablesReference)
+	case "evaluate":
+		// Frames are numbered from 1, and a missing frame means the innermost
+		frame := args.FrameID - 1
+		if frame < 0 {
+			frame = 0
+		}
+		value, err := a.debugger.evaluateSource(frame, args.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": quoted(value), "variablesReference": a.reference(value)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported request %s", request.Command)
+}
+
+// Loads the script to debug
+func (a *debugAdapter) launch(path string, stopOnEntry bool) error {
+
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Send the compile errors back in the response
+	var errs bytes.Buffer
+	output := errorOutput
+	errorOutput = &errs
+	stmts, err := parseSource(string(source))
+	errorOutput = output
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(errs.String()))
+	}
+
+	a.path, a.stmts, a.stopOnEntry = path, stmts, stopOnEntry
+	a.lines = map[int]bool{}
+	var mark func(stmts []Stmt)
+	mark = func(stmts []Stmt) {
+		for _, stmt := range stmts {
+			a.lines[startLine(stmtToken(stmt))] = true
+			inspectStmt(stmt, mark)
+		}
+	}
+	mark(stmts)
+	return nil
+}
+
+// Calls f with the statements nested directly inside a statement
+func inspectStmt(stmt Stmt, f func([]Stmt)) {
+	switch s := stmt.(type) {
+	case BlockStmt:
+		f(s.statements)
+	case ForInStmt:
+		f([]Stmt{s.body})
+	case FuncStmt:
+		f(s.body)
+	case IfStmt:
+		f([]Stmt{s.branch})
+		if s.elseStmt != nil {
+			f([]Stmt{s.elseStmt})
+		}
+	case WhileStmt:
+		f([]Stmt{s.body})
+	}
+}
+
+// Replaces the breakpoints, reporting which ones are on lines with statements
+func (a *debugAdapter) setBreakpoints(requested []dapBreakpoint) interface{} {
+
+	a.debugger.clearBreakpoints()
+	breakpoints := []map[string]interface{}{}
+	for _, b := range requested {
+		result := map[string]interface{}{"line": b.Line, "verified": false}
+		if !a.lines[b.Line] {
+			result["message"] = "there is no statement on this line"
+		} else if err := a.debugger.setBreakpoint(b.Line, b.Condition); err != nil {
+			result["message"] = err.Error()
+		} else {
+			result["verified"] = true
+		}
+		breakpoints = append(breakpoints, result)
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}
+}
+
+// Starts the program on its own goroutine
+func (a *debugAdapter) start() {
+
+	a.finished = make(chan struct{})
+	go func() {
+		defer close(a.finished)
+
+		exitCode := 0
+		if err := a.debugger.run(a.stmts, dapOutput{a}, a.stopOnEntry); err != nil {
+			a.event("output", map[string]string{"category": "stderr", "output": err.Error() + "\n"})
+			exitCode = 1
+		}
+		a.event("exited", map[string]int{"exitCode": exitCode})
+		a.event("terminated", nil)
+	}()
+}
+
+// Called on the program's goroutine when it stops, waiting to be told how to carry on
+func (a *debugAdapter) stopped(reason string) stepMode {
+
+	a.mu.Lock()
+	a.isStopped = true
+	a.references = nil
+	a.mu.Unlock()
+
+	a.event("stopped", map[string]interface{}{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	return <-a.resume
+}
+
+// Sends what the debugger couldn't do as console output
+func (a *debugAdapter) warn(message string) {
+	a.event("output", map[string]string{"category": "console", "output": "warning: " + message + "\n"})
+}
+
+// Lets the stopped program carry on
+func (a *debugAdapter) carryOn(mode stepMode) {
+	a.mu.Lock()
+	a.isStopped = false
+	a.mu.Unlock()
+	a.resume <- mode
+}
+
+// Ends the program, if it's running, and waits for it to finish
+func (a *debugAdapter) stop() {
+	if a.finished == nil {
+		return
+	}
+	a.debugger.end()
+
+	// The program may be stopped, or about to stop, waiting to be told to carry on
+	for {
+		select {
+		case <-a.finished:
+			return
+		case a.resume <- stepQuit:
+		}
+	}
+}
+
+// Numbers a scope, or a list or map with something in it, so the client can ask
+// for what's inside
+// Returns 0 for values with nothing inside
+func (a *debugAdapter) reference(value interface{}) int {
+	if v, ok := value.(Value); ok && len(children(v)) == 0 {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.references = append(a.references, value)
+	return len(a.references)
+}
+
+func (a *debugAdapter) stackTrace() interface{} {
+	frames := []map[string]interface{}{}
+	for n, frame := range a.debugger.stack() {
+		frames = append(frames, map[string]interface{}{
+			"id":     n + 1,
+			"name":   frame.name,
+			"line":   frame.line,
+			"column": 1,
+			"source": dapSource{Name: filepath.Base(a.path), Path: a.path},
+		})
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+func (a *debugAdapter) scopes(frameID int) (interface{}, error) {
+	frame, err := a.debugger.frame(frameID - 1)
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]interface{}{}
+	for _, scope := range scopes(frame.environment) {
+		list = append(list, map[string]interface{}{
+			"name":               scope.name,
+			"variablesReference": a.reference(scope),
+			"expensive":          false,
+		})
+	}
+	return map[string]interface{}{"scopes": list}, nil
+}
+
+func (a *debugAdapter) variables(reference int) (interface{}, error) {
+
+	a.mu.Lock()
+	if reference < 1 || reference > len(a.references) {
+		a.mu.Unlock()
+		return nil, fmt.Errorf("there are no variables numbered %d", reference)
+	}
+	value := a.references[reference-1]
+	a.mu.Unlock()
+
+	var inside []debugVariable
+	switch v := value.(type) {
+	case debugScope:
+		inside = v.variables()
+	case Value:
+		inside = children(v)
+	}
+
+	list := []dapVariable{}
+	for _, v := range inside {
+		list = append(list, dapVariable{v.name, quoted(v.value), typeName(v.value), a.reference(v.value)})
+	}
+	return map[string]interface{}{"variables": list}, nil
+}
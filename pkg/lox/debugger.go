@@ -0,0 +1,431 @@
+package lox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// The debugger stops a program before statements, at breakpoints or while stepping,
+// and lets a front end look at the call stack and the variables in scope before
+// carrying on. The interpreter asks it before running each statement.
+//
+// There are two front ends: the terminal debugger in debugshell.go and the Debug
+// Adapter Protocol server for editors in dap.go.
+//
+// Generator bodies run on interpreters of their own, but only while the code that
+// resumed them waits, so they stop like the rest of the program and their calls show
+// on top of the caller's. Spawned tasks run alongside the program and never stop.
+// A breakpoint they pass is reported once through warn instead.
+
+// How the program carries on after it stops
+type stepMode int
+
+const (
+	// Run until a breakpoint
+	stepContinue stepMode = iota
+	// Stop at the next statement
+	stepIn
+	// Stop at the next statement in the same function or a caller
+	stepOver
+	// Stop at the next statement in a caller
+	stepOut
+	// End the program
+	stepQuit
+)
+
+// Returned by the statement that was about to run when the debugger ends the program
+var errDebuggerQuit = errors.New("program ended by the debugger")
+
+type breakpoint struct {
+	line int
+	// The condition as written, and parsed, if the breakpoint has one
+	condition string
+	expr      Expr
+}
+
+// A function call that is running, or the program itself
+type callFrame struct {
+	name string
+	// Line of the statement the frame is running
+	line        int
+	environment *Environment
+}
+
+// Frames are kept by the interpreter running them, so a generator's calls stay with it
+// while it is paused. A running generator's frames are stacked on its caller's
+func (i *Interpreter) stackDepth() int {
+	depth := 0
+	for ; i != nil; i = i.caller {
+		depth += len(i.frames)
+	}
+	return depth
+}
+
+// Debugger controls a program being debugged
+type Debugger struct {
+	// Called when the program stops, with the reason it stopped: "entry", "breakpoint",
+	// "step" or "pause"
+	// Returns once the program should carry on, saying how
+	stopped func(reason string) stepMode
+	// Called with a message about something the debugger couldn't do, such as stop
+	// a task at a breakpoint. Can be called from any task
+	warn func(message string)
+
+	// Guards what front ends can change while the program runs
+	mu          sync.Mutex
+	breakpoints map[int]breakpoint
+	// Set to stop at the next statement
+	pauseRequested bool
+	// Set to end the program at the next statement
+	quit bool
+	// Breakpoint lines a task has passed, which are only reported once
+	warned map[int]bool
+
+	interpreter *Interpreter
+	// The interpreter running the statement the program last stopped at
+	current *Interpreter
+	mode    stepMode
+	// Set until the first statement runs, to stop there
+	entry bool
+	// Set while evaluating an expression for the front end, which never stops
+	evaluating bool
+	// Number of frames when the last step began
+	stepDepth int
+	// Line and depth of the last statement, so a line with several statements on it,
+	// such as the clauses of a for, is only stopped at once each time it runs
+	lastLine, lastDepth int
+}
+
+// Returns a debugger that calls stopped whenever the program stops, and warn with
+// anything it can't do
+func newDebugger(stopped func(reason string) stepMode, warn func(message string)) *Debugger {
+	return &Debugger{stopped: stopped, warn: warn, breakpoints: map[int]breakpoint{}, warned: map[int]bool{}}
+}
+
+// Runs the program under the debugger, writing what it prints to out
+// Stops before the first statement if stopOnEntry is set
+func (d *Debugger) run(stmts []Stmt, out io.Writer, stopOnEntry bool) error {
+
+	d.interpreter = NewInterpreter(out)
+	d.interpreter.debugger = d
+	d.interpreter.frames = []*callFrame{{name: "<script>", environment: d.interpreter.environment}}
+	d.current = d.interpreter
+	d.entry = stopOnEntry
+
+	err := d.interpreter.Interpret(stmts)
+	if d.ended() {
+		return nil
+	}
+	return err
+}
+
+// Sets a breakpoint on a line, which only stops the program when the condition is
+// true if there is one
+func (d *Debugger) setBreakpoint(line int, condition string) error {
+
+	b := breakpoint{line: line, condition: condition}
+	if condition != "" {
+		expr, err := parseExpression(condition)
+		if err != nil {
+			return err
+		}
+		b.expr = expr
+	}
+
+	d.mu.Lock()
+	d.breakpoints[line] = b
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *Debugger) clearBreakpoint(line int) {
+	d.mu.Lock()
+	delete(d.breakpoints, line)
+	d.mu.Unlock()
+}
+
+func (d *Debugger) clearBreakpoints() {
+	d.mu.Lock()
+	d.breakpoints = map[int]breakpoint{}
+	d.mu.Unlock()
+}
+
+// Returns the breakpoints, sorted by line
+func (d *Debugger) breakpointList() []breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var list []breakpoint
+	for _, b := range d.breakpoints {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].line < list[b].line })
+	return list
+}
+
+// Stops the running program at the next statement
+func (d *Debugger) pause() {
+	d.mu.Lock()
+	d.pauseRequested = true
+	d.mu.Unlock()
+}
+
+// Ends the running program at the next statement
+func (d *Debugger) end() {
+	d.mu.Lock()
+	d.quit = true
+	d.mu.Unlock()
+}
+
+func (d *Debugger) ended() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.quit
+}
+
+// Called when a function starts running in a new environment
+func (d *Debugger) enter(i *Interpreter, name string, environment *Environment) {
+	i.frames = append(i.frames, &callFrame{name: name, environment: environment})
+}
+
+// Called when a function returns
+func (d *Debugger) leave(i *Interpreter) {
+	i.frames = i.frames[:len(i.frames)-1]
+}
+
+// Reports whether the debugger can stop the interpreter, which it can for the program
+// and the generators it resumes, but not for spawned tasks
+func (d *Debugger) follows(i *Interpreter) bool {
+	return i.task == d.interpreter.task
+}
+
+// Called before each statement, stopping the program if it should stop there
+func (d *Debugger) statement(i *Interpreter, stmt Stmt) error {
+
+	// A block isn't a step of its own, the statements in it are
+	if _, ok := stmt.(BlockStmt); ok {
+		return nil
+	}
+
+	line := startLine(stmtToken(stmt))
+	if !d.follows(i) {
+		return d.passed(line)
+	}
+	if d.evaluating {
+		return nil
+	}
+
+	d.current = i
+	depth := i.stackDepth()
+	top := i.frames[len(i.frames)-1]
+	top.line, top.environment = line, i.environment
+
+	d.mu.Lock()
+	quit, pause := d.quit, d.pauseRequested
+	d.pauseRequested = false
+	b, isBreakpoint := d.breakpoints[line]
+	d.mu.Unlock()
+
+	if quit {
+		return errDebuggerQuit
+	}
+
+	newLine := line != d.lastLine || depth != d.lastDepth
+	d.lastLine, d.lastDepth = line, depth
+
+	var reason string
+	switch {
+	case d.entry:
+		reason = "entry"
+		d.entry = false
+	case pause:
+		reason = "pause"
+	case !newLine:
+	case isBreakpoint && d.holds(b):
+		reason = "breakpoint"
+	case d.mode == stepIn,
+		d.mode == stepOver && depth <= d.stepDepth,
+		d.mode == stepOut && depth < d.stepDepth:
+		reason = "step"
+	}
+	if reason == "" {
+		return nil
+	}
+
+	d.mode, d.stepDepth = d.stopped(reason), depth
+	if d.mode == stepQuit {
+		d.end()
+	}
+	if d.ended() {
+		return errDebuggerQuit
+	}
+	return nil
+}
+
+// Called when a loop has run its body, so a line in the loop stops again on the next
+// pass even if nothing on another line ran in between
+func (d *Debugger) iterated(i *Interpreter) {
+	if d.follows(i) {
+		d.lastLine = 0
+	}
+}
+
+// Called before each statement of a spawned task, which keeps running whatever the
+// debugger is doing, but still ends with the program
+func (d *Debugger) passed(line int) error {
+
+	d.mu.Lock()
+	quit := d.quit
+	_, isBreakpoint := d.breakpoints[line]
+	warn := isBreakpoint && !d.warned[line]
+	if warn {
+		d.warned[line] = true
+	}
+	d.mu.Unlock()
+
+	if quit {
+		return errDebuggerQuit
+	}
+	if warn {
+		d.warn(fmt.Sprintf("breakpoint at line %d was passed by a spawned task, which the debugger can't stop", line))
+	}
+	return nil
+}
+
+// Reports whether a breakpoint's condition is true
+// A condition that fails to evaluate counts as true, so the mistake can be seen
+func (d *Debugger) holds(b breakpoint) bool {
+	if b.expr == nil {
+		return true
+	}
+	value, err := d.evaluate(0, b.expr)
+	return err != nil || value.truthy()
+}
+
+// Returns the frames of the stopped program, innermost first
+func (d *Debugger) stack() []*callFrame {
+	var frames []*callFrame
+	for i := d.current; i != nil; i = i.caller {
+		for n := len(i.frames) - 1; n >= 0; n-- {
+			frames = append(frames, i.frames[n])
+		}
+	}
+	return frames
+}
+
+// Returns the frame n calls out from the innermost one
+func (d *Debugger) frame(n int) (*callFrame, error) {
+	frames := d.stack()
+	if n < 0 || n >= len(frames) {
+		return nil, fmt.Errorf("there is no frame %d", n)
+	}
+	return frames[n], nil
+}
+
+// Evaluates an expression in the scope of the frame n calls out from the innermost one
+func (d *Debugger) evaluate(n int, expr Expr) (Value, error) {
+
+	frame, err := d.frame(n)
+	if err != nil {
+		return Value{}, err
+	}
+
+	// The program is stopped part way through, so put back anything evaluating changes
+	i := d.interpreter
+	environment, value := i.environment, i.value
+	defer func() { i.environment, i.value, d.evaluating = environment, value, false }()
+
+	i.environment = frame.environment
+	d.evaluating = true
+	return i.evaluate(expr)
+}
+
+// Parses and evaluates an expression in the scope of the frame n calls out from the
+// innermost one
+func (d *Debugger) evaluateSource(n int, source string) (Value, error) {
+	expr, err := parseExpression(source)
+	if err != nil {
+		return Value{}, err
+	}
+	return d.evaluate(n, expr)
+}
+
+// A scope in the environment chain of a frame
+type debugScope struct {
+	name        string
+	environment *Environment
+}
+
+// Returns the scopes a frame can see, from the innermost out to the globals
+// The builtins are left out
+func scopes(environment *Environment) []debugScope {
+	var list []debugScope
+	for env := environment; env != nil && env.enclosing != nil; env = env.enclosing {
+		name := "Enclosing"
+		if env.enclosing.enclosing == nil {
+			name = "Globals"
+		} else if env == environment {
+			name = "Locals"
+		}
+		list = append(list, debugScope{name, env})
+	}
+	return list
+}
+
+// A variable in a scope, or an element of a list or map
+type debugVariable struct {
+	name  string
+	value Value
+}
+
+// Returns the variables defined in a scope, sorted by name
+func (s debugScope) variables() []debugVariable {
+	var list []debugVariable
+	for _, name := range s.environment.names() {
+		value, _ := s.environment.Get(Variable{token: Token{lexeme: name}})
+		list = append(list, debugVariable{name, value})
+	}
+	return list
+}
+
+// Returns the elements of a list or the entries of a map, or nothing for other values
+func children(value Value) []debugVariable {
+	var list []debugVariable
+	switch v := value.object.(type) {
+	case *LoxList:
+		for n, element := range v.elements {
+			list = append(list, debugVariable{fmt.Sprintf("[%d]", n), element})
+		}
+	case *LoxMap:
+		for _, key := range v.keys {
+			entry, _ := v.Get(key)
+			list = append(list, debugVariable{"[" + quoted(key) + "]", entry})
+		}
+	}
+	return list
+}
+
+// Parses a single expression, such as a breakpoint condition
+func parseExpression(source string) (Expr, error) {
+
+	hadErr = false
+	compileErrors = nil
+	s := NewScanner(source)
+	s.scanTokens()
+	if hadErr {
+		return nil, fmt.Errorf("%s", compileErrors[0].message)
+	}
+
+	p := Parser{tokens: s.tokens}
+	expr, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isAtEnd() {
+		return nil, parseError(p.peek(), "Expect end of expression")
+	}
+	return expr, nil
+}
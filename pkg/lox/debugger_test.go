@@ -0,0 +1,320 @@
+package lox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const debugSource = `fun add(a, b) {
+  var sum = a + b;
+  return sum;
+}
+
+var total = 0;
+for (var i = 0; i < 3; i = i + 1) {
+  total = add(total, i);
+}
+print total;
+`
+
+func TestDebugShell(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		commands string
+		// Lines the output should have, in order, though others may come between them
+		want []string
+	}{
+		{"entry", "c\n", []string{"stopped at line 1 in <script> (entry)", ">    1 | fun add(a, b) {", "3"}},
+		{"breakpoint", "b 2\nc\np a + b\nc\nd\nc\n", []string{"(breakpoint)", "0", "(breakpoint)", "3"}},
+		{"condition", "b 3 if sum > 2\nc\np sum\nc\n", []string{"stopped at line 3 in add (breakpoint)", "3", "3"}},
+		{"step", "s\ns\ns\ns\ns\n", []string{"(entry)", "line 6", "line 7", "line 8", "line 2 in add (step)", "line 3 in add (step)"}},
+		{"next", "b 8\nc\nn\nn\n", []string{"line 8 in <script> (breakpoint)", "line 7 in <script> (step)", "line 8 in <script> (breakpoint)"}},
+		{"out", "b 2\nc\no\n", []string{"line 2 in add (breakpoint)", "line 7 in <script> (step)"}},
+		{"frames", "b 2\nc\nbt\nenv\nup\np i\n", []string{"> #0 add at line 2", "  #1 <script> at line 8", "locals:", "  a = 0", "  b = 0", "globals:", "  total = 0", "#1 <script> at line 8", "0"}},
+		{"quit", "q\n", []string{"(entry)"}},
+		{"errors", "b x\np )\nfrob\n", []string{`expected a line number, got "x"`, "Error at ')': Expect expression", "Unknown command frob, try help"}},
+	}
+
+	for _, test := range tests {
+		var out strings.Builder
+		if err := Debug(debugSource, strings.NewReader(test.commands), &out); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		rest := out.String()
+		for _, line := range test.want {
+			n := strings.Index(rest, line)
+			if n < 0 {
+				t.Errorf("%s: expected %q in the output, got\n%s", test.name, line, out.String())
+				break
+			}
+			rest = rest[n+len(line):]
+		}
+	}
+
+	// The program doesn't run on past a quit
+	var out strings.Builder
+	Debug(debugSource, strings.NewReader("q\n"), &out)
+	if strings.Contains(out.String(), "\n3\n") {
+		t.Errorf("expected the program to end, got\n%s", out.String())
+	}
+}
+
+func TestDebugGeneratorsAndTasks(t *testing.T) {
+
+	generator := `fun count(n) {
+  for (i in range(n)) {
+    yield i;
+  }
+}
+for (x in count(2)) print x;
+`
+	tasks := `fun work() {
+  return 1;
+}
+print join(spawn work());
+`
+
+	tests := []struct {
+		name     string
+		source   string
+		commands string
+		want     []string
+	}{
+		{"generator breakpoint", generator, "b 3\nc\nbt\np i\nc\nc\n", []string{"stopped at line 3 in count (breakpoint)", "> #0 count at line 3", "  #1 <script> at line 6", "0", "(breakpoint)", "1"}},
+		{"generator step out", generator, "b 3\nc\no\n", []string{"line 3 in count (breakpoint)", "line 6 in <script> (step)"}},
+		{"task breakpoint", tasks, "b 2\nc\n", []string{"warning: breakpoint at line 2 was passed by a spawned task, which the debugger can't stop", "1"}},
+	}
+
+	for _, test := range tests {
+		var out strings.Builder
+		if err := Debug(test.source, strings.NewReader(test.commands), &out); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		rest := out.String()
+		for _, line := range test.want {
+			n := strings.Index(rest, line)
+			if n < 0 {
+				t.Errorf("%s: expected %q in the output, got\n%s", test.name, line, out.String())
+				break
+			}
+			rest = rest[n+len(line):]
+		}
+	}
+}
+
+func TestDebugLoops(t *testing.T) {
+
+	source := `var total = 0;
+for (i in range(3)) {
+  total = total + i;
+}
+var n = 0;
+while (n < 2) n = n + 1;
+print total + n;
+`
+
+	tests := []struct {
+		name     string
+		commands string
+		want     []string
+	}{
+		{"every pass", "b 3\nc\np i\nc\np i\nc\np i\nd\nc\n", []string{"line 3 in <script> (breakpoint)", "0", "(breakpoint)", "1", "(breakpoint)", "2", "5"}},
+		{"condition", "b 3 if i == 2\nc\np i\nc\n", []string{"line 3 in <script> (breakpoint)", "2", "5"}},
+		{"one line", "b 6\nc\np n\nc\np n\nc\n", []string{"line 6 in <script> (breakpoint)", "0", "(breakpoint)", "1", "5"}},
+	}
+
+	for _, test := range tests {
+		var out strings.Builder
+		if err := Debug(source, strings.NewReader(test.commands), &out); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		rest := out.String()
+		for _, line := range test.want {
+			n := strings.Index(rest, line)
+			if n < 0 {
+				t.Errorf("%s: expected %q in the output, got\n%s", test.name, line, out.String())
+				break
+			}
+			rest = rest[n+len(line):]
+		}
+	}
+}
+
+// A DAP client talking to an adapter running in the same process
+type dapClient struct {
+	t   *testing.T
+	in  *bufio.Reader
+	out io.WriteCloser
+	seq int
+	// Events received while waiting for responses
+	events []map[string]json.RawMessage
+}
+
+func newDapClient(t *testing.T) *dapClient {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	go func() {
+		ServeDebugAdapter(serverIn, serverOut)
+		serverOut.Close()
+	}()
+	return &dapClient{t: t, in: bufio.NewReader(clientIn), out: clientOut}
+}
+
+func (c *dapClient) receive() map[string]json.RawMessage {
+	headers, err := textproto.NewReader(c.in).ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	length, _ := strconv.Atoi(headers.Get("Content-Length"))
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.in, body); err != nil {
+		c.t.Fatal(err)
+	}
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		c.t.Fatal(err)
+	}
+	return message
+}
+
+// Sends a request and decodes the body of the response into body, failing the test
+// if the request didn't succeed
+func (c *dapClient) call(command string, args interface{}, body interface{}) {
+	c.seq++
+	message, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(c.out, "Content-Length: %d\r\n\r\n%s", len(message), message)
+	for {
+		response := c.receive()
+		if string(response["type"]) != `"response"` {
+			c.events = append(c.events, response)
+			continue
+		}
+		if string(response["success"]) != "true" {
+			c.t.Fatalf("%s failed: %s", command, response["message"])
+		}
+		if body != nil {
+			if err := json.Unmarshal(response["body"], body); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+// Waits for an event, returning its body
+func (c *dapClient) wait(event string) map[string]json.RawMessage {
+	for {
+		var message map[string]json.RawMessage
+		if len(c.events) > 0 {
+			message, c.events = c.events[0], c.events[1:]
+		} else {
+			message = c.receive()
+		}
+		if string(message["event"]) == strconv.Quote(event) {
+			var body map[string]json.RawMessage
+			json.Unmarshal(message["body"], &body)
+			return body
+		}
+	}
+}
+
+func TestDebugAdapter(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "golox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "add.lox")
+	if err := ioutil.WriteFile(path, []byte(debugSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newDapClient(t)
+	c.call("initialize", map[string]string{"adapterID": "golox"}, nil)
+	c.wait("initialized")
+	c.call("launch", map[string]interface{}{"program": path}, nil)
+
+	var breakpoints struct {
+		Breakpoints []struct {
+			Line     int
+			Verified bool
+		}
+	}
+	c.call("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": path},
+		"breakpoints": []map[string]interface{}{{"line": 3, "condition": "sum == 1"}, {"line": 5}},
+	}, &breakpoints)
+	if len(breakpoints.Breakpoints) != 2 || !breakpoints.Breakpoints[0].Verified || breakpoints.Breakpoints[1].Verified {
+		t.Errorf("expected only the breakpoint on line 3 to be verified, got %+v", breakpoints.Breakpoints)
+	}
+	c.call("configurationDone", nil, nil)
+
+	if reason := string(c.wait("stopped")["reason"]); reason != `"breakpoint"` {
+		t.Errorf("expected to stop at the breakpoint, got %s", reason)
+	}
+
+	var trace struct {
+		StackFrames []struct {
+			ID   int
+			Name string
+			Line int
+		}
+	}
+	c.call("stackTrace", map[string]int{"threadId": 1}, &trace)
+	if len(trace.StackFrames) != 2 || trace.StackFrames[0].Name != "add" || trace.StackFrames[0].Line != 3 || trace.StackFrames[1].Line != 8 {
+		t.Fatalf("unexpected stack %+v", trace.StackFrames)
+	}
+
+	var scopesBody struct {
+		Scopes []struct {
+			Name               string
+			VariablesReference int
+		}
+	}
+	c.call("scopes", map[string]int{"frameId": trace.StackFrames[0].ID}, &scopesBody)
+	if len(scopesBody.Scopes) == 0 || scopesBody.Scopes[0].Name != "Locals" {
+		t.Fatalf("unexpected scopes %+v", scopesBody.Scopes)
+	}
+	var variablesBody struct {
+		Variables []struct {
+			Name  string
+			Value string
+		}
+	}
+	c.call("variables", map[string]int{"variablesReference": scopesBody.Scopes[0].VariablesReference}, &variablesBody)
+	if len(variablesBody.Variables) != 3 || variablesBody.Variables[2].Name != "sum" || variablesBody.Variables[2].Value != "1" {
+		t.Errorf("unexpected locals %+v", variablesBody.Variables)
+	}
+
+	var evaluated struct {
+		Result string
+	}
+	c.call("evaluate", map[string]interface{}{"expression": "total + i", "frameId": trace.StackFrames[1].ID}, &evaluated)
+	if evaluated.Result != "1" {
+		t.Errorf("expected total + i to be 1 in the caller, got %s", evaluated.Result)
+	}
+
+	c.call("continue", map[string]int{"threadId": 1}, nil)
+	if output := string(c.wait("output")["output"]); output != `"3\n"` {
+		t.Errorf("expected the program to print 3, got %s", output)
+	}
+	if code := string(c.wait("exited")["exitCode"]); code != "0" {
+		t.Errorf("expected exit code 0, got %s", code)
+	}
+	c.wait("terminated")
+	c.call("disconnect", nil, nil)
+}
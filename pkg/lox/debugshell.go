@@ -0,0 +1,251 @@
+package lox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Debug runs the source under the terminal debugger, which reads commands from in
+// and writes to out along with what the program prints
+// The program stops before its first statement
+// Returns ErrCompile if the source has errors, which are written to errorOutput
+func Debug(source string, in io.Reader, out io.Writer) error {
+
+	stmts, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+
+	s := &debugShell{in: bufio.NewReader(in), out: out, lines: strings.Split(source, "\n")}
+	s.debugger = newDebugger(s.stopped, s.warn)
+	return s.debugger.run(stmts, out, true)
+}
+
+// The terminal debugger
+type debugShell struct {
+	debugger *Debugger
+	in       *bufio.Reader
+	out      io.Writer
+	// Lines of the source, for showing where the program stopped
+	lines []string
+	// The frame print and env look at, counting out from the innermost one
+	frame int
+}
+
+// A command the terminal debugger accepts, such as break 12
+type debugCommand struct {
+	names []string
+	// Describes the argument the command takes, if any
+	usage string
+	help  string
+	run   func(s *debugShell, argument string) error
+	// How the program carries on after the command, for commands without run
+	mode stepMode
+}
+
+// Set up in init, since help lists the commands
+var debugCommands []debugCommand
+
+func init() {
+	debugCommands = []debugCommand{
+		{[]string{"help", "h"}, "", "show this list", (*debugShell).help, 0},
+		{[]string{"break", "b"}, "[line [if condition]]", "stop at a line, or list the breakpoints", (*debugShell).setBreakpoint, 0},
+		{[]string{"delete", "d"}, "[line]", "remove the breakpoint on a line, or all of them", (*debugShell).deleteBreakpoint, 0},
+		{[]string{"continue", "c"}, "", "run until a breakpoint", nil, stepContinue},
+		{[]string{"step", "s"}, "", "run to the next statement, going into calls", nil, stepIn},
+		{[]string{"next", "n"}, "", "run to the next statement, stepping over calls", nil, stepOver},
+		{[]string{"out", "o"}, "", "run until the current function returns", nil, stepOut},
+		{[]string{"print", "p"}, "<expr>", "show the value of an expression", (*debugShell).print, 0},
+		{[]string{"env", "e"}, "", "show the variables in each scope of the frame", (*debugShell).env, 0},
+		{[]string{"backtrace", "bt"}, "", "show the calls that led here", (*debugShell).backtrace, 0},
+		{[]string{"up", "u"}, "", "look at the frame of the caller", (*debugShell).up, 0},
+		{[]string{"down"}, "", "look at the frame of the callee", (*debugShell).down, 0},
+		{[]string{"list", "l"}, "", "show the source around the current line", (*debugShell).list, 0},
+		{[]string{"quit", "q"}, "", "end the program", nil, stepQuit},
+	}
+}
+
+// Shows where the program stopped and reads commands until one carries on
+func (s *debugShell) stopped(reason string) stepMode {
+
+	s.frame = 0
+	frame, _ := s.debugger.frame(0)
+	fmt.Fprintf(s.out, "stopped at line %d in %s (%s)\n", frame.line, frame.name, reason)
+	s.showLine(frame.line, true)
+
+	for {
+		fmt.Fprint(s.out, "(debug) ")
+		line, err := s.in.ReadString('\n')
+		if err != nil && line == "" {
+			// The end of the input ends the program
+			fmt.Fprintln(s.out)
+			return stepQuit
+		}
+
+		name, argument := strings.TrimSpace(line), ""
+		if name == "" {
+			continue
+		}
+		if space := strings.IndexAny(name, " \t"); space >= 0 {
+			name, argument = name[:space], strings.TrimSpace(name[space+1:])
+		}
+
+		command, ok := findDebugCommand(name)
+		if !ok {
+			fmt.Fprintf(s.out, "Unknown command %s, try help\n", name)
+			continue
+		}
+		if command.run == nil {
+			return command.mode
+		}
+		if strings.HasPrefix(command.usage, "<") && argument == "" {
+			fmt.Fprintf(s.out, "Usage: %s %s\n", command.names[0], command.usage)
+			continue
+		}
+		if err := command.run(s, argument); err != nil {
+			fmt.Fprintln(s.out, err)
+		}
+	}
+}
+
+func (s *debugShell) warn(message string) {
+	fmt.Fprintf(s.out, "warning: %s\n", message)
+}
+
+func findDebugCommand(name string) (debugCommand, bool) {
+	for _, command := range debugCommands {
+		for _, n := range command.names {
+			if n == name {
+				return command, true
+			}
+		}
+	}
+	return debugCommand{}, false
+}
+
+// Shows a line of the source, marking it if it's the current one
+func (s *debugShell) showLine(line int, current bool) {
+	if line < 1 || line > len(s.lines) {
+		return
+	}
+	marker := " "
+	if current {
+		marker = ">"
+	}
+	fmt.Fprintf(s.out, "%s %4d | %s\n", marker, line, s.lines[line-1])
+}
+
+func (s *debugShell) help(argument string) error {
+	for _, command := range debugCommands {
+		fmt.Fprintf(s.out, "  %-32s %s\n", strings.TrimSpace(strings.Join(command.names, ", ")+" "+command.usage), command.help)
+	}
+	return nil
+}
+
+func (s *debugShell) setBreakpoint(argument string) error {
+
+	if argument == "" {
+		breakpoints := s.debugger.breakpointList()
+		if len(breakpoints) == 0 {
+			fmt.Fprintln(s.out, "No breakpoints")
+		}
+		for _, b := range breakpoints {
+			if b.condition != "" {
+				fmt.Fprintf(s.out, "line %d if %s\n", b.line, b.condition)
+			} else {
+				fmt.Fprintf(s.out, "line %d\n", b.line)
+			}
+		}
+		return nil
+	}
+
+	lineText, condition := argument, ""
+	if n := strings.Index(argument, " if "); n >= 0 {
+		lineText, condition = strings.TrimSpace(argument[:n]), strings.TrimSpace(argument[n+4:])
+	}
+	line, err := strconv.Atoi(lineText)
+	if err != nil || line < 1 {
+		return fmt.Errorf("expected a line number, got %q", lineText)
+	}
+	return s.debugger.setBreakpoint(line, condition)
+}
+
+func (s *debugShell) deleteBreakpoint(argument string) error {
+	if argument == "" {
+		s.debugger.clearBreakpoints()
+		return nil
+	}
+	line, err := strconv.Atoi(argument)
+	if err != nil {
+		return fmt.Errorf("expected a line number, got %q", argument)
+	}
+	s.debugger.clearBreakpoint(line)
+	return nil
+}
+
+func (s *debugShell) print(expr string) error {
+	value, err := s.debugger.evaluateSource(s.frame, expr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(s.out, quoted(value))
+	return nil
+}
+
+// Shows the variables of each scope the frame can see, from the innermost out
+func (s *debugShell) env(argument string) error {
+	frame, err := s.debugger.frame(s.frame)
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes(frame.environment) {
+		fmt.Fprintf(s.out, "%s:\n", strings.ToLower(scope.name))
+		for _, v := range scope.variables() {
+			fmt.Fprintf(s.out, "  %s = %s\n", v.name, quoted(v.value))
+		}
+	}
+	return nil
+}
+
+func (s *debugShell) backtrace(argument string) error {
+	for n, frame := range s.debugger.stack() {
+		marker := " "
+		if n == s.frame {
+			marker = ">"
+		}
+		fmt.Fprintf(s.out, "%s #%d %s at line %d\n", marker, n, frame.name, frame.line)
+	}
+	return nil
+}
+
+func (s *debugShell) up(argument string) error {
+	return s.selectFrame(s.frame + 1)
+}
+
+func (s *debugShell) down(argument string) error {
+	return s.selectFrame(s.frame - 1)
+}
+
+func (s *debugShell) selectFrame(n int) error {
+	frame, err := s.debugger.frame(n)
+	if err != nil {
+		return err
+	}
+	s.frame = n
+	fmt.Fprintf(s.out, "#%d %s at line %d\n", n, frame.name, frame.line)
+	return nil
+}
+
+func (s *debugShell) list(argument string) error {
+	frame, err := s.debugger.frame(s.frame)
+	if err != nil {
+		return err
+	}
+	for line := frame.line - 3; line <= frame.line+3; line++ {
+		s.showLine(line, line == frame.line)
+	}
+	return nil
+}
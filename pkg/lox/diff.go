@@ -0,0 +1,128 @@
+package lox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lines of context shown around each change in a diff
+const diffContext = 3
+
+// An edit turning one line of a into one line of b
+type diffLine struct {
+	// ' ' for a line in both, '-' for a line only in a, '+' for a line only in b
+	op   byte
+	text string
+}
+
+// Diff returns a unified diff turning a into b, labelled with their names
+// Returns an empty string if they are the same
+func Diff(nameA, nameB, a, b string) string {
+
+	if a == b {
+		return ""
+	}
+
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// Group the changes into hunks, merging ones whose context would overlap
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+
+		first := start - diffContext
+		if first < 0 {
+			first = 0
+		}
+		last := start
+		for n := start; n < len(lines) && n <= last+2*diffContext; n++ {
+			if lines[n].op != ' ' {
+				last = n
+			}
+		}
+		end := last + diffContext + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		// Line numbers of the hunk in a and b
+		lineA, lineB := 1, 1
+		for _, line := range lines[:first] {
+			if line.op != '+' {
+				lineA++
+			}
+			if line.op != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, line := range lines[first:end] {
+			if line.op != '+' {
+				countA++
+			}
+			if line.op != '-' {
+				countB++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+		for _, line := range lines[first:end] {
+			fmt.Fprintf(&out, "%c%s\n", line.op, line.text)
+		}
+		start = end
+	}
+
+	return out.String()
+}
+
+// Splits text into lines, without a final empty line for a trailing newline
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Returns the edits turning a into b, from their longest common subsequence
+func diffLines(a, b []string) []diffLine {
+
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case j >= len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return lines
+}
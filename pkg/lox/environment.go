@@ -1,61 +1,231 @@
 package lox
 
-import "fmt"
+import (
+	"sort"
+	"sync"
+)
 
-// Tracks all variable assignments with a map
+// Tracks the values of variables
+// The builtins and the top level of the script are global environments, keeping
+// variables by name in a map. Blocks, calls and for-in iterations run in frames,
+// keeping variables in the slots the resolver gave them
+// Environments can be shared by tasks running at the same time, so once the program
+// has spawned a task access is locked. Until then only one goroutine runs the program
+// at a time, a generator's body taking turns with the code resuming it, so nothing
+// needs locking. The switch belongs to the program's scheduler, so other programs in
+// the same process, such as the next test file, start out without locking again
 type Environment struct {
-	values    map[string]interface{}
+	mu sync.RWMutex
+	// The scheduler of the program the environment belongs to, which says whether
+	// tasks have been spawned. Environments get it from the one enclosing them
+	scheduler *Scheduler
+	// The variables of a global environment, by name
+	values map[string]Value
+	// The variables of a frame, by slot, undefined until they're defined
+	slots []Value
+	// The names of the slots of a frame
+	locals    *locals
 	enclosing *Environment
 }
 
-// Returns a new environment with an initalized map
+// Reports whether the environment has to be locked, because tasks may be running
+func (e *Environment) shared() bool {
+	return e.scheduler != nil && e.scheduler.tasksSpawned()
+}
+
+// Returns a new global environment with an initalized map
 func NewEnvironment(enclosing *Environment) *Environment {
-	return &Environment{values: make(map[string]interface{}), enclosing: enclosing}
+	e := &Environment{values: make(map[string]Value), enclosing: enclosing}
+	if enclosing != nil {
+		e.scheduler = enclosing.scheduler
+	}
+	return e
+}
+
+// Returns a new frame with a slot for each of the locals
+func newFrame(enclosing *Environment, locals *locals) *Environment {
+	e := &Environment{locals: locals, enclosing: enclosing, scheduler: enclosing.scheduler}
+	if locals != nil {
+		e.slots = make([]Value, len(locals.names))
+		for slot := range e.slots {
+			e.slots[slot] = undefined
+		}
+	}
+	return e
+}
+
+// Returns the environment depth frames out from this one
+func (e *Environment) ancestor(depth int) *Environment {
+	for ; depth > 0; depth-- {
+		e = e.enclosing
+	}
+	return e
 }
 
 // Assigns a value to an existing variable.
 // Does NOT allow for first time variable declaration. See Define()
-func (e *Environment) Assign(v Variable, expr Expr) error {
-	// Checks if the var name exists in the values map
-	if _, ok := e.values[v.token.lexeme]; ok {
-		// If the var name exists, update the value
-		e.values[v.token.lexeme] = expr
-		return nil
+func (e *Environment) Assign(v Variable, value Value) error {
+
+	if v.binding != nil && v.binding.local {
+		if e.ancestor(v.binding.depth).assignSlot(v.binding.slot, value) {
+			return nil
+		}
+		return runtimeErrorf(v.token.line, "undefined variable %v", v.token.lexeme)
 	}
 
-	// Check the higher scope for the variable if not in the current scope
-	if e.enclosing != nil {
-		return e.enclosing.Assign(v, expr)
+	// Search for the name, from where the top level is for a global
+	if v.binding != nil {
+		e = e.ancestor(v.binding.depth)
+	}
+	for env := e; env != nil; env = env.enclosing {
+		if env.set(v.token.lexeme, value) {
+			return nil
+		}
 	}
 
-	// If the var is not in the map, return an error
-	return fmt.Errorf("error at line %d: undefined variable %v", v.token.line, v.token.lexeme)
+	// If the var is not in any scope, return an error
+	return runtimeErrorf(v.token.line, "undefined variable %v", v.token.lexeme)
 
 }
 
-// Retrieves a value from the environment map
-func (e *Environment) Get(v Variable) (interface{}, error) {
+// Retrieves the value of a variable
+func (e *Environment) Get(v Variable) (Value, error) {
 
-	// Check to ensure the var exists in the map
-	if value, ok := e.values[v.token.lexeme]; ok {
-		// If the var exists, return the value
-		return value, nil
+	if v.binding != nil && v.binding.local {
+		value := e.ancestor(v.binding.depth).slot(v.binding.slot)
+		if value.kind != undefinedKind {
+			return value, nil
+		}
+		return Value{}, runtimeErrorf(v.token.line, "undefined variable %v", v.token.lexeme)
 	}
 
-	// If there's a higher scope than the current one, check it for the variable
-	if e.enclosing != nil {
-		return e.enclosing.Get(v)
+	// Search for the name, from where the top level is for a global
+	if v.binding != nil {
+		e = e.ancestor(v.binding.depth)
+	}
+	for env := e; env != nil; env = env.enclosing {
+		if value, ok := env.get(v.token.lexeme); ok {
+			return value, nil
+		}
 	}
 
-	// If the var is not in the map, return an error
-	return nil, fmt.Errorf("error at line %d: undefined variable %v", v.token.line, v.token.lexeme)
+	// If the var is not in any scope, return an error
+	return Value{}, runtimeErrorf(v.token.line, "undefined variable %v", v.token.lexeme)
 }
 
-// Defines a new variable in the map
-func (e *Environment) Define(v Variable, expr Expr) error {
+// Defines a new variable, in its slot in a frame or by name in a global environment
+func (e *Environment) Define(v Variable, value Value) error {
+
+	if v.binding != nil && v.binding.local {
+		e.defineSlot(v.binding.slot, value)
+		return nil
+	}
 
 	// Creates an entry in the map for a new variable and its definition
-	e.values[v.token.lexeme] = expr
+	if e.shared() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	}
+	e.values[v.token.lexeme] = value
 
 	return nil
 }
+
+// Defines the variable in a slot of a frame
+func (e *Environment) defineSlot(slot int, value Value) {
+	if e.shared() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	}
+	e.slots[slot] = value
+}
+
+// Sets a slot of a frame that has been defined, reporting whether it had been
+func (e *Environment) assignSlot(slot int, value Value) bool {
+	if e.shared() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	}
+	if e.slots[slot].kind == undefinedKind {
+		return false
+	}
+	e.slots[slot] = value
+	return true
+}
+
+// Returns the value in a slot of a frame
+func (e *Environment) slot(slot int) Value {
+	if e.shared() {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+	return e.slots[slot]
+}
+
+// Looks up a name in this environment only
+// A frame is searched from its last slot, so of two variables declared with the
+// same name the later one is found
+func (e *Environment) get(name string) (Value, bool) {
+	if e.shared() {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+	}
+
+	if e.values != nil {
+		value, ok := e.values[name]
+		return value, ok
+	}
+	if slot := e.slotOf(name); slot >= 0 {
+		return e.slots[slot], true
+	}
+	return Value{}, false
+}
+
+// Sets a variable defined in this environment only, reporting whether it was found
+func (e *Environment) set(name string, value Value) bool {
+	if e.shared() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	}
+
+	if e.values != nil {
+		if _, ok := e.values[name]; ok {
+			e.values[name] = value
+			return true
+		}
+		return false
+	}
+	if slot := e.slotOf(name); slot >= 0 {
+		e.slots[slot] = value
+		return true
+	}
+	return false
+}
+
+// Returns the last defined slot of a frame with the name, or -1
+func (e *Environment) slotOf(name string) int {
+	for slot := len(e.slots) - 1; slot >= 0; slot-- {
+		if e.slots[slot].kind != undefinedKind && e.locals.names[slot] == name {
+			return slot
+		}
+	}
+	return -1
+}
+
+// Returns the names of the variables defined in this scope, sorted
+func (e *Environment) names() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var names []string
+	for name := range e.values {
+		names = append(names, name)
+	}
+	for slot, value := range e.slots {
+		if value.kind != undefinedKind && e.slotOf(e.locals.names[slot]) == slot {
+			names = append(names, e.locals.names[slot])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
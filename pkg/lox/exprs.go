@@ -1,10 +1,5 @@
 package lox
 
-import (
-	"fmt"
-	"math"
-)
-
 // Expressions are combinations of values and operators
 // that create a new value
 type Expr interface {
@@ -18,9 +13,14 @@ type ExprVisitor interface {
 	visitAssign(Assign) error
 	visitBinary(Binary) error
 	visitCall(Call) error
+	visitConditional(Conditional) error
 	visitGrouping(Grouping) error
+	visitInterpolation(Interpolation) error
+	visitListLiteral(ListLiteral) error
 	visitLiteral(Literal) error
 	visitLogical(Logical) error
+	visitMapLiteral(MapLiteral) error
+	visitSpawn(Spawn) error
 	visitUnary(Unary) error
 	visitVariable(Variable) error
 }
@@ -62,6 +62,21 @@ func (c Call) Accept(visitor ExprVisitor) error {
 	return visitor.visitCall(c)
 }
 
+// Represents a ternary conditional expression
+// example: a > b ? a : b
+type Conditional struct {
+	// The ?, for the expression's position
+	question   Token
+	condition  Expr
+	thenBranch Expr
+	elseBranch Expr
+}
+
+// Boilerplate visitor pattern for Conditional
+func (c Conditional) Accept(visitor ExprVisitor) error {
+	return visitor.visitConditional(c)
+}
+
 // Represents a grouping of expressions
 type Grouping struct {
 	expression Expr
@@ -72,6 +87,30 @@ func (g Grouping) Accept(visitor ExprVisitor) error {
 	return visitor.visitGrouping(g)
 }
 
+// Represents a string with embedded expressions
+// example: "x = ${x + 1}"
+// Each part is either a Literal holding a piece of the string or an embedded expression
+type Interpolation struct {
+	parts []Expr
+}
+
+// Boilerplate visitor pattern for Interpolation
+func (i Interpolation) Accept(visitor ExprVisitor) error {
+	return visitor.visitInterpolation(i)
+}
+
+// Represents a list built from expressions
+// example: [1, 2, a + b]
+type ListLiteral struct {
+	bracket  Token
+	elements []Expr
+}
+
+// Boilerplate visitor pattern for ListLiteral
+func (l ListLiteral) Accept(visitor ExprVisitor) error {
+	return visitor.visitListLiteral(l)
+}
+
 // Represents a singular value, such as a number or a string
 type Literal struct {
 	value interface{}
@@ -84,31 +123,10 @@ func (l Literal) Accept(visitor ExprVisitor) error {
 
 // Implement the String interface for literals
 func (l Literal) String() string {
-
-	if s, ok := l.value.(string); ok {
-		return s
-	}
-
-	if f, ok := l.value.(float64); ok {
-		if f == math.Trunc(f) {
-			return fmt.Sprintf("%d", int64(f))
-		}
-
-		return fmt.Sprintf("%f", f)
-	}
-
-	if b, ok := l.value.(bool); ok {
-		return fmt.Sprintf("%t", b)
-	}
-
-	if l.value == nil {
-		return "nil"
-	}
-
-	return fmt.Sprintf("%v", l.value)
+	return valueOf(l.value).String()
 }
 
-// Represents a logical "and" or "or"
+// Represents a logical "and" or "or", or a null-coalescing "??"
 type Logical struct {
 	left     Expr
 	operator Token
@@ -119,6 +137,31 @@ func (l Logical) Accept(visitor ExprVisitor) error {
 	return visitor.visitLogical(l)
 }
 
+// Represents a map built from key and value expressions
+// example: {"a": 1, "b": 2}
+type MapLiteral struct {
+	brace  Token
+	keys   []Expr
+	values []Expr
+}
+
+// Boilerplate visitor pattern for MapLiteral
+func (m MapLiteral) Accept(visitor ExprVisitor) error {
+	return visitor.visitMapLiteral(m)
+}
+
+// Represents starting a function call as a new task
+// example: spawn worker(jobs)
+type Spawn struct {
+	keyword Token
+	call    Call
+}
+
+// Boilerplate visitor pattern for Spawn
+func (s Spawn) Accept(visitor ExprVisitor) error {
+	return visitor.visitSpawn(s)
+}
+
 // Represetns unary operations
 // example: -1 or !true
 type Unary struct {
@@ -135,6 +178,8 @@ func (u Unary) Accept(visitor ExprVisitor) error {
 // Example: print foo
 type Variable struct {
 	token Token
+	// Where the variable lives, filled in by the resolver
+	binding *binding
 }
 
 // Boilerplate visitor pattern for Variable
@@ -0,0 +1,163 @@
+package lox
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the type and lexeme of each token, leaving out comments
+func codeTokens(source string) []string {
+	s := NewScanner(source)
+	s.scanTokens()
+	var tokens []string
+	for _, token := range s.tokens {
+		tokens = append(tokens, token.tType.String()+" "+token.lexeme)
+	}
+	return tokens
+}
+
+// Formats every script in testdata that compiles, checking that formatting doesn't
+// change the code and that formatting again changes nothing
+func TestFormatCorpus(t *testing.T) {
+
+	errorOutput = ioutil.Discard
+	defer func() { errorOutput = os.Stderr }()
+
+	err := filepath.WalkDir("testdata", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".lox" {
+			return err
+		}
+
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		formatted, err := Format(string(source))
+		if err != nil {
+			// Scripts testing compile errors can't be formatted
+			return nil
+		}
+
+		if again, err := Format(formatted); err != nil || again != formatted {
+			t.Errorf("%s: formatting is not idempotent:\n%s", path, Diff("once", "twice", formatted, again))
+		}
+
+		want, got := codeTokens(string(source)), codeTokens(formatted)
+		if len(want) != len(got) {
+			t.Errorf("%s: formatting changed the tokens:\n%s", path, formatted)
+			return nil
+		}
+		for n := range want {
+			if want[n] != got[n] {
+				t.Errorf("%s: formatting changed token %d from %q to %q", path, n, want[n], got[n])
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	source := `// leading comment
+fun add(a,b){return a+b;}   // trailing
+
+
+var m={"k":[1,-2,3],"t":x?1:2};
+if(a<b){print "less";}else{
+  // nothing to see
+}
+for(var i=0;i<3;i=i+1) print i;
+for (k, v in m) { print "${k}=${v + 1}"; }
+print -a - -b * (c ** 2);
+fun empty() {}
+`
+	want := `// leading comment
+fun add(a, b) {
+  return a + b;
+} // trailing
+
+var m = {"k": [1, -2, 3], "t": x ? 1 : 2};
+if (a < b) {
+  print "less";
+} else {
+  // nothing to see
+}
+for (var i = 0; i < 3; i = i + 1) print i;
+for (k, v in m) {
+  print "${k}=${v + 1}";
+}
+print -a - -b * (c ** 2);
+fun empty() {}
+`
+	got, err := Format(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("unexpected formatting:\n%s", Diff("want", "got", want, got))
+	}
+}
+
+// A body that isn't a block is indented when a comment pushes it onto a line of its own
+func TestFormatBodyAfterComment(t *testing.T) {
+	source := `if (true) // why
+print 1;
+while (x) // loop
+    x = x - 1;
+if (a) if (b) print 1; else // other
+print 2;
+if (a) x = 1; else if (b) // next
+y = 2;
+while (x) if (y) { print 1; } else print 2;
+`
+	want := `if (true) // why
+  print 1;
+while (x) // loop
+  x = x - 1;
+if (a) if (b) print 1;
+else // other
+  print 2;
+if (a) x = 1;
+else if (b) // next
+  y = 2;
+while (x) if (y) {
+  print 1;
+} else print 2;
+`
+	got, err := Format(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("unexpected formatting:\n%s", Diff("want", "got", want, got))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n"
+	want := `--- a
++++ b
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+`
+	if got := Diff("a", "b", a, b); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if got := Diff("a", "b", a, a); got != "" {
+		t.Errorf("got %q for equal texts", got)
+	}
+}
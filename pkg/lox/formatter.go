@@ -0,0 +1,367 @@
+package lox
+
+import (
+	"strings"
+)
+
+// The formatter re-prints source in the canonical style:
+//   - Two spaces of indentation per block, with the opening brace on the same line
+//   - One statement per line, and } else { on one line
+//   - Spaces around binary operators and after commas, none inside brackets
+//   - At most one blank line between statements
+//
+// It works on the tokens rather than the syntax tree so comments can be kept where
+// they were written. Lists, maps and calls are printed on one line unless a comment
+// inside them forces a line break.
+
+// Format returns the source formatted in the canonical style
+// Only valid code is formatted: returns ErrCompile if the source has errors, which
+// are written to errorOutput
+func Format(source string) (string, error) {
+
+	if _, err := parseSource(source); err != nil {
+		return "", err
+	}
+
+	s := NewScanner(source)
+	s.keepComments = true
+	s.scanTokens()
+
+	f := &formatter{tokens: s.tokens}
+	return f.format(), nil
+}
+
+// Kinds of brackets the formatter tracks, along with statement bodies that aren't blocks
+type frameKind int
+
+const (
+	parenFrame frameKind = iota
+	// The parentheses after for, where semicolons don't end the line
+	forFrame
+	// The parentheses after if or while
+	conditionFrame
+	// The body of an if, else, while or for that isn't a block, so a line break
+	// before it is indented like one
+	bodyFrame
+	bracketFrame
+	blockFrame
+	mapFrame
+	// The expression inside ${ } in a string
+	interpolationFrame
+)
+
+// A bracket that has been opened but not closed yet, or a body that hasn't ended
+type frame struct {
+	kind frameKind
+	// Number of ? waiting for their :, to tell a conditional's : from a map's
+	questions int
+	// For a body, set once its first token is written, and set if that token
+	// started a line, which indents the body a level
+	started, indented bool
+}
+
+type formatter struct {
+	tokens []Token
+	out    strings.Builder
+
+	frames []frame
+	// Number of blocks the current line is nested in
+	indent int
+
+	// Last token written that wasn't a comment
+	prev *Token
+	// Line the last token written, comment or not, ended on in the source
+	prevLine int
+	// Set if the last token written was a unary operator
+	prevUnary bool
+	// Set if the next token should start a new line
+	newline bool
+	// Set if nothing has been written yet
+	start bool
+	// Set if a comment has been written since the last token
+	afterComment bool
+}
+
+func (f *formatter) format() string {
+
+	// The top level of the file acts like a block
+	f.frames = []frame{{kind: blockFrame}}
+	f.start = true
+	for n, token := range f.tokens {
+		if token.tType == EOF {
+			break
+		}
+		if token.tType == COMMENT {
+			f.comment(token)
+			continue
+		}
+		f.token(token, f.nextCode(n))
+	}
+
+	return strings.TrimRight(f.out.String(), "\n ") + "\n"
+}
+
+// Returns the next token after n that isn't a comment
+func (f *formatter) nextCode(n int) Token {
+	for _, token := range f.tokens[n+1:] {
+		if token.tType != COMMENT {
+			return token
+		}
+	}
+	return Token{tType: EOF}
+}
+
+func (f *formatter) top() *frame {
+	return &f.frames[len(f.frames)-1]
+}
+
+func (f *formatter) push(kind frameKind) {
+	f.frames = append(f.frames, frame{kind: kind})
+}
+
+func (f *formatter) pop() frame {
+	top := f.frames[len(f.frames)-1]
+	f.frames = f.frames[:len(f.frames)-1]
+	return top
+}
+
+// Called when a statement ends, to end the bodies it finishes too
+// An else carries on the if whose body just ended, the bodies around it end with it
+func (f *formatter) endBodies(next Token) {
+	for f.top().kind == bodyFrame && next.tType != ELSE {
+		f.pop()
+	}
+}
+
+// Returns the line a token starts on, since tokens record the line they end on
+func startLine(t Token) int {
+	return t.line - strings.Count(t.lexeme, "\n")
+}
+
+// Starts a new line if one is due, keeping a single blank line if the source had any
+// Otherwise writes a space if space is set
+func (f *formatter) separate(t Token, space bool) {
+
+	if f.start {
+		f.start = false
+		f.newline = false
+		return
+	}
+
+	if !f.newline {
+		if space {
+			f.out.WriteString(" ")
+		}
+		return
+	}
+
+	f.newline = false
+	f.out.WriteString("\n")
+	// Blank lines at the start or end of a block are dropped
+	opensBlock := f.prev != nil && f.prev.tType == LEFT_BRACE && f.top().kind == blockFrame
+	if startLine(t) > f.prevLine+1 && !opensBlock && t.tType != RIGHT_BRACE {
+		f.out.WriteString("\n")
+	}
+
+	// Lines broken inside an expression are indented a level further
+	depth := f.indent
+	for _, fr := range f.frames {
+		if fr.kind != blockFrame && (fr.kind != bodyFrame || fr.indented) {
+			depth++
+		}
+	}
+	f.out.WriteString(strings.Repeat("  ", depth))
+}
+
+func (f *formatter) comment(t Token) {
+
+	text := strings.TrimRight(t.lexeme, "\r ")
+	lineComment := strings.HasPrefix(text, "//")
+
+	// A comment on the same line as code stays at the end of that line
+	if f.prev != nil && startLine(t) == f.prevLine {
+		f.out.WriteString(" " + text)
+	} else {
+		f.newline = !f.start
+		f.separate(t, false)
+		f.out.WriteString(text)
+		// A block comment on a line of its own stays on its own line
+		if !lineComment {
+			f.newline = true
+		}
+	}
+
+	if lineComment {
+		f.newline = true
+	}
+	f.prevLine = t.line
+	f.afterComment = true
+}
+
+// Reports whether a token ends an operand, so a - after it is a binary minus and
+// a ( or [ after it is a call or index
+func (f *formatter) endsOperand() bool {
+	if f.prev == nil {
+		return false
+	}
+	switch f.prev.tType {
+	case IDENTIFIER, NUMBER, STRING, TRUE, FALSE, NIL, THIS, SUPER, RIGHT_PAREN, RIGHT_BRACKET:
+		return true
+	case RIGHT_BRACE:
+		// Only the end of a map, the end of a block starts a statement
+		return !f.newline
+	}
+	return false
+}
+
+// Reports whether a { starts a block rather than a map
+func (f *formatter) opensBlock() bool {
+	if f.prev == nil {
+		return true
+	}
+	switch f.prev.tType {
+	case RIGHT_PAREN, ELSE, SEMICOLON, LEFT_BRACE, RIGHT_BRACE:
+		// After { or }, a { is a block unless it is inside a map or list
+		if f.prev.tType == LEFT_BRACE || f.prev.tType == RIGHT_BRACE {
+			return f.top().kind == blockFrame
+		}
+		return true
+	}
+	return false
+}
+
+// Writes a token, with the spacing and line breaks it needs
+func (f *formatter) token(t Token, next Token) {
+
+	top := f.top()
+	space := true
+	unary := false
+	// A block with nothing in it, not even a comment, is printed as {}
+	empty := t.tType == RIGHT_BRACE && f.prev != nil && f.prev.tType == LEFT_BRACE && !f.afterComment
+
+	switch t.tType {
+	case RIGHT_PAREN, RIGHT_BRACKET, COMMA, SEMICOLON, DOT:
+		space = false
+	case LEFT_PAREN, LEFT_BRACKET:
+		space = !f.endsOperand()
+	case MINUS:
+		unary = !f.endsOperand()
+	case BANG, TILDE:
+		unary = true
+	case COLON:
+		// A map's colon sticks to its key, a conditional's has spaces
+		space = top.questions > 0
+	case STRING, INTERPOLATION:
+		// The rest of a string after an interpolation sticks to the expression
+		if strings.HasPrefix(t.lexeme, "}") {
+			space = false
+		}
+	case RIGHT_BRACE:
+		if top.kind == blockFrame {
+			// A block ends on its own line, unless it is empty
+			f.indent--
+			f.newline = !empty
+		} else {
+			space = false
+		}
+	}
+
+	// Nothing goes between an opening bracket or unary operator and what follows it
+	if f.prev != nil {
+		switch f.prev.tType {
+		case LEFT_PAREN, LEFT_BRACKET, DOT:
+			space = false
+		case LEFT_BRACE:
+			if top.kind == mapFrame {
+				space = false
+			}
+		case INTERPOLATION:
+			space = false
+		}
+	}
+	if f.prevUnary {
+		space = false
+	}
+
+	if empty {
+		space = false
+	}
+
+	if top.kind == bodyFrame && !top.started {
+		top.started, top.indented = true, f.newline
+	}
+	f.separate(t, space)
+	f.out.WriteString(t.lexeme)
+
+	// Track brackets and decide what comes after the token
+	switch t.tType {
+	case LEFT_PAREN:
+		switch {
+		case f.prev != nil && f.prev.tType == FOR:
+			f.push(forFrame)
+		case f.prev != nil && (f.prev.tType == IF || f.prev.tType == WHILE):
+			f.push(conditionFrame)
+		default:
+			f.push(parenFrame)
+		}
+	case LEFT_BRACKET:
+		f.push(bracketFrame)
+	case LEFT_BRACE:
+		if f.opensBlock() {
+			f.push(blockFrame)
+			f.indent++
+			f.newline = next.tType != RIGHT_BRACE
+		} else {
+			f.push(mapFrame)
+		}
+	case INTERPOLATION:
+		if strings.HasPrefix(t.lexeme, "}") {
+			f.pop()
+		}
+		f.push(interpolationFrame)
+	case STRING:
+		if strings.HasPrefix(t.lexeme, "}") {
+			f.pop()
+		}
+	case RIGHT_PAREN:
+		if kind := f.pop().kind; (kind == forFrame || kind == conditionFrame) && next.tType != LEFT_BRACE {
+			f.push(bodyFrame)
+		}
+	case ELSE:
+		// else if chains stay at the same level
+		if next.tType != LEFT_BRACE && next.tType != IF {
+			f.push(bodyFrame)
+		}
+	case RIGHT_BRACKET:
+		f.pop()
+	case RIGHT_BRACE:
+		if f.pop().kind == blockFrame {
+			// } else and }; stay on the same line
+			switch next.tType {
+			case ELSE, SEMICOLON, COMMA, RIGHT_PAREN:
+			default:
+				f.newline = true
+			}
+			f.endBodies(next)
+		}
+	case SEMICOLON:
+		if top.kind != forFrame {
+			f.newline = true
+		}
+		if top.kind == bodyFrame {
+			f.pop()
+			f.endBodies(next)
+		}
+	case QUESTION:
+		top.questions++
+	case COLON:
+		if top.questions > 0 {
+			top.questions--
+		}
+	}
+
+	f.prev = &t
+	f.prevLine = t.line
+	f.prevUnary = unary
+	f.afterComment = false
+}
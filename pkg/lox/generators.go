@@ -0,0 +1,169 @@
+package lox
+
+import (
+	"errors"
+	"sync"
+)
+
+// Generator is the value returned by calling a function that contains a yield
+// The function body runs on its own goroutine with its own interpreter, but never at the
+// same time as the code using the generator: asking for the next value resumes the body,
+// and the body pauses again at the next yield. This handoff means the two sides can
+// share environments without any locking.
+//
+// A generator can be shared between tasks, but only one of them can resume it at a
+// time. Asking a running generator for a value, including from its own body, fails
+// with errGeneratorRunning rather than waiting for a yield that would never come.
+//
+// A generator that is abandoned before it finishes has to be closed, or its goroutine
+// stays parked at a yield. Closing makes the yield fail with errGeneratorClosed, so the
+// body unwinds and its goroutine ends. For-in loops close their generator when they stop
+// early, and the scheduler closes any left open when the program ends
+type Generator struct {
+	function  FuncStmt
+	arguments []Value
+	// Interpreter the generator was created by, used to set up the body's interpreter
+	parent *Interpreter
+	// Interpreter running the body
+	interpreter *Interpreter
+
+	// Guards the state below, the channels do the handoff itself
+	mu       sync.Mutex
+	started  bool
+	running  bool
+	finished bool
+
+	// Signals a paused body to carry on to the next yield
+	resume chan struct{}
+	// Closed to make a paused body unwind instead
+	done chan struct{}
+	// Receives each yielded value, and a final result when the body finishes
+	results chan generatorResult
+}
+
+// What the body of a generator produced when it paused or finished
+type generatorResult struct {
+	value Value
+	done  bool
+	err   error
+}
+
+var errGeneratorRunning = errors.New("generator is already running")
+
+// Returned by the yield a closed generator's body was paused at
+var errGeneratorClosed = errors.New("generator is closed")
+
+// Returns a new generator that will run the function with the arguments
+// Nothing runs until the first value is asked for
+func NewGenerator(parent *Interpreter, function FuncStmt, arguments []Value) *Generator {
+	return &Generator{
+		function:  function,
+		arguments: arguments,
+		parent:    parent,
+		resume:    make(chan struct{}),
+		done:      make(chan struct{}),
+		results:   make(chan generatorResult),
+	}
+}
+
+// Runs the body until the next yield and returns the yielded value
+// Returns false once the body has finished
+func (g *Generator) next(interpreter *Interpreter) (Value, bool, error) {
+
+	g.mu.Lock()
+	if g.finished {
+		g.mu.Unlock()
+		return Value{}, false, nil
+	}
+	if g.running {
+		g.mu.Unlock()
+		return Value{}, false, errGeneratorRunning
+	}
+	g.running = true
+	start := !g.started
+	g.started = true
+	g.mu.Unlock()
+
+	// The first value starts the body, later ones resume it from the last yield
+	// The body runs on behalf of whichever task asked for the value, so it blocks
+	// that task if it waits on a channel
+	if start {
+		g.interpreter = &Interpreter{
+			out:         g.parent.out,
+			globals:     g.parent.globals,
+			environment: g.parent.globals,
+			generator:   g,
+			scheduler:   g.parent.scheduler,
+			task:        interpreter.task,
+			debugger:    interpreter.debugger,
+			caller:      interpreter,
+			tracer:      interpreter.tracer.fork(),
+			profiler:    interpreter.profiler.fork(),
+			coverage:    interpreter.coverage,
+		}
+		g.parent.scheduler.openGenerator(g)
+		go g.run()
+	} else {
+		g.interpreter.task, g.interpreter.caller = interpreter.task, interpreter
+		g.resume <- struct{}{}
+	}
+
+	result := <-g.results
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.running = false
+	if result.done || result.err != nil {
+		g.finished = true
+		g.parent.scheduler.closedGenerator(g)
+		return Value{}, false, result.err
+	}
+
+	return result.value, true, nil
+}
+
+// Runs the function body on the generator's interpreter
+func (g *Generator) run() {
+
+	// Returning from a generator just finishes it, the value is dropped
+	_, err := g.function.invoke(g.interpreter, g.arguments)
+	g.results <- generatorResult{done: true, err: err}
+}
+
+// Called by the body to hand out a value, then waits to be resumed
+// Returns errGeneratorClosed if the generator is closed instead
+func (g *Generator) yield(value Value) error {
+	g.results <- generatorResult{value: value}
+	select {
+	case <-g.resume:
+		return nil
+	case <-g.done:
+		return errGeneratorClosed
+	}
+}
+
+// Finishes the generator, unwinding its body if it's paused at a yield
+// A running generator is left alone, whoever resumed it is still using it
+func (g *Generator) close() {
+
+	g.mu.Lock()
+	if g.finished || g.running {
+		g.mu.Unlock()
+		return
+	}
+	g.finished = true
+	started := g.started
+	g.mu.Unlock()
+
+	if !started {
+		return
+	}
+	// Wait for the body to finish unwinding, so nothing of it runs after this returns
+	close(g.done)
+	<-g.results
+	g.parent.scheduler.closedGenerator(g)
+}
+
+func (g *Generator) String() string {
+	return "<generator " + g.function.name.lexeme + ">"
+}
@@ -0,0 +1,36 @@
+package lox
+
+import (
+	"io/ioutil"
+	"runtime"
+	"testing"
+)
+
+// Generators abandoned part way through mustn't leave their goroutines behind
+func TestGeneratorsClosed(t *testing.T) {
+
+	source := `fun nat() {
+  var n = 0;
+  while (true) {
+    yield n;
+    n = n + 1;
+  }
+}
+fun first() {
+  for (x in nat()) {
+    return x;
+  }
+}
+for (i in range(1000)) first();
+var left = nat();
+next(left);
+`
+	before := runtime.NumGoroutine()
+	if err := Run(source, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// A closed generator's goroutine can still be on its way out, so allow a few
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Errorf("expected about %d goroutines after the program ended, got %d", before, after)
+	}
+}
@@ -1,45 +1,142 @@
 package lox
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 )
 
 // Represents an interpreter and associated logic
 type Interpreter struct {
-	literal     Literal
+	// The value of the last expression evaluated
+	value       Value
 	environment *Environment
 	globals     *Environment
+	// Where print statements write to, defaults to stdout
+	out io.Writer
+	// The generator this interpreter is running the body of, if any
+	generator *Generator
+	// Runs tasks started with spawn, shared by every interpreter in the program
+	scheduler *Scheduler
+	// The task this interpreter is running
+	task *Task
+	// Stops the program at breakpoints and steps through it, if it's being debugged
+	debugger *Debugger
+	// The calls the debugger shows, innermost last
+	frames []*callFrame
+	// For a generator body, the interpreter that resumed it, whose frames are below these
+	caller *Interpreter
+	// Logs what the program does, if it's being traced
+	tracer *tracer
+	// Measures where the program spends its time, if it's being profiled
+	profiler *profiler
+	// Records which statements and branches run, if coverage is being measured
+	coverage *fileCoverage
+	// Whether a return of a call can hand the call back to the function running
+	// instead of making it, so tail calls don't grow the stack
+	tailCalls bool
+	// Set for a REPL session, whose generators stay open from one entry to the next
+	// until the session is reset or ends
+	session bool
 }
 
 type ReturnValue struct {
-	Literal
+	Value
 }
 
 func (r ReturnValue) Error() string {
-	return r.Literal.String()
+	return r.Value.String()
 }
 
-// Main interpretation loop
-func (i *Interpreter) Interpret(stmts []Stmt) error {
+// Returned by a return statement whose value is a call to a Lox function, for the
+// function running to make once it has returned
+type tailCall struct {
+	function  FuncStmt
+	arguments []Value
+}
+
+func (t tailCall) Error() string {
+	return "tail call to " + t.function.String()
+}
+
+// Returns an interpreter that writes what programs print to out
+// Variables and functions defined by one call to Interpret can be used by the next
+func NewInterpreter(out io.Writer) *Interpreter {
+	i := &Interpreter{out: out}
+	i.setup()
+	return i
+}
+
+// Creates the global scope and the scheduler for any tasks programs spawn
+func (i *Interpreter) setup() {
+
+	// Print to stdout unless told otherwise
+	if i.out == nil {
+		i.out = os.Stdout
+	}
+
+	// Set up the scheduler for any tasks the program spawns
+	// Tasks can print at the same time, so the output has to be shared safely
+	if i.scheduler == nil {
+		i.scheduler, i.task = NewScheduler(deterministicTasks)
+		i.out = &syncWriter{w: i.out}
+	}
 
 	// Initalize the global env
 	i.globals = NewEnvironment(nil)
+	i.globals.scheduler = i.scheduler
 
 	// Create a new environment to initalize the empty map
 	// Set global as the parent env
 	i.environment = NewEnvironment(i.globals)
 
-	// Create a clock variable at the global scope, with a new instance of a clockwq
-	i.globals.Define(Variable{token: Token{tType: VAR, lexeme: "clock", line: 0}}, Literal{Clock{}})
+	// Create a variable at the global scope for each native function, such as clock
+	for name, function := range builtins {
+		i.globals.Define(Variable{token: Token{tType: VAR, lexeme: name, line: 0}}, objectValue(function))
+	}
+}
+
+// Main interpretation loop
+func (i *Interpreter) Interpret(stmts []Stmt) error {
+
+	if i.globals == nil {
+		i.setup()
+	}
+
+	// Generators the program leaves paused are closed once it ends
+	if !i.session {
+		defer i.scheduler.closeGenerators()
+	}
 
 	// Loop through all statements
 	for _, stmt := range stmts {
 		// Exectue the logic for each statement with the vistiro pattern
-		if err := stmt.Accept(i); err != nil {
+		if err := i.execute(stmt); err != nil {
 			return err
 		}
 	}
-	return nil
+
+	// A task that failed without being joined fails the program
+	i.scheduler.wait(i.task)
+	return i.scheduler.unjoinedError()
+}
+
+// Evaluates a single expression and returns its value, for the REPL to show
+func (i *Interpreter) InterpretExpr(expr Expr) (Value, error) {
+
+	if i.globals == nil {
+		i.setup()
+	}
+
+	value, err := i.evaluate(expr)
+	if err != nil {
+		return Value{}, err
+	}
+
+	i.scheduler.wait(i.task)
+	return value, i.scheduler.unjoinedError()
 }
 
 func (i *Interpreter) visitAssign(a Assign) error {
@@ -52,167 +149,192 @@ func (i *Interpreter) visitAssign(a Assign) error {
 	if err := i.environment.Assign(a.variable, l); err != nil {
 		return err
 	}
-
-	if l, ok := a.value.(Literal); ok {
-		i.literal = l
+	if i.tracer != nil {
+		i.tracer.assign(i, a.variable.token, l)
 	}
 
+	i.value = l
+
 	return nil
 }
 
 func (i *Interpreter) visitCall(c Call) error {
 
-	callee, err := i.evaluate(c.callee)
+	callee, arguments, err := i.evaluateCall(c)
 	if err != nil {
 		return err
 	}
+	return i.callValue(c, callee, arguments)
+}
+
+// Evaluates the callee of a call, then its arguments
+func (i *Interpreter) evaluateCall(c Call) (Value, []Value, error) {
 
-	var arguments []Expr
+	callee, err := i.evaluate(c.callee)
+	if err != nil {
+		return Value{}, nil, err
+	}
+
+	var arguments []Value
 	for _, arg := range c.arguments {
 		value, err := i.evaluate(arg)
 		if err != nil {
-			return err
+			return Value{}, nil, err
 		}
 
 		arguments = append(arguments, value)
 	}
+	return callee, arguments, nil
+}
 
-	if function, ok := callee.value.(LoxCallable); ok {
+// Calls the callee with the evaluated arguments, leaving the result in i.value
+func (i *Interpreter) callValue(c Call, callee Value, arguments []Value) error {
 
-		if function.arity() != len(arguments) {
-			return fmt.Errorf("expected %d arguments but %d were provided", function.arity(), len(arguments))
+	if function, ok := callee.object.(LoxCallable); ok {
+
+		if err := checkArity(function, len(arguments), c.paren.line); err != nil {
+			return err
 		}
 
 		val, err := function.call(i, arguments)
 		if err != nil {
+			// Errors from native functions don't know where they were called from,
+			// unless they came from Lox code the function ran, like a joined task
+			if _, ok := function.(FuncStmt); !ok {
+				var located *runtimeError
+				if _, ok := err.(ReturnValue); !ok && !errors.As(err, &located) {
+					return &runtimeError{line: c.paren.line, err: err}
+				}
+			}
 			return err
 		}
 
-		i.literal = val
+		i.value = val
+		return nil
 	}
 
+	return runtimeErrorf(c.paren.line, "can only call functions")
+}
+
+// Checks a callable accepts the number of arguments it's called with
+func checkArity(function LoxCallable, count int, line int) error {
+	if v, ok := function.(variadic); ok {
+		if min, max := v.arityRange(); count < min || count > max {
+			return runtimeErrorf(line, "expected %d to %d arguments but %d were provided", min, max, count)
+		}
+	} else if function.arity() != count {
+		return runtimeErrorf(line, "expected %d arguments but %d were provided", function.arity(), count)
+	}
 	return nil
 }
 
+// Evaluates only the branch selected by the condition
+func (i *Interpreter) visitConditional(c Conditional) error {
+
+	condition, err := i.evaluate(c.condition)
+	if err != nil {
+		return err
+	}
+
+	if condition.truthy() {
+		_, err = i.evaluate(c.thenBranch)
+	} else {
+		_, err = i.evaluate(c.elseBranch)
+	}
+
+	return err
+}
+
 // Implementations of required functions for visitor pattern
 func (i *Interpreter) visitLiteral(l Literal) error {
 
-	// With a literal, it can be returned as is
-	i.literal = l
+	// The constant in the syntax tree becomes a value
+	i.value = valueOf(l.value)
 	return nil
 }
 
 func (i *Interpreter) visitBinary(b Binary) error {
 	// For binary, both sides need to be evaluated
 
-	// Evalaute the right side expression, expeting a single value
-	right, err := i.evaluate(b.right)
+	// Evalaute the left side expression, expeting a single value
+	left, err := i.evaluate(b.left)
 	if err != nil {
 		return err
 	}
 
-	// Evalaute the left side expression, expeting a single value
-	left, err := i.evaluate(b.left)
+	// Evalaute the right side expression, expeting a single value
+	right, err := i.evaluate(b.right)
 	if err != nil {
 		return err
 	}
 
-	operationError := fmt.Errorf("error at line %d: bad operand for binary %s: %T, %T", b.operator.line, b.operator.lexeme, left.value, right.value)
-
 	switch b.operator.tType {
-	// Minus, Slash and Star attempt to convert both operands to float64 and then calculate the result
-	case MINUS:
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l - r}
-				return nil
-			}
+	// Minus, Slash, Star and Percent only operate on numbers
+	// Ints and floats can be mixed, see numbers.go for how the result type is chosen
+	case MINUS, SLASH, STAR, PERCENT:
+		if left.isNumber() && right.isNumber() {
+			return i.arithmetic(b.operator, left, right)
 		}
-		return operationError
-
-	case SLASH:
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l / r}
-				return nil
-			}
-		}
-		return operationError
-	case STAR:
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l * r}
-				return nil
-			}
-		}
-		return operationError
-	// Plus does the same operation on float64. If the values do not convert, string concatenation is attempted
+	// Plus does the same operation on numbers. If the values are not numbers, string concatenation is attempted
 	case PLUS:
 
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l + r}
-				return nil
-			}
+		// Check both sides to make sure they are numbers
+		if left.isNumber() && right.isNumber() {
+			return i.arithmetic(b.operator, left, right)
 			// Plus can also work on strings , so check that as well
-		} else if l, ok := left.value.(string); ok {
-			if r, ok := right.value.(string); ok {
-				i.literal = Literal{l + r}
-				return nil
-			}
+		} else if left.kind == stringKind && right.kind == stringKind {
+			i.value = stringValue(left.str + right.str)
+			return nil
 		}
-		return operationError
-	// The rest are simple truthy-checks
-	// Greater, Greater Equal, Less and Less Equal only operator on float64
-	// Bang Equal and Equal Equal operate on any values
-	case GREATER:
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l > r}
-				return nil
+	// Exponents work on any numbers
+	case STAR_STAR:
+		if left.isNumber() && right.isNumber() {
+			result, err := power(left, right)
+			if err != nil {
+				return &runtimeError{line: b.operator.line, err: err}
 			}
+			i.value = result
+			return nil
 		}
-		return operationError
-
-	case GREATER_EQUAL:
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l >= r}
-			}
-		} else {
-			return operationError
-		}
-	case LESS:
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l < r}
-				return nil
+	// Bitwise operators only work on integers
+	case AMPERSAND, PIPE, CARET, LESS_LESS, GREATER_GREATER:
+		if left.isInteger() && right.isInteger() {
+			result, err := bitwise(b.operator.tType, left, right)
+			if err != nil {
+				return &runtimeError{line: b.operator.line, err: err}
 			}
+			i.value = result
+			return nil
 		}
-		return operationError
-
-	case LESS_EQUAL:
-		// Check both sides to make sure they can be converted to float64s
-		if l, ok := left.value.(float64); ok {
-			if r, ok := right.value.(float64); ok {
-				i.literal = Literal{l <= r}
-				return nil
-			}
+	// The rest are simple truthy-checks
+	// Greater, Greater Equal, Less and Less Equal only operator on numbers
+	// Bang Equal and Equal Equal operate on any values
+	case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL:
+		if left.isNumber() && right.isNumber() {
+			i.value = boolValue(compareNumbers(b.operator.tType, left, right))
+			return nil
 		}
-		return operationError
 	case BANG_EQUAL:
-		i.literal = Literal{left != right}
+		i.value = boolValue(!left.equals(right))
+		return nil
 	case EQUAL_EQUAL:
-		i.literal = Literal{left == right}
+		i.value = boolValue(left.equals(right))
+		return nil
+	default:
+		return nil
+	}
+
+	return runtimeErrorf(b.operator.line, "bad operand for binary %s: %s, %s", b.operator.lexeme, typeName(left), typeName(right))
+}
+
+// Applies an arithmetic operator to two numbers and stores the result
+func (i *Interpreter) arithmetic(operator Token, left, right Value) error {
+	result, err := arithmetic(operator.tType, left, right)
+	if err != nil {
+		return &runtimeError{line: operator.line, err: err}
 	}
 
+	i.value = result
 	return nil
 }
 
@@ -223,18 +345,20 @@ func (i *Interpreter) visitBinary(b Binary) error {
 func (i *Interpreter) visitBlockStmt(b BlockStmt) error {
 	// Create a new environment as the child of the current environment
 	// as assign it as our current environment
-	i.environment = NewEnvironment(i.environment)
+	previous := i.environment
+	i.environment = newFrame(i.environment, b.locals)
+
+	// Reset the environment back to the original environment, even if
+	// a statement errors or returns out of the block
+	defer func() { i.environment = previous }()
 
 	// Range through statements and evaluate them
 	for _, stmt := range b.statements {
-		if err := stmt.Accept(i); err != nil {
+		if err := i.execute(stmt); err != nil {
 			return err
 		}
 	}
 
-	// Reset the environment back to the original environment
-	i.environment = i.environment.enclosing
-
 	return nil
 
 }
@@ -244,13 +368,88 @@ func (i *Interpreter) visitExprStmt(e ExprStmt) error {
 	return e.expression.Accept(i)
 }
 
+// Visitor pattern for for-in loops
+// Gets an iterator for the iterable, then runs the body once per value with the loop
+// variables defined in a new scope, so closures in the body capture that iteration's values
+func (i *Interpreter) visitForInStmt(f ForInStmt) error {
+
+	iterable, err := i.evaluate(f.iterable)
+	if err != nil {
+		return err
+	}
+
+	iterator, err := iterate(iterable)
+	if err != nil {
+		return &runtimeError{line: f.keyword.line, err: err}
+	}
+
+	// Loops with a key and a value need an iterator that can produce both
+	pairs, isPairs := iterator.(pairIterator)
+	if len(f.names) == 2 && !isPairs {
+		return runtimeErrorf(f.keyword.line, "can't loop over keys and values of %s", typeName(iterable))
+	}
+
+	// A loop that stops early, such as by returning, lets go of what the iterator holds
+	if closing, ok := iterator.(closingIterator); ok {
+		defer closing.close()
+	}
+
+	previous := i.environment
+	defer func() { i.environment = previous }()
+
+	for {
+		// Get the next value(s), stopping once the iterator is finished
+		var key, value Value
+		var ok bool
+		if len(f.names) == 2 {
+			key, value, ok, err = pairs.nextPair(i)
+		} else {
+			value, ok, err = iterator.next(i)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			i.branch(f.keyword, 1)
+			return nil
+		}
+		i.branch(f.keyword, 0)
+
+		// Create the scope for this iteration and define the loop variables in it
+		i.environment = newFrame(previous, f.locals)
+		if len(f.names) == 2 {
+			i.environment.defineSlot(0, key)
+			i.environment.defineSlot(1, value)
+			if i.tracer != nil {
+				i.tracer.define(i, f.names[0], key)
+				i.tracer.define(i, f.names[1], value)
+			}
+		} else {
+			i.environment.defineSlot(0, value)
+			if i.tracer != nil {
+				i.tracer.define(i, f.names[0], value)
+			}
+		}
+
+		if err := i.execute(f.body); err != nil {
+			return err
+		}
+		if i.debugger != nil {
+			i.debugger.iterated(i)
+		}
+	}
+}
+
 func (i *Interpreter) visitFuncStmt(f FuncStmt) error {
 
 	f.closure = i.environment
 
-	if err := i.environment.Define(Variable{f.name}, Literal{f}); err != nil {
+	if err := i.environment.Define(Variable{token: f.name, binding: f.binding}, objectValue(f)); err != nil {
 		return err
 	}
+	if i.tracer != nil {
+		i.tracer.define(i, f.name, objectValue(f))
+	}
 	return nil
 }
 
@@ -264,14 +463,16 @@ func (i *Interpreter) visitIfStmt(ifStmt IfStmt) error {
 		return err
 	}
 
-	if isTruthy(expr) {
-		err = ifStmt.branch.Accept(i)
+	if expr.truthy() {
+		i.branch(ifStmt.keyword, 0)
+		err = i.execute(ifStmt.branch)
 		if err != nil {
 			return err
 		}
 	} else {
+		i.branch(ifStmt.keyword, 1)
 		if ifStmt.elseStmt != nil {
-			err = ifStmt.elseStmt.Accept(i)
+			err = i.execute(ifStmt.elseStmt)
 			if err != nil {
 				return err
 			}
@@ -290,38 +491,113 @@ func (i *Interpreter) visitPrintStmt(p PrintStmt) error {
 		return err
 	}
 	// Print the result
-	fmt.Println(expr.value)
+	fmt.Fprintln(i.out, expr.String())
 	return nil
 }
 
 func (i *Interpreter) visitReturnStmt(r ReturnStmt) error {
+	// A return with no value returns nil
+	if r.value == nil {
+		return ReturnValue{Value{}}
+	}
+
+	// The function can make a call it returns the result of itself, once this
+	// call has finished, instead of the call nesting inside it
+	if i.tailCalls {
+		return i.tailReturn(r.value)
+	}
+
 	if err := r.value.Accept(i); err != nil {
 		return err
 	} else {
-		return ReturnValue{i.literal}
+		return ReturnValue{i.value}
+	}
+}
+
+// Evaluates the value of a return, finding the calls in tail position: the value
+// itself, either arm of a ?: and the right side of and, or and ??
+func (i *Interpreter) tailReturn(expr Expr) error {
+
+	switch e := expr.(type) {
+	case Call:
+		return i.tailCall(e)
+	case Grouping:
+		return i.tailReturn(e.expression)
+	case Conditional:
+		condition, err := i.evaluate(e.condition)
+		if err != nil {
+			return err
+		}
+		if condition.truthy() {
+			return i.tailReturn(e.thenBranch)
+		}
+		return i.tailReturn(e.elseBranch)
+	case Logical:
+		left, err := i.evaluate(e.left)
+		if err != nil {
+			return err
+		}
+		if shortCircuits(e.operator.tType, left) {
+			i.branch(e.operator, 1)
+			return ReturnValue{left}
+		}
+		i.branch(e.operator, 0)
+		return i.tailReturn(e.right)
+	}
+
+	value, err := i.evaluate(expr)
+	if err != nil {
+		return err
+	}
+	return ReturnValue{value}
+}
+
+// Evaluates a call a function returns the result of
+// A call to a Lox function is handed back to the function running as a tailCall,
+// anything else is called here
+func (i *Interpreter) tailCall(c Call) error {
+
+	callee, arguments, err := i.evaluateCall(c)
+	if err != nil {
+		return err
+	}
+
+	if function, ok := callee.object.(FuncStmt); ok && !function.isGenerator {
+		if err := checkArity(function, len(arguments), c.paren.line); err != nil {
+			return err
+		}
+		return tailCall{function, arguments}
+	}
+
+	if err := i.callValue(c, callee, arguments); err != nil {
+		return err
 	}
+	return ReturnValue{i.value}
 }
 
 // Visitor pattern for Var statements
 func (i *Interpreter) visitVarStmt(v VarStmt) error {
 
-	// Reset the interpreter literal
-	i.literal = Literal{nil}
+	// Reset the interpreter value
+	i.value = Value{}
 
 	// If the right hand size exists, evaluate it
-	// Evaluate here sets i.literal to the result of the expression
+	// Evaluate here sets i.value to the result of the expression
 	if v.initializer != nil {
 		if _, err := i.evaluate(v.initializer); err != nil {
 			return err
 		}
 	}
 
-	// Define the variable and map it to the current value of i.literal
-	// If there's no value to assign, it will map to a Literal{nil}
+	// Define the variable and map it to the current value of i.value
+	// If there's no value to assign, it will map to nil
 	// Otherwise it will map to the result of the expression in the initializer
-	if err := i.environment.Define(Variable{v.name}, i.literal); err != nil {
+	if err := i.environment.Define(Variable{token: v.name, binding: v.binding}, i.value); err != nil {
 		return err
 	}
+	if i.tracer != nil {
+		i.tracer.define(i, v.name, i.value)
+	}
 
 	return nil
 }
@@ -334,17 +610,45 @@ func (i *Interpreter) visitWhileStmt(w WhileStmt) error {
 			return err
 		}
 
-		if !isTruthy(isTrue) {
+		if !isTrue.truthy() {
+			i.branch(w.keyword, 1)
 			return nil
 		}
 
-		if err := w.body.Accept(i); err != nil {
+		i.branch(w.keyword, 0)
+		if err := i.execute(w.body); err != nil {
 			return err
 		}
+		if i.debugger != nil {
+			i.debugger.iterated(i)
+		}
 	}
+}
 
-	return nil
+// Visitor pattern for yield statements
+// Hands the value to whoever asked the generator for its next value, then waits until
+// the generator is asked for another one
+func (i *Interpreter) visitYieldStmt(y YieldStmt) error {
+
+	if i.generator == nil {
+		return runtimeErrorf(y.keyword.line, "can't yield outside of a generator")
+	}
+
+	value := Value{}
+	if y.value != nil {
+		var err error
+		if value, err = i.evaluate(y.value); err != nil {
+			return err
+		}
+	}
+
+	if i.profiler != nil {
+		i.profiler.suspend()
+		defer i.profiler.resume()
+	}
+	return i.generator.yield(value)
 }
+
 func (i *Interpreter) visitGrouping(g Grouping) error {
 
 	// Send the expression back into the visitor
@@ -353,40 +657,131 @@ func (i *Interpreter) visitGrouping(g Grouping) error {
 	return err
 }
 
+// Evaluates each part of the interpolated string and joins their string representations
+func (i *Interpreter) visitInterpolation(in Interpolation) error {
+
+	var sb strings.Builder
+	for _, part := range in.parts {
+		value, err := i.evaluate(part)
+		if err != nil {
+			return err
+		}
+		sb.WriteString(value.String())
+	}
+
+	i.value = stringValue(sb.String())
+	return nil
+}
+
+// Evaluates each element into a new list
+func (i *Interpreter) visitListLiteral(l ListLiteral) error {
+
+	list := &LoxList{}
+	for _, element := range l.elements {
+		value, err := i.evaluate(element)
+		if err != nil {
+			return err
+		}
+		list.elements = append(list.elements, value)
+	}
+
+	i.value = objectValue(list)
+	return nil
+}
+
 func (i *Interpreter) visitLogical(l Logical) error {
 	left, err := i.evaluate(l.left)
 	if err != nil {
 		return err
 	}
 
-	if l.operator.tType == OR {
-		// If the laft is false, return the right's truth value
-		if !isTruthy(left) {
-			right, err := i.evaluate(l.right)
-			if err != nil {
-				return err
-			}
-			i.literal = Literal{value: isTruthy(right)}
-		} else {
-			// If the left is true, then the "or" is true
-			i.literal = Literal{value: true}
-		}
-	} else if l.operator.tType == AND {
-		// This could probably be moved to just an ekse
-		// since "or" and "and" are the only two logicals
-		if isTruthy(left) {
-			// If the left is true, return the truthiness of the right
-			right, err := i.evaluate(l.right)
-			if err != nil {
-				return err
-			}
-			i.literal = Literal{value: isTruthy(right)}
-		} else {
-			// If left is false, no need to check right
-			i.literal = Literal{value: false}
+	// Only evaluate the right side if the left doesn't decide the result
+	if shortCircuits(l.operator.tType, left) {
+		i.branch(l.operator, 1)
+		i.value = left
+		return nil
+	}
+
+	i.branch(l.operator, 0)
+	right, err := i.evaluate(l.right)
+	if err != nil {
+		return err
+	}
+	i.value = right
+	return nil
+}
+
+// Reports whether the left side of a logical operator is its result, so the right
+// side isn't evaluated
+// That's a left that isn't nil for ??, a true one for or and a false one for and
+func shortCircuits(operator TokenType, left Value) bool {
+	switch operator {
+	case QUESTION_QUESTION:
+		return left.kind != nilKind
+	case OR:
+		return left.truthy()
+	default:
+		return !left.truthy()
+	}
+}
+
+// Evaluates each key and value, in order, into a new map
+func (i *Interpreter) visitMapLiteral(m MapLiteral) error {
+
+	result := NewLoxMap()
+	for n := range m.keys {
+		key, err := i.evaluate(m.keys[n])
+		if err != nil {
+			return err
+		}
+
+		value, err := i.evaluate(m.values[n])
+		if err != nil {
+			return err
+		}
+
+		if err := result.Set(key, value); err != nil {
+			return &runtimeError{line: m.brace.line, err: err}
 		}
 	}
 
+	i.value = objectValue(result)
+	return nil
+}
+
+// Evaluates the callee and arguments, then starts the call running as a new task
+// The value of the expression is the task, which can be passed to join()
+func (i *Interpreter) visitSpawn(s Spawn) error {
+
+	callee, err := i.evaluate(s.call.callee)
+	if err != nil {
+		return err
+	}
+
+	var arguments []Value
+	for _, arg := range s.call.arguments {
+		value, err := i.evaluate(arg)
+		if err != nil {
+			return err
+		}
+		arguments = append(arguments, value)
+	}
+
+	function, ok := callee.object.(LoxCallable)
+	if !ok {
+		return runtimeErrorf(s.keyword.line, "can only spawn functions")
+	}
+	if err := checkArity(function, len(arguments), s.call.paren.line); err != nil {
+		return err
+	}
+
+	// Name the task after the function, if it has one
+	name := "task"
+	if f, ok := function.(FuncStmt); ok {
+		name = f.name.lexeme
+	}
+
+	i.value = objectValue(i.scheduler.spawn(i, function, arguments, name))
 	return nil
 }
 
@@ -400,16 +795,23 @@ func (i *Interpreter) visitUnary(u Unary) error {
 
 	switch u.operator.tType {
 	case MINUS:
-		// Ensure the value can be converted to a float64 and return the negation if it
-		if value, ok := i.literal.value.(float64); ok {
-			i.literal = Literal{-value}
+		// Ensure the value is a number and return the negation of it
+		if i.value.isNumber() {
+			i.value = negate(i.value)
 		} else {
 			// Indicates the value cannot be converted into a number and cannot be negated
-			return fmt.Errorf("error at line %d: bad operand for unary %s: %T", u.operator.line, u.operator.lexeme, i.literal.value)
+			return runtimeErrorf(u.operator.line, "bad operand for unary %s: %s", u.operator.lexeme, typeName(i.value))
+		}
+	case TILDE:
+		// Bitwise complement only works on integers
+		if i.value.isInteger() {
+			i.value = complement(i.value)
+		} else {
+			return runtimeErrorf(u.operator.line, "bad operand for unary %s: %s", u.operator.lexeme, typeName(i.value))
 		}
 	case BANG:
 		// Invert the truthiness i.e. var a = true; !a;
-		i.literal = Literal{!isTruthy(i.literal)}
+		i.value = boolValue(!i.value.truthy())
 	}
 
 	return nil
@@ -423,31 +825,41 @@ func (i *Interpreter) visitVariable(v Variable) error {
 		return err
 	}
 
-	// Place the value of variable in the interpreter literal
-	if lit, ok := value.(Literal); ok {
-		i.literal = lit
-	}
+	// Place the value of variable in the interpreter value
+	i.value = value
 
 	return nil
 }
 
-func (i *Interpreter) evaluate(expr Expr) (Literal, error) {
-	// Use the visitor to continue to evaluate the expression
-	err := expr.Accept(i)
-	return i.literal, err
+// Runs a statement, letting the debugger stop the program first if there is one, and
+// tracing, profiling and recording coverage of it as needed
+func (i *Interpreter) execute(stmt Stmt) error {
+	if i.debugger != nil {
+		if err := i.debugger.statement(i, stmt); err != nil {
+			return err
+		}
+	}
+	if i.tracer != nil {
+		i.tracer.statement(i, stmt)
+	}
+	if i.profiler != nil {
+		i.profiler.statement(stmt)
+	}
+	if i.coverage != nil {
+		i.coverage.statement(stmt)
+	}
+	return stmt.Accept(i)
 }
 
-func isTruthy(l Literal) bool {
-	// If the value is already a bool, just return in
-	if b, ok := l.value.(bool); ok {
-		return b
-	} else {
-		// If the value is nil, return false
-		if l.value == nil {
-			return false
-		} else {
-			//Every other value is true
-			return true
-		}
+// Records which way a branch went, if coverage is being measured
+func (i *Interpreter) branch(at Token, arm int) {
+	if i.coverage != nil {
+		i.coverage.branch(at, arm)
 	}
 }
+
+func (i *Interpreter) evaluate(expr Expr) (Value, error) {
+	// Use the visitor to continue to evaluate the expression
+	err := expr.Accept(i)
+	return i.value, err
+}
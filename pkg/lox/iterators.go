@@ -0,0 +1,186 @@
+package lox
+
+import (
+	"fmt"
+)
+
+// Iterator is the protocol for-in loops use to walk over a value
+// Lists, maps, strings, ranges and generators all provide one
+type Iterator interface {
+	// Returns the next value, or false once there are no more values
+	next(interpreter *Interpreter) (Value, bool, error)
+}
+
+// Implemented by iterators that can also produce key/value pairs
+// for loops like for (k, v in map)
+type pairIterator interface {
+	Iterator
+	nextPair(interpreter *Interpreter) (Value, Value, bool, error)
+}
+
+// Implemented by iterators holding on to something that has to be let go of when a loop
+// stops before they're finished, such as a generator's paused body
+type closingIterator interface {
+	Iterator
+	close()
+}
+
+// Returns an iterator over a value
+// Lists give their elements, maps their keys and strings their characters.
+// A function taking no arguments is called repeatedly, and each value it
+// returns is produced until it returns nil
+func iterate(value Value) (Iterator, error) {
+	if value.kind == stringKind {
+		return &stringIterator{runes: []rune(value.str)}, nil
+	}
+	switch v := value.object.(type) {
+	case Iterator:
+		return v, nil
+	case *LoxList:
+		return &listIterator{list: v}, nil
+	case *LoxMap:
+		return &mapIterator{m: v}, nil
+	case LoxCallable:
+		if v.arity() == 0 {
+			return &functionIterator{function: v}, nil
+		}
+	}
+	return nil, fmt.Errorf("can't iterate over %s", typeName(value))
+}
+
+// Walks over the elements of a list, with their indexes as keys
+type listIterator struct {
+	list  *LoxList
+	index int
+}
+
+func (l *listIterator) next(interpreter *Interpreter) (Value, bool, error) {
+	_, value, ok, err := l.nextPair(interpreter)
+	return value, ok, err
+}
+
+func (l *listIterator) nextPair(interpreter *Interpreter) (Value, Value, bool, error) {
+	// Check the length each time, since the list may change while looping
+	if l.index >= len(l.list.elements) {
+		return Value{}, Value{}, false, nil
+	}
+
+	index := l.index
+	l.index++
+	return intValue(int64(index)), l.list.elements[index], true, nil
+}
+
+func (l *listIterator) String() string {
+	return "<iterator>"
+}
+
+// Walks over the keys of a map in the order they were added, with their values
+type mapIterator struct {
+	m     *LoxMap
+	index int
+}
+
+func (m *mapIterator) next(interpreter *Interpreter) (Value, bool, error) {
+	key, _, ok, err := m.nextPair(interpreter)
+	return key, ok, err
+}
+
+func (m *mapIterator) nextPair(interpreter *Interpreter) (Value, Value, bool, error) {
+	if m.index >= len(m.m.keys) {
+		return Value{}, Value{}, false, nil
+	}
+
+	key := m.m.keys[m.index]
+	m.index++
+	value, _ := m.m.Get(key)
+	return key, value, true, nil
+}
+
+func (m *mapIterator) String() string {
+	return "<iterator>"
+}
+
+// Walks over the characters of a string, with their indexes as keys
+type stringIterator struct {
+	runes []rune
+	index int
+}
+
+func (s *stringIterator) next(interpreter *Interpreter) (Value, bool, error) {
+	_, value, ok, err := s.nextPair(interpreter)
+	return value, ok, err
+}
+
+func (s *stringIterator) nextPair(interpreter *Interpreter) (Value, Value, bool, error) {
+	if s.index >= len(s.runes) {
+		return Value{}, Value{}, false, nil
+	}
+
+	index := s.index
+	s.index++
+	return intValue(int64(index)), stringValue(string(s.runes[index])), true, nil
+}
+
+func (s *stringIterator) String() string {
+	return "<iterator>"
+}
+
+// Produces numbers lazily from start up to (but not including) end, moving by step
+type rangeIterator struct {
+	current Value
+	end     Value
+	step    Value
+}
+
+func (r *rangeIterator) next(interpreter *Interpreter) (Value, bool, error) {
+
+	// Count up for positive steps and down for negative ones
+	done := compareNumbers(GREATER_EQUAL, r.current, r.end)
+	if compareNumbers(LESS, r.step, intValue(0)) {
+		done = compareNumbers(LESS_EQUAL, r.current, r.end)
+	}
+	if done {
+		return Value{}, false, nil
+	}
+
+	value := r.current
+	nextValue, err := arithmetic(PLUS, r.current, r.step)
+	if err != nil {
+		return Value{}, false, err
+	}
+	r.current = nextValue
+
+	return value, true, nil
+}
+
+func (r *rangeIterator) String() string {
+	return "<iterator>"
+}
+
+// Calls a function until it returns nil
+type functionIterator struct {
+	function LoxCallable
+	done     bool
+}
+
+func (f *functionIterator) next(interpreter *Interpreter) (Value, bool, error) {
+	if f.done {
+		return Value{}, false, nil
+	}
+
+	value, err := f.function.call(interpreter, nil)
+	if err != nil {
+		return Value{}, false, err
+	}
+
+	if value.kind == nilKind {
+		f.done = true
+		return Value{}, false, nil
+	}
+
+	return value, true, nil
+}
+
+func (f *functionIterator) String() string {
+	return "<iterator>"
+}
@@ -0,0 +1,304 @@
+package lox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returned when reading a line is cancelled with Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// Reads the lines of input typed into the REPL
+type lineReader interface {
+	// Shows the prompt and returns the line typed, without the newline
+	// Returns io.EOF at the end of input and errInterrupted if the line was cancelled
+	readLine(prompt string) (string, error)
+}
+
+// Reads lines from input that isn't a terminal, such as a pipe
+type plainReader struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *plainReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(p.out, prompt)
+	line, err := p.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		// The last line didn't end in a newline
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// Lines entered in previous sessions, saved to a file so they survive restarts
+type history struct {
+	entries []string
+	path    string
+}
+
+// Most lines kept in the history file
+const maxHistory = 1000
+
+// Returns the history file to use, $LOX_HISTORY or ~/.lox_history
+func historyPath() string {
+	if path := os.Getenv("LOX_HISTORY"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".lox_history")
+}
+
+// Loads the history saved in the file at path
+// A missing file just means there's no history yet
+func loadHistory(path string) *history {
+	h := &history{path: path}
+	if path == "" {
+		return h
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return h
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+	return h
+}
+
+// Adds a line to the history and appends it to the history file
+// Blank lines and repeats of the last line are skipped
+func (h *history) add(line string) {
+	if strings.TrimSpace(line) == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == line) {
+		return
+	}
+	h.entries = append(h.entries, line)
+
+	// Failing to save history shouldn't stop the session
+	if h.path == "" {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// Key codes the editor handles
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlK     = 11
+	keyCtrlU     = 21
+	keyTab       = 9
+	keyEnter     = 13
+	keyNewline   = 10
+	keyEscape    = 27
+	keyBackspace = 127
+	keyCtrlH     = 8
+)
+
+// Edits lines typed into a terminal in raw mode, with cursor movement, history
+// with the up and down arrows, and tab completion
+type editor struct {
+	fd      int
+	in      *bufio.Reader
+	out     io.Writer
+	history *history
+	// Returns the words that could complete the prefix
+	complete func(prefix string) []string
+
+	prompt string
+	line   []rune
+	// Position of the cursor in line
+	pos int
+}
+
+func newEditor(fd int, in io.Reader, out io.Writer, h *history, complete func(string) []string) *editor {
+	return &editor{fd: fd, in: bufio.NewReader(in), out: out, history: h, complete: complete}
+}
+
+func (e *editor) readLine(prompt string) (string, error) {
+
+	// Only stay in raw mode while reading, so the program's output looks normal
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	e.prompt, e.line, e.pos = prompt, nil, 0
+	e.refresh()
+
+	// Index of the history entry being shown, and the line being typed before
+	// moving into the history
+	index := len(e.history.entries)
+	var typed []rune
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case keyEnter, keyNewline:
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.line), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			// Ctrl-D on an empty line ends the session, otherwise it deletes
+			if len(e.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.delete()
+		case keyBackspace, keyCtrlH:
+			if e.pos > 0 {
+				e.pos--
+				e.delete()
+			}
+		case keyCtrlA:
+			e.pos = 0
+		case keyCtrlE:
+			e.pos = len(e.line)
+		case keyCtrlK:
+			e.line = e.line[:e.pos]
+		case keyCtrlU:
+			e.line = e.line[e.pos:]
+			e.pos = 0
+		case keyTab:
+			e.completeWord()
+		case keyEscape:
+			// Arrow keys and friends come as ESC [ followed by a code
+			if next, _, _ := e.in.ReadRune(); next != '[' && next != 'O' {
+				continue
+			}
+			code, _, _ := e.in.ReadRune()
+			switch code {
+			case 'A':
+				if index > 0 {
+					if index == len(e.history.entries) {
+						typed = append([]rune(nil), e.line...)
+					}
+					index--
+					e.setLine([]rune(e.history.entries[index]))
+				}
+			case 'B':
+				if index < len(e.history.entries) {
+					index++
+					if index == len(e.history.entries) {
+						e.setLine(typed)
+					} else {
+						e.setLine([]rune(e.history.entries[index]))
+					}
+				}
+			case 'C':
+				if e.pos < len(e.line) {
+					e.pos++
+				}
+			case 'D':
+				if e.pos > 0 {
+					e.pos--
+				}
+			case 'H':
+				e.pos = 0
+			case 'F':
+				e.pos = len(e.line)
+			case '3':
+				// Delete is ESC [ 3 ~
+				if tilde, _, _ := e.in.ReadRune(); tilde == '~' {
+					e.delete()
+				}
+			}
+		default:
+			if r >= ' ' {
+				e.insert([]rune{r})
+			}
+		}
+
+		e.refresh()
+	}
+}
+
+// Replaces the whole line, leaving the cursor at the end
+func (e *editor) setLine(line []rune) {
+	e.line = append([]rune(nil), line...)
+	e.pos = len(e.line)
+}
+
+func (e *editor) insert(text []rune) {
+	line := append([]rune(nil), e.line[:e.pos]...)
+	line = append(line, text...)
+	e.line = append(line, e.line[e.pos:]...)
+	e.pos += len(text)
+}
+
+// Deletes the character under the cursor
+func (e *editor) delete() {
+	if e.pos < len(e.line) {
+		e.line = append(e.line[:e.pos], e.line[e.pos+1:]...)
+	}
+}
+
+// Completes the word before the cursor
+// If several words match, it completes as far as they agree and lists them
+func (e *editor) completeWord() {
+
+	start := e.pos
+	for start > 0 && isAlphaNumeric(e.line[start-1]) {
+		start--
+	}
+	prefix := string(e.line[start:e.pos])
+	if prefix == "" {
+		return
+	}
+
+	matches := e.complete(prefix)
+	if len(matches) == 0 {
+		return
+	}
+
+	common := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if len(common) > len(prefix) {
+		e.insert([]rune(common[len(prefix):]))
+		return
+	}
+	if len(matches) > 1 {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+	}
+}
+
+// Redraws the prompt and line, and puts the cursor back where it belongs
+func (e *editor) refresh() {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K\r", e.prompt, string(e.line))
+	if column := len([]rune(e.prompt)) + e.pos; column > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dC", column)
+	}
+}
@@ -0,0 +1,69 @@
+package lox
+
+import (
+	"reflect"
+	"testing"
+)
+
+func lintAll(t *testing.T, source string) []string {
+	t.Helper()
+	rules := map[string]bool{}
+	for _, rule := range LintRules {
+		rules[rule.Name] = true
+	}
+	diagnostics, err := Lint(source, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, d := range diagnostics {
+		found = append(found, d.String())
+	}
+	return found
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"unused variable", "var a = 1;\nvar _b = 2;\n", []string{"1:5: variable a is never used (unused-variable)"}},
+		{"unused parameter", "fun f(a, b) { return a; }\nprint f(1, 2);\n", []string{"1:10: parameter b is never used (unused-parameter)"}},
+		{"global used before declaration", "fun f() { return g; }\nvar g = 1;\nprint f();\n", nil},
+		{"shadow", "var a = 1;\n{\n  var a = 2;\n  print a;\n}\nprint a;\n", []string{"3:7: a shadows the declaration on line 1 (shadow)"}},
+		{"unreachable", "fun f() {\n  return 1;\n  print 2;\n  print 3;\n}\nprint f();\n", []string{"3:3: unreachable code (unreachable)"}},
+		{"assign in condition", "var a = 1;\nif (a = 2) print a;\nwhile ((a = 3)) print a;\n", []string{"2:5: assignment to a used as a condition, did you mean ==? (assign-in-condition)"}},
+		{"missing return", "fun f(a) {\n  if (a) return 1;\n}\nfun g(a) {\n  if (a) return 1; else return 2;\n}\nprint f(1) + g(1);\n", []string{"1:5: f returns a value on some paths but not all of them (missing-return)"}},
+		{"arity", "print h(1);\nfun h(a, b) { return a + b; }\nprint len();\nprint range(1, 2);\n", []string{
+			"1:7: h expects 2 arguments but is called with 1 (arity)",
+			"3:7: len expects 1 argument but is called with 0 (arity)",
+		}},
+		{"reassigned function", "fun f(a) { return a; }\nf = clock;\nprint f();\n", nil},
+		{"impossible comparison", "var a = 1;\nprint a == \"1\";\nprint 1 == \"1\";\nprint 1 != 1.0;\nprint [] != nil;\n", []string{
+			"3:9: comparing number with string using == is always false (impossible-comparison)",
+			"5:10: comparing list with nil using != is always true (impossible-comparison)",
+		}},
+		{"ignore comments", "var a = 1; // lint:ignore unused-variable\n// lint:ignore\nvar b = 2;\nvar c = 3; // lint:ignore shadow\n", []string{"4:5: variable c is never used (unused-variable)"}},
+		{"trailing ignore", "var a = 1; // lint:ignore unused-variable\nvar b = 2;\n", []string{"2:5: variable b is never used (unused-variable)"}},
+		{"file ignore", "// lint:file-ignore unused-variable,unreachable\nvar a = 1;\n", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := lintAll(t, test.source); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLintRules(t *testing.T) {
+	diagnostics, err := Lint("var a = 1;\n{ var a = 2; print a; }\n", map[string]bool{"shadow": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Rule != "shadow" {
+		t.Errorf("got %v, want only the shadow finding", diagnostics)
+	}
+}
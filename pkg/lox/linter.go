@@ -0,0 +1,663 @@
+package lox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The linter looks for code that runs but probably doesn't do what was meant.
+// It walks the syntax tree once, keeping track of the names declared in each scope
+// the same way the interpreter's environments do, and reports what it finds as
+// Diagnostics. Each check is a rule that can be turned on and off.
+//
+// Findings can be silenced in the source with comments:
+//
+//	// lint:ignore             silences every rule on this line
+//	// lint:ignore rule,rule   silences the listed rules on this line
+//	// lint:file-ignore rule   silences the listed rules, or every rule, in the whole file
+//
+// A lint:ignore comment on a line of its own silences the next line as well.
+//
+// Names starting with _ are never reported as unused.
+
+// LintRule is a check the linter can make
+type LintRule struct {
+	Name string
+	Help string
+	// Set if the rule is checked unless it is disabled
+	Default bool
+}
+
+// LintRules lists every rule the linter knows
+var LintRules = []LintRule{
+	{"unused-variable", "variables that are never read", true},
+	{"unused-parameter", "function parameters that are never read", true},
+	{"shadow", "declarations that hide a name from an enclosing scope", false},
+	{"unreachable", "statements after a return, which can never run", true},
+	{"assign-in-condition", "assignments used as a condition, which are usually a mistyped ==", true},
+	{"missing-return", "functions that return a value on some paths but not all of them", true},
+	{"arity", "calls with the wrong number of arguments to a known function", true},
+	{"impossible-comparison", "== and != between values of different types, which always give the same answer", true},
+}
+
+// DefaultLintRules returns the set of rules checked when none are enabled or disabled
+func DefaultLintRules() map[string]bool {
+	rules := map[string]bool{}
+	for _, rule := range LintRules {
+		if rule.Default {
+			rules[rule.Name] = true
+		}
+	}
+	return rules
+}
+
+// IsLintRule reports whether name is the name of a lint rule
+func IsLintRule(name string) bool {
+	for _, rule := range LintRules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Diagnostic is a problem the linter found
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Rule    string
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s (%s)", d.Line, d.Column, d.Message, d.Rule)
+}
+
+// Lint checks the source with the rules in the set, returning what it finds in the
+// order it appears in the source
+// Returns ErrCompile if the source has errors, which are written to errorOutput
+func Lint(source string, rules map[string]bool) ([]Diagnostic, error) {
+
+	stmts, err := parseSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	diagnostics := suppress(analyze(stmts, rules).diagnostics, source)
+	sort.SliceStable(diagnostics, func(a, b int) bool {
+		if diagnostics[a].Line != diagnostics[b].Line {
+			return diagnostics[a].Line < diagnostics[b].Line
+		}
+		return diagnostics[a].Column < diagnostics[b].Column
+	})
+	return diagnostics, nil
+}
+
+// Removes the diagnostics silenced by lint:ignore and lint:file-ignore comments
+func suppress(diagnostics []Diagnostic, source string) []Diagnostic {
+
+	s := NewScanner(source)
+	s.keepComments = true
+	s.scanTokens()
+
+	// Rules ignored on each line, with "" standing for every rule
+	lines := map[int][]string{}
+	var file []string
+	for n, token := range s.tokens {
+		if token.tType != COMMENT || !strings.HasPrefix(token.lexeme, "//") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(token.lexeme, "//"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		rules := []string{""}
+		if len(fields) > 1 {
+			rules = strings.Split(fields[1], ",")
+		}
+		switch fields[0] {
+		case "lint:ignore":
+			// A comment covers its own line and, when it's on a line of its own, the next one
+			lines[token.line] = append(lines[token.line], rules...)
+			if n == 0 || s.tokens[n-1].line < token.line {
+				lines[token.line+1] = append(lines[token.line+1], rules...)
+			}
+		case "lint:file-ignore":
+			file = append(file, rules...)
+		}
+	}
+
+	ignored := func(rules []string, rule string) bool {
+		for _, r := range rules {
+			if r == "" || r == rule {
+				return true
+			}
+		}
+		return false
+	}
+
+	var kept []Diagnostic
+	for _, d := range diagnostics {
+		if !ignored(file, d.Rule) && !ignored(lines[d.Line], d.Rule) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// A name declared in a scope
+type declaration struct {
+	token Token
+	// "variable", "parameter", "loop variable" or "function"
+	kind string
+	// The function, if this declares one
+	function *FuncStmt
+	// Doc comment written above the declaration, if any
+	doc string
+	// Last token of the scope the name is declared in, or a zero Token for the
+	// global scope, which lasts until the end of the file
+	scopeEnd Token
+	read     bool
+	// Set if something other than the declaration assigns the name
+	reassigned bool
+}
+
+// A use of a name that couldn't be resolved where it appeared, because it is a
+// global declared further down
+type pendingRef struct {
+	token Token
+	write bool
+}
+
+// A call to a named function, checked once every assignment has been seen
+type pendingCall struct {
+	callee Token
+	count  int
+	// The declaration the callee resolved to, or nil if it didn't resolve
+	decl *declaration
+}
+
+// Information about the function being checked
+type lintFunction struct {
+	// Set if the function has a return with a value
+	returnsValue bool
+}
+
+// Walks the syntax tree with the visitor pattern, collecting diagnostics
+type linter struct {
+	rules       map[string]bool
+	diagnostics []Diagnostic
+
+	// Innermost scope last, the first is the global scope
+	scopes []map[string]*declaration
+	// Last token of each scope in scopes
+	ends      []Token
+	functions []*lintFunction
+	pending   []pendingRef
+	calls     []pendingCall
+
+	// Every declaration, in the order they were made
+	declarations []*declaration
+	// Every name in the program, declared or used, and the declaration it refers to
+	// Names that aren't declared anywhere, like builtins, refer to nil
+	references map[Token]*declaration
+}
+
+// Checks a program, returning the linter with what it found and the names it resolved
+func analyze(stmts []Stmt, rules map[string]bool) *linter {
+	l := &linter{rules: rules, references: map[Token]*declaration{}}
+	l.program(stmts)
+	return l
+}
+
+func (l *linter) report(t Token, rule string, format string, args ...interface{}) {
+	if l.rules[rule] {
+		l.diagnostics = append(l.diagnostics, Diagnostic{t.line, t.column, rule, fmt.Sprintf(format, args...)})
+	}
+}
+
+func (l *linter) program(stmts []Stmt) {
+
+	l.beginScope(Token{})
+	l.statements(stmts)
+
+	// Uses inside functions can refer to globals declared after the function
+	globals := l.scopes[0]
+	for _, ref := range l.pending {
+		if decl, ok := globals[ref.token.lexeme]; ok {
+			l.references[ref.token] = decl
+			if ref.write {
+				decl.reassigned = true
+			} else {
+				decl.read = true
+			}
+		}
+	}
+	for n, call := range l.calls {
+		if call.decl == nil {
+			l.calls[n].decl = globals[call.callee.lexeme]
+		}
+	}
+	l.checkCalls()
+
+	l.endScope()
+}
+
+// Pushes a new scope, which lasts until the end token
+func (l *linter) beginScope(end Token) {
+	l.scopes = append(l.scopes, map[string]*declaration{})
+	l.ends = append(l.ends, end)
+}
+
+// Pops the innermost scope, reporting anything in it that was never read
+func (l *linter) endScope() {
+
+	scope := l.scopes[len(l.scopes)-1]
+	l.scopes = l.scopes[:len(l.scopes)-1]
+	l.ends = l.ends[:len(l.ends)-1]
+
+	// Lint sorts the diagnostics, so the map's order doesn't matter
+	for _, decl := range scope {
+		if decl.read || strings.HasPrefix(decl.token.lexeme, "_") {
+			continue
+		}
+		switch decl.kind {
+		case "variable", "loop variable":
+			l.report(decl.token, "unused-variable", "%s %s is never used", decl.kind, decl.token.lexeme)
+		case "parameter":
+			l.report(decl.token, "unused-parameter", "parameter %s is never used", decl.token.lexeme)
+		}
+	}
+}
+
+func (l *linter) declare(t Token, kind string) *declaration {
+
+	scope := l.scopes[len(l.scopes)-1]
+	decl := &declaration{token: t, kind: kind, scopeEnd: l.ends[len(l.ends)-1]}
+	l.declarations = append(l.declarations, decl)
+	l.references[t] = decl
+
+	if _, ok := scope[t.lexeme]; ok {
+		// Redeclaring a name replaces it, so calls can't be sure which one they get
+		decl.reassigned = true
+	} else {
+		for n := len(l.scopes) - 2; n >= 0; n-- {
+			if outer, ok := l.scopes[n][t.lexeme]; ok {
+				l.report(t, "shadow", "%s shadows the declaration on line %d", t.lexeme, outer.token.line)
+				break
+			}
+		}
+	}
+
+	scope[t.lexeme] = decl
+	return decl
+}
+
+// Finds the declaration a name refers to, or nil if it isn't declared yet
+func (l *linter) resolve(t Token) *declaration {
+	for n := len(l.scopes) - 1; n >= 0; n-- {
+		if decl, ok := l.scopes[n][t.lexeme]; ok {
+			return decl
+		}
+	}
+	return nil
+}
+
+// Records a read or a write of a name
+func (l *linter) use(t Token, write bool) *declaration {
+	decl := l.resolve(t)
+	l.references[t] = decl
+	switch {
+	case decl == nil:
+		if len(l.functions) > 0 {
+			l.pending = append(l.pending, pendingRef{t, write})
+		}
+	case write:
+		decl.reassigned = true
+	default:
+		decl.read = true
+	}
+	return decl
+}
+
+// Checks calls to functions whose number of parameters is known: ones declared once
+// and never reassigned, and builtins that haven't been replaced
+func (l *linter) checkCalls() {
+	for _, call := range l.calls {
+		var function LoxCallable
+		if call.decl != nil {
+			if call.decl.function == nil || call.decl.reassigned {
+				continue
+			}
+			function = *call.decl.function
+		} else if builtin, ok := builtins[call.callee.lexeme]; ok {
+			function = builtin
+		} else {
+			continue
+		}
+
+		if v, ok := function.(variadic); ok {
+			if min, max := v.arityRange(); call.count < min || call.count > max {
+				l.report(call.callee, "arity", "%s expects %d to %d arguments but is called with %d", call.callee.lexeme, min, max, call.count)
+			}
+		} else if function.arity() != call.count {
+			l.report(call.callee, "arity", "%s expects %s but is called with %d", call.callee.lexeme, plural(function.arity(), "argument"), call.count)
+		}
+	}
+}
+
+func plural(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, noun)
+	}
+	return fmt.Sprintf("%d %ss", count, noun)
+}
+
+// Checks a list of statements, reporting the first one that can't be reached
+func (l *linter) statements(stmts []Stmt) {
+	reported := false
+	for n, stmt := range stmts {
+		if !reported && n > 0 && terminates(stmts[n-1]) {
+			l.report(stmtToken(stmt), "unreachable", "unreachable code")
+			reported = true
+		}
+		l.stmt(stmt)
+	}
+}
+
+func (l *linter) stmt(stmt Stmt) {
+	if stmt != nil {
+		stmt.Accept(l)
+	}
+}
+
+func (l *linter) expr(expr Expr) {
+	if expr != nil {
+		expr.Accept(l)
+	}
+}
+
+// Reports an assignment used directly as a condition
+// Wrapping it in an extra pair of parentheses shows it was meant
+func (l *linter) condition(expr Expr) {
+	switch e := expr.(type) {
+	case Assign:
+		l.report(e.variable.token, "assign-in-condition", "assignment to %s used as a condition, did you mean ==?", e.variable.token.lexeme)
+	case Logical:
+		l.condition(e.left)
+		l.condition(e.right)
+	case Unary:
+		if e.operator.tType == BANG {
+			l.condition(e.right)
+		}
+	}
+}
+
+// Reports whether a statement always returns, or loops forever, so that nothing after
+// it can run
+func terminates(stmt Stmt) bool {
+	switch s := stmt.(type) {
+	case ReturnStmt:
+		return true
+	case BlockStmt:
+		for _, inner := range s.statements {
+			if terminates(inner) {
+				return true
+			}
+		}
+	case IfStmt:
+		return s.elseStmt != nil && terminates(s.branch) && terminates(s.elseStmt)
+	case WhileStmt:
+		// There's no break, so only a return can leave a while (true)
+		literal, ok := s.condition.(Literal)
+		return ok && literal.value == true
+	}
+	return false
+}
+
+// Returns the token a statement is reported at
+func stmtToken(stmt Stmt) Token {
+	switch s := stmt.(type) {
+	case BlockStmt:
+		return s.brace
+	case ExprStmt:
+		return s.start
+	case ForInStmt:
+		return s.names[0]
+	case FuncStmt:
+		return s.name
+	case IfStmt:
+		return s.keyword
+	case PrintStmt:
+		return s.keyword
+	case ReturnStmt:
+		return s.keyword
+	case VarStmt:
+		return s.name
+	case WhileStmt:
+		return s.keyword
+	case YieldStmt:
+		return s.keyword
+	}
+	return Token{}
+}
+
+// Returns the type an expression always has, or "" if it can't be known without
+// running it
+// Ints and floats are both "number", since they can be equal to each other
+func staticType(expr Expr) string {
+	switch e := expr.(type) {
+	case Literal:
+		value := valueOf(e.value)
+		if value.isNumber() {
+			return "number"
+		}
+		return typeName(value)
+	case Grouping:
+		return staticType(e.expression)
+	case Interpolation:
+		return "string"
+	case ListLiteral:
+		return "list"
+	case MapLiteral:
+		return "map"
+	case Unary:
+		if e.operator.tType == BANG {
+			return "bool"
+		}
+	case Binary:
+		switch e.operator.tType {
+		case EQUAL_EQUAL, BANG_EQUAL, LESS, LESS_EQUAL, GREATER, GREATER_EQUAL:
+			return "bool"
+		}
+	}
+	return ""
+}
+
+func (l *linter) visitAssign(e Assign) error {
+	l.expr(e.value)
+	l.use(e.variable.token, true)
+	return nil
+}
+
+func (l *linter) visitBinary(e Binary) error {
+	l.expr(e.left)
+	l.expr(e.right)
+
+	if e.operator.tType == EQUAL_EQUAL || e.operator.tType == BANG_EQUAL {
+		left, right := staticType(e.left), staticType(e.right)
+		if left != "" && right != "" && left != right {
+			result := "false"
+			if e.operator.tType == BANG_EQUAL {
+				result = "true"
+			}
+			l.report(e.operator, "impossible-comparison", "comparing %s with %s using %s is always %s", left, right, e.operator.lexeme, result)
+		}
+	}
+	return nil
+}
+
+func (l *linter) visitCall(e Call) error {
+	l.expr(e.callee)
+	for _, argument := range e.arguments {
+		l.expr(argument)
+	}
+
+	if v, ok := e.callee.(Variable); ok {
+		l.calls = append(l.calls, pendingCall{v.token, len(e.arguments), l.resolve(v.token)})
+	}
+	return nil
+}
+
+func (l *linter) visitConditional(e Conditional) error {
+	l.condition(e.condition)
+	l.expr(e.condition)
+	l.expr(e.thenBranch)
+	l.expr(e.elseBranch)
+	return nil
+}
+
+func (l *linter) visitGrouping(e Grouping) error {
+	l.expr(e.expression)
+	return nil
+}
+
+func (l *linter) visitInterpolation(e Interpolation) error {
+	for _, part := range e.parts {
+		l.expr(part)
+	}
+	return nil
+}
+
+func (l *linter) visitListLiteral(e ListLiteral) error {
+	for _, element := range e.elements {
+		l.expr(element)
+	}
+	return nil
+}
+
+func (l *linter) visitLiteral(e Literal) error {
+	return nil
+}
+
+func (l *linter) visitLogical(e Logical) error {
+	l.expr(e.left)
+	l.expr(e.right)
+	return nil
+}
+
+func (l *linter) visitMapLiteral(e MapLiteral) error {
+	for n := range e.keys {
+		l.expr(e.keys[n])
+		l.expr(e.values[n])
+	}
+	return nil
+}
+
+func (l *linter) visitSpawn(e Spawn) error {
+	return l.visitCall(e.call)
+}
+
+func (l *linter) visitUnary(e Unary) error {
+	l.expr(e.right)
+	return nil
+}
+
+func (l *linter) visitVariable(e Variable) error {
+	l.use(e.token, false)
+	return nil
+}
+
+func (l *linter) visitBlockStmt(s BlockStmt) error {
+	l.beginScope(s.end)
+	l.statements(s.statements)
+	l.endScope()
+	return nil
+}
+
+func (l *linter) visitExprStmt(s ExprStmt) error {
+	l.expr(s.expression)
+	return nil
+}
+
+func (l *linter) visitForInStmt(s ForInStmt) error {
+	l.expr(s.iterable)
+
+	// Each pass of the loop gets a new scope holding the loop variables
+	l.beginScope(s.end)
+	for _, name := range s.names {
+		l.declare(name, "loop variable")
+	}
+	l.stmt(s.body)
+	l.endScope()
+	return nil
+}
+
+func (l *linter) visitFuncStmt(s FuncStmt) error {
+
+	// Declared before the body so the function can call itself
+	decl := l.declare(s.name, "function")
+	decl.function = &s
+	decl.doc = s.doc
+
+	function := &lintFunction{}
+	l.functions = append(l.functions, function)
+
+	// The parameters and the body share a scope, like they do when the function runs
+	l.beginScope(s.end)
+	for _, param := range s.params {
+		l.declare(param, "parameter")
+	}
+	l.statements(s.body)
+	l.endScope()
+
+	l.functions = l.functions[:len(l.functions)-1]
+
+	// Generators hand out values with yield, their returns only end them
+	if function.returnsValue && !s.isGenerator && !terminates(BlockStmt{statements: s.body}) {
+		l.report(s.name, "missing-return", "%s returns a value on some paths but not all of them", s.name.lexeme)
+	}
+	return nil
+}
+
+func (l *linter) visitIfStmt(s IfStmt) error {
+	l.condition(s.condition)
+	l.expr(s.condition)
+	l.stmt(s.branch)
+	l.stmt(s.elseStmt)
+	return nil
+}
+
+func (l *linter) visitPrintStmt(s PrintStmt) error {
+	l.expr(s.expression)
+	return nil
+}
+
+func (l *linter) visitReturnStmt(s ReturnStmt) error {
+	l.expr(s.value)
+	if s.value != nil && len(l.functions) > 0 {
+		l.functions[len(l.functions)-1].returnsValue = true
+	}
+	return nil
+}
+
+func (l *linter) visitVarStmt(s VarStmt) error {
+	// The initializer can't see the variable it initializes
+	l.expr(s.initializer)
+	l.declare(s.name, "variable").doc = s.doc
+	return nil
+}
+
+func (l *linter) visitWhileStmt(s WhileStmt) error {
+	l.condition(s.condition)
+	l.expr(s.condition)
+	l.stmt(s.body)
+	return nil
+}
+
+func (l *linter) visitYieldStmt(s YieldStmt) error {
+	l.expr(s.value)
+	return nil
+}
@@ -7,7 +7,13 @@ import (
 
 type LoxCallable interface {
 	arity() int
-	call(interpreter *Interpreter, arguments []Expr) (Literal, error)
+	call(interpreter *Interpreter, arguments []Value) (Value, error)
+}
+
+// Implemented by callables that accept a range of argument counts
+// instead of exactly arity() arguments
+type variadic interface {
+	arityRange() (min int, max int)
 }
 
 type Clock struct{}
@@ -16,8 +22,13 @@ func (c Clock) arity() int {
 	return 0
 }
 
-func (c Clock) call(interpreter *Interpreter, arguments []Expr) (Literal, error) {
-	return Literal{time.Now().Unix()}, nil
+func (c Clock) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	// Seconds since the epoch, with a fractional part so it can be used for timing
+	return floatValue(float64(time.Now().UnixNano()) / float64(time.Second)), nil
+}
+
+func (c Clock) String() string {
+	return "<native fn>"
 }
 
 type Print struct{}
@@ -26,47 +37,93 @@ func (p Print) arity() int {
 	return 1
 }
 
-func (p Print) call(interpreter *Interpreter, arguments []Expr) (Literal, error) {
+func (p Print) call(interpreter *Interpreter, arguments []Value) (Value, error) {
 	fmt.Println(arguments[0])
-	return Literal{}, nil
+	return Value{}, nil
 }
 
 func (f FuncStmt) arity() int {
 	return len(f.params)
 }
 
-func (f FuncStmt) call(interpreter *Interpreter, arguments []Expr) (Literal, error) {
+func (f FuncStmt) call(interpreter *Interpreter, arguments []Value) (Value, error) {
 
-	// Create new scope for the function
-	interpreter.environment = NewEnvironment(interpreter.environment)
+	// Calling a generator function doesn't run it, instead the body runs as values are asked for
+	if f.isGenerator {
+		return objectValue(NewGenerator(interpreter, f, arguments)), nil
+	}
 
-	// Place all arguments into the scope of the function as variables
-	for i, arg := range arguments {
-		expr, err := interpreter.evaluate(arg)
-		if err != nil {
-			return Literal{}, err
-		}
+	return f.invoke(interpreter, arguments)
+}
 
-		if err := interpreter.environment.Define(Variable{f.params[i]}, expr); err != nil {
-			return Literal{}, err
+// Runs the body of the function with the arguments, then any function it returns a
+// call to, and so on, so a chain of tail calls runs in constant stack space
+func (f FuncStmt) invoke(interpreter *Interpreter, arguments []Value) (Value, error) {
+
+	// Restore the caller's scope however the function exits
+	previous := interpreter.environment
+	defer func() { interpreter.environment = previous }()
+
+	// The debugger, tracer and profiler show each call as nested in its caller,
+	// so tail calls are ordinary calls while they are watching
+	tailCalls := interpreter.tailCalls
+	interpreter.tailCalls = interpreter.debugger == nil && interpreter.tracer == nil && interpreter.profiler == nil
+	defer func() { interpreter.tailCalls = tailCalls }()
+
+	for {
+		result, err := f.run(interpreter, arguments)
+		if call, ok := err.(tailCall); ok {
+			f, arguments = call.function, call.arguments
+			continue
 		}
+		return result, err
+	}
+}
+
+// Runs the body of the function once with the arguments
+func (f FuncStmt) run(interpreter *Interpreter, arguments []Value) (result Value, err error) {
+
+	// Create new scope for the function, enclosed by the scope the function was declared in
+	interpreter.environment = newFrame(f.closure, f.locals)
+
+	if interpreter.debugger != nil {
+		interpreter.debugger.enter(interpreter, f.name.lexeme, interpreter.environment)
+		defer interpreter.debugger.leave(interpreter)
+	}
+
+	// Place all arguments into the scope of the function as variables
+	for i, value := range arguments {
+		interpreter.environment.defineSlot(i, value)
+	}
+
+	if interpreter.tracer != nil {
+		interpreter.tracer.call(interpreter, f.name.lexeme, arguments)
+		defer func() { interpreter.tracer.leave(interpreter, f.name.lexeme, result, err) }()
+	}
+	if interpreter.coverage != nil {
+		interpreter.coverage.call(f.name)
+	}
+	if interpreter.profiler != nil {
+		interpreter.profiler.enter(profileFunction{f.name.lexeme, f.name.line})
+		defer interpreter.profiler.leave()
 	}
 
 	// Execute stmts in the body
 	for _, stmt := range f.body {
-		if err := stmt.Accept(interpreter); err != nil {
+		if err := interpreter.execute(stmt); err != nil {
 			// If the statement is a return (as an error), escape the scope of the func and return the value
 			if r, ok := err.(ReturnValue); ok {
-				interpreter.environment = interpreter.environment.enclosing
-				return r.Literal, nil
+				return r.Value, nil
 
 			}
-			return Literal{}, err
+			return Value{}, err
 		}
 	}
 
-	interpreter.environment = interpreter.environment.enclosing
+	return Value{}, nil
 
-	return Literal{}, nil
+}
 
+func (f FuncStmt) String() string {
+	return "<fn " + f.name.lexeme + ">"
 }
@@ -0,0 +1,576 @@
+package lox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The language server speaks the Language Server Protocol, JSON-RPC messages framed
+// with a Content-Length header, so editors can show Lox errors and navigate Lox code.
+//
+// Documents are synced in full on every change. Each version is scanned, parsed and
+// linted, and the problems are published as diagnostics. Navigation uses the names
+// the linter resolved in the last version that parsed, so it keeps working while an
+// edit is half typed.
+//
+// Positions are converted between LSP's zero based lines and characters and the
+// one based lines and columns of tokens. Columns count runes, which matches the
+// UTF-16 characters LSP counts for everything outside the astral planes.
+
+// JSON-RPC error codes
+const (
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+	lspRequestFailed  = -32803
+)
+
+// LSP symbol kinds
+const (
+	lspSymbolFunction = 12
+	lspSymbolVariable = 13
+)
+
+// LSP completion item kinds
+const (
+	lspCompletionFunction = 3
+	lspCompletionVariable = 6
+	lspCompletionKeyword  = 14
+)
+
+// LSP diagnostic severities
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+)
+
+// A message read from the client, either a request, which has an ID, or a notification
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string {
+	return e.Message
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocument `json:"textDocument"`
+	Position     lspPosition     `json:"position"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail,omitempty"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// An open document
+type lspDocument struct {
+	text string
+	// The statements and resolved names of the last version that parsed
+	stmts    []Stmt
+	analysis *linter
+}
+
+type languageServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]*lspDocument
+}
+
+// ServeLanguageServer answers Language Server Protocol messages read from in, writing
+// the replies to out, until the client sends exit or in ends
+func ServeLanguageServer(in io.Reader, out io.Writer) error {
+
+	// Problems are sent to the client as diagnostics instead
+	output := errorOutput
+	errorOutput = ioutil.Discard
+	defer func() { errorOutput = output }()
+
+	s := &languageServer{in: bufio.NewReader(in), out: out, documents: map[string]*lspDocument{}}
+	for {
+		message, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if message.Method == "exit" {
+			return nil
+		}
+
+		result, err := s.handle(message)
+		// Notifications don't get a reply
+		if message.ID == nil {
+			continue
+		}
+		reply := map[string]interface{}{"jsonrpc": "2.0", "id": message.ID}
+		if err != nil {
+			lerr, ok := err.(*lspError)
+			if !ok {
+				lerr = &lspError{lspRequestFailed, err.Error()}
+			}
+			reply["error"] = lerr
+		} else {
+			reply["result"] = result
+		}
+		if err := s.write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads one message, framed by headers ending in a blank line
+func (s *languageServer) read() (lspMessage, error) {
+
+	var message lspMessage
+	headers, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err != nil {
+		return message, err
+	}
+	length, err := strconv.Atoi(headers.Get("Content-Length"))
+	if err != nil {
+		return message, fmt.Errorf("bad Content-Length header: %v", err)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return message, err
+	}
+	err = json.Unmarshal(body, &message)
+	return message, err
+}
+
+func (s *languageServer) write(message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *languageServer) notify(method string, params interface{}) error {
+	return s.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// Runs the method a message asks for, returning the result to reply with
+func (s *languageServer) handle(message lspMessage) (interface{}, error) {
+
+	// Only the parts of the params each method needs are filled in
+	var params struct {
+		lspPositionParams
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+		Context struct {
+			IncludeDeclaration bool `json:"includeDeclaration"`
+		} `json:"context"`
+		NewName string `json:"newName"`
+	}
+	if len(message.Params) > 0 {
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+	}
+	uri := params.TextDocument.URI
+
+	switch message.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// Full document sync
+				"textDocumentSync":       1,
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]interface{}{},
+				"renameProvider":         true,
+			},
+			"serverInfo": map[string]string{"name": "golox"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		return nil, s.update(uri, params.TextDocument.Text)
+	case "textDocument/didChange":
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		return nil, s.update(uri, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		delete(s.documents, uri)
+		return nil, s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": []lspDiagnostic{}})
+	}
+
+	// Everything else works on an open document
+	doc, ok := s.documents[uri]
+	if !ok {
+		if message.ID == nil {
+			return nil, nil
+		}
+		if strings.HasPrefix(message.Method, "textDocument/") {
+			return nil, &lspError{lspInvalidParams, "document " + uri + " is not open"}
+		}
+		return nil, &lspError{lspMethodNotFound, "method " + message.Method + " is not supported"}
+	}
+
+	switch message.Method {
+	case "textDocument/definition":
+		return doc.definition(uri, params.Position), nil
+	case "textDocument/references":
+		return doc.references(uri, params.Position, params.Context.IncludeDeclaration), nil
+	case "textDocument/hover":
+		return doc.hover(params.Position), nil
+	case "textDocument/documentSymbol":
+		return doc.symbols(), nil
+	case "textDocument/completion":
+		return doc.completion(params.Position), nil
+	case "textDocument/rename":
+		return doc.rename(uri, params.Position, params.NewName)
+	}
+
+	if message.ID == nil {
+		return nil, nil
+	}
+	return nil, &lspError{lspMethodNotFound, "method " + message.Method + " is not supported"}
+}
+
+// Analyzes a new version of a document and publishes its diagnostics
+func (s *languageServer) update(uri, text string) error {
+
+	doc, ok := s.documents[uri]
+	if !ok {
+		doc = &lspDocument{}
+		s.documents[uri] = doc
+	}
+	doc.text = text
+
+	diagnostics := []lspDiagnostic{}
+	stmts, err := parseSource(text)
+	if err != nil {
+		lines := strings.Split(text, "\n")
+		for _, e := range compileErrors {
+			var r lspRange
+			if e.column > 0 {
+				r = tokenRange(e.line, e.column, e.length)
+			} else if e.line-1 < len(lines) {
+				// Only the line is known, so mark all of it
+				r = tokenRange(e.line, 1, len([]rune(lines[e.line-1])))
+			}
+			diagnostics = append(diagnostics, lspDiagnostic{Range: r, Severity: lspSeverityError, Source: "golox", Message: e.message})
+		}
+	} else {
+		doc.stmts = stmts
+		doc.analysis = analyze(stmts, DefaultLintRules())
+		for _, d := range suppress(doc.analysis.diagnostics, text) {
+			diagnostics = append(diagnostics, lspDiagnostic{
+				Range:    tokenRange(d.Line, d.Column, 0),
+				Severity: lspSeverityWarning,
+				Code:     d.Rule,
+				Source:   "golox lint",
+				Message:  d.Message,
+			})
+		}
+		// Findings about a name cover the name
+		for n, d := range diagnostics {
+			if t, ok := doc.tokenAt(d.Range.Start); ok {
+				diagnostics[n].Range = rangeOf(t)
+			}
+		}
+	}
+
+	return s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": diagnostics})
+}
+
+// Returns the range of length characters starting at a one based line and column
+func tokenRange(line, column, length int) lspRange {
+	start := lspPosition{line - 1, column - 1}
+	return lspRange{start, lspPosition{start.Line, start.Character + length}}
+}
+
+func rangeOf(t Token) lspRange {
+	return tokenRange(startLine(t), t.column, len([]rune(t.lexeme)))
+}
+
+// Returns the name at a position, which may be just after its last character
+func (d *lspDocument) tokenAt(p lspPosition) (Token, bool) {
+	if d.analysis == nil {
+		return Token{}, false
+	}
+	for t := range d.analysis.references {
+		if startLine(t)-1 == p.Line && p.Character >= t.column-1 && p.Character <= t.column-1+len([]rune(t.lexeme)) {
+			return t, true
+		}
+	}
+	return Token{}, false
+}
+
+// Returns the declaration of the name at a position, or nil if there isn't one
+func (d *lspDocument) declarationAt(p lspPosition) *declaration {
+	if t, ok := d.tokenAt(p); ok {
+		return d.analysis.references[t]
+	}
+	return nil
+}
+
+// Returns every use of a declaration, in the order they appear
+func (d *lspDocument) uses(decl *declaration, includeDeclaration bool) []Token {
+	var tokens []Token
+	for t, ref := range d.analysis.references {
+		if ref == decl && (includeDeclaration || t != decl.token) {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(a, b int) bool {
+		return tokenBefore(tokens[a], tokens[b])
+	})
+	return tokens
+}
+
+func tokenBefore(a, b Token) bool {
+	return a.line < b.line || a.line == b.line && a.column < b.column
+}
+
+func (d *lspDocument) definition(uri string, p lspPosition) interface{} {
+	decl := d.declarationAt(p)
+	if decl == nil {
+		return nil
+	}
+	return lspLocation{uri, rangeOf(decl.token)}
+}
+
+func (d *lspDocument) references(uri string, p lspPosition, includeDeclaration bool) []lspLocation {
+	locations := []lspLocation{}
+	if decl := d.declarationAt(p); decl != nil {
+		for _, t := range d.uses(decl, includeDeclaration) {
+			locations = append(locations, lspLocation{uri, rangeOf(t)})
+		}
+	}
+	return locations
+}
+
+// Returns how a declaration is written, such as fun add(a, b)
+func signature(decl *declaration) string {
+	if decl.function != nil {
+		var params []string
+		for _, param := range decl.function.params {
+			params = append(params, param.lexeme)
+		}
+		return "fun " + decl.token.lexeme + "(" + strings.Join(params, ", ") + ")"
+	}
+	if decl.kind == "variable" {
+		return "var " + decl.token.lexeme
+	}
+	return decl.kind + " " + decl.token.lexeme
+}
+
+func (d *lspDocument) hover(p lspPosition) interface{} {
+
+	t, ok := d.tokenAt(p)
+	if !ok {
+		return nil
+	}
+
+	var text string
+	if decl := d.analysis.references[t]; decl != nil {
+		text = "```lox\n" + signature(decl) + "\n```"
+		if decl.doc != "" {
+			text += "\n\n" + decl.doc
+		}
+	} else if builtin, ok := builtins[t.lexeme]; ok {
+		text = "```lox\nfun " + t.lexeme + "\n```\n\nBuiltin function taking " + builtinArity(builtin)
+	} else {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": text},
+		"range":    rangeOf(t),
+	}
+}
+
+// Describes how many arguments a builtin takes
+func builtinArity(function LoxCallable) string {
+	if v, ok := function.(variadic); ok {
+		min, max := v.arityRange()
+		return fmt.Sprintf("%d to %d arguments", min, max)
+	}
+	return plural(function.arity(), "argument")
+}
+
+// Lists the functions and variables declared in the document, with the ones
+// declared inside each function as its children
+func (d *lspDocument) symbols() []lspDocumentSymbol {
+	symbols := []lspDocumentSymbol{}
+	for _, stmt := range d.stmts {
+		symbols = append(symbols, documentSymbols(stmt)...)
+	}
+	return symbols
+}
+
+func documentSymbols(stmt Stmt) []lspDocumentSymbol {
+	switch s := stmt.(type) {
+	case FuncStmt:
+		symbol := lspDocumentSymbol{
+			Name:           s.name.lexeme,
+			Detail:         signature(&declaration{token: s.name, function: &s}),
+			Kind:           lspSymbolFunction,
+			Range:          lspRange{rangeOf(s.name).Start, rangeOf(s.end).End},
+			SelectionRange: rangeOf(s.name),
+		}
+		for _, inner := range s.body {
+			symbol.Children = append(symbol.Children, documentSymbols(inner)...)
+		}
+		return []lspDocumentSymbol{symbol}
+	case VarStmt:
+		return []lspDocumentSymbol{{Name: s.name.lexeme, Kind: lspSymbolVariable, Range: rangeOf(s.name), SelectionRange: rangeOf(s.name)}}
+	case BlockStmt:
+		var symbols []lspDocumentSymbol
+		for _, inner := range s.statements {
+			symbols = append(symbols, documentSymbols(inner)...)
+		}
+		return symbols
+	}
+	return nil
+}
+
+// Offers the keywords, the builtins and the names in scope at a position
+func (d *lspDocument) completion(p lspPosition) []lspCompletionItem {
+
+	items := []lspCompletionItem{}
+	seen := map[string]bool{}
+	add := func(item lspCompletionItem) {
+		if !seen[item.Label] {
+			seen[item.Label] = true
+			items = append(items, item)
+		}
+	}
+
+	if d.analysis != nil {
+		at := Token{line: p.Line + 1, column: p.Character + 1}
+		// Innermost declarations first, so they hide the ones they shadow
+		for n := len(d.analysis.declarations) - 1; n >= 0; n-- {
+			decl := d.analysis.declarations[n]
+			global := decl.scopeEnd.line == 0
+			if !global && (tokenBefore(at, decl.token) || tokenBefore(decl.scopeEnd, at)) {
+				continue
+			}
+			kind := lspCompletionVariable
+			if decl.function != nil {
+				kind = lspCompletionFunction
+			}
+			add(lspCompletionItem{Label: decl.token.lexeme, Kind: kind, Detail: signature(decl)})
+		}
+	}
+
+	var names []string
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(lspCompletionItem{Label: name, Kind: lspCompletionFunction, Detail: "builtin"})
+	}
+
+	names = names[:0]
+	for keyword := range keywords {
+		names = append(names, keyword)
+	}
+	sort.Strings(names)
+	for _, keyword := range names {
+		add(lspCompletionItem{Label: keyword, Kind: lspCompletionKeyword})
+	}
+	return items
+}
+
+func (d *lspDocument) rename(uri string, p lspPosition, newName string) (interface{}, error) {
+
+	if !isIdentifier(newName) {
+		return nil, &lspError{lspInvalidParams, fmt.Sprintf("%q is not a valid name", newName)}
+	}
+
+	decl := d.declarationAt(p)
+	if decl == nil {
+		return nil, &lspError{lspRequestFailed, "there is no variable or function to rename here"}
+	}
+
+	edits := []lspTextEdit{}
+	for _, t := range d.uses(decl, true) {
+		edits = append(edits, lspTextEdit{rangeOf(t), newName})
+	}
+	return map[string]interface{}{"changes": map[string][]lspTextEdit{uri: edits}}, nil
+}
+
+// Reports whether name can be used as a variable or function name
+func isIdentifier(name string) bool {
+	if name == "" || isDigit([]rune(name)[0]) {
+		return false
+	}
+	for _, r := range name {
+		if !isAlphaNumeric(r) {
+			return false
+		}
+	}
+	_, keyword := keywords[name]
+	return !keyword
+}
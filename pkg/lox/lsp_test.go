@@ -0,0 +1,255 @@
+package lox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// An LSP client talking to a server running in the same process
+type lspClient struct {
+	t      *testing.T
+	in     *bufio.Reader
+	out    io.WriteCloser
+	nextID int
+	done   chan error
+	// Notifications received while waiting for replies
+	notifications []json.RawMessage
+}
+
+func newLspClient(t *testing.T) *lspClient {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	c := &lspClient{t: t, in: bufio.NewReader(clientIn), out: clientOut, done: make(chan error, 1)}
+	go func() {
+		c.done <- ServeLanguageServer(serverIn, serverOut)
+		serverOut.Close()
+	}()
+	c.call("initialize", map[string]interface{}{}, nil)
+	c.notify("initialized", map[string]interface{}{})
+	return c
+}
+
+func (c *lspClient) send(message map[string]interface{}) {
+	message["jsonrpc"] = "2.0"
+	body, err := json.Marshal(message)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.out, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lspClient) receive() map[string]json.RawMessage {
+	headers, err := textproto.NewReader(c.in).ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	length, _ := strconv.Atoi(headers.Get("Content-Length"))
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.in, body); err != nil {
+		c.t.Fatal(err)
+	}
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		c.t.Fatal(err)
+	}
+	return message
+}
+
+func (c *lspClient) notify(method string, params interface{}) {
+	c.send(map[string]interface{}{"method": method, "params": params})
+}
+
+// Sends a request and decodes the result into result, returning the error the
+// server replied with, if any
+func (c *lspClient) call(method string, params interface{}, result interface{}) *lspError {
+	c.nextID++
+	c.send(map[string]interface{}{"id": c.nextID, "method": method, "params": params})
+	for {
+		message := c.receive()
+		if _, ok := message["id"]; !ok {
+			c.notifications = append(c.notifications, message["params"])
+			continue
+		}
+		if e, ok := message["error"]; ok {
+			var lerr lspError
+			json.Unmarshal(e, &lerr)
+			return &lerr
+		}
+		if result != nil {
+			if err := json.Unmarshal(message["result"], result); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return nil
+	}
+}
+
+// Opens a document and returns the diagnostics published for it
+func (c *lspClient) open(uri, text string) []lspDiagnostic {
+	c.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri, "languageId": "lox", "version": 1, "text": text}})
+	return c.diagnostics()
+}
+
+func (c *lspClient) diagnostics() []lspDiagnostic {
+	var params struct {
+		Diagnostics []lspDiagnostic
+	}
+	if err := json.Unmarshal(c.receive()["params"], &params); err != nil {
+		c.t.Fatal(err)
+	}
+	return params.Diagnostics
+}
+
+func (c *lspClient) close() {
+	if err := c.call("shutdown", nil, nil); err != nil {
+		c.t.Fatal(err)
+	}
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func at(uri string, line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"position":     lspPosition{line, character},
+	}
+}
+
+const lspSource = `/// Adds two numbers
+fun add(a, b) {
+  return a + b;
+}
+
+var total = add(1, 2);
+{
+  var inner = total;
+  print inner;
+}
+print add(total, 3);
+`
+
+func TestLspDiagnostics(t *testing.T) {
+	c := newLspClient(t)
+	defer c.close()
+
+	diagnostics := c.open("file:///bad.lox", "var a = 1;\nprint (a;\n")
+	want := []lspDiagnostic{{Range: lspRange{lspPosition{1, 8}, lspPosition{1, 9}}, Severity: lspSeverityError, Source: "golox", Message: "Expect ')' after expression."}}
+	if !reflect.DeepEqual(diagnostics, want) {
+		t.Errorf("got %+v, want %+v", diagnostics, want)
+	}
+
+	// Fixing the error leaves a lint warning
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": "file:///bad.lox", "version": 2},
+		"contentChanges": []map[string]string{{"text": "var a = 1;\nvar b = a;\n"}},
+	})
+	diagnostics = c.diagnostics()
+	want = []lspDiagnostic{{Range: lspRange{lspPosition{1, 4}, lspPosition{1, 5}}, Severity: lspSeverityWarning, Code: "unused-variable", Source: "golox lint", Message: "variable b is never used"}}
+	if !reflect.DeepEqual(diagnostics, want) {
+		t.Errorf("got %+v, want %+v", diagnostics, want)
+	}
+}
+
+func TestLspNavigation(t *testing.T) {
+	c := newLspClient(t)
+	defer c.close()
+
+	const uri = "file:///add.lox"
+	if diagnostics := c.open(uri, lspSource); len(diagnostics) != 0 {
+		t.Errorf("unexpected diagnostics %+v", diagnostics)
+	}
+
+	// From the call of add on the last line to its declaration
+	var location lspLocation
+	c.call("textDocument/definition", at(uri, 10, 7), &location)
+	if want := (lspLocation{uri, lspRange{lspPosition{1, 4}, lspPosition{1, 7}}}); location != want {
+		t.Errorf("definition: got %+v, want %+v", location, want)
+	}
+
+	params := at(uri, 5, 5)
+	params["context"] = map[string]bool{"includeDeclaration": true}
+	var locations []lspLocation
+	c.call("textDocument/references", params, &locations)
+	var lines []int
+	for _, l := range locations {
+		lines = append(lines, l.Range.Start.Line)
+	}
+	if want := []int{5, 7, 10}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("references: got lines %v, want %v", lines, want)
+	}
+
+	var hover struct {
+		Contents struct{ Value string }
+	}
+	c.call("textDocument/hover", at(uri, 5, 13), &hover)
+	if want := "```lox\nfun add(a, b)\n```\n\nAdds two numbers"; hover.Contents.Value != want {
+		t.Errorf("hover: got %q, want %q", hover.Contents.Value, want)
+	}
+
+	var symbols []lspDocumentSymbol
+	c.call("textDocument/documentSymbol", at(uri, 0, 0), &symbols)
+	var names []string
+	for _, s := range symbols {
+		names = append(names, s.Name)
+	}
+	if want := []string{"add", "total", "inner"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("symbols: got %v, want %v", names, want)
+	}
+
+	var rename struct {
+		Changes map[string][]lspTextEdit
+	}
+	params = at(uri, 2, 9)
+	params["newName"] = "x"
+	if err := c.call("textDocument/rename", params, &rename); err != nil {
+		t.Fatal(err)
+	}
+	if edits := rename.Changes[uri]; len(edits) != 2 || edits[0].Range.Start != (lspPosition{1, 8}) || edits[1].Range.Start != (lspPosition{2, 9}) {
+		t.Errorf("rename: got %+v", edits)
+	}
+	params["newName"] = "var"
+	if err := c.call("textDocument/rename", params, nil); err == nil || err.Code != lspInvalidParams {
+		t.Errorf("rename to a keyword: got error %v, want invalid params", err)
+	}
+}
+
+func TestLspCompletion(t *testing.T) {
+	c := newLspClient(t)
+	defer c.close()
+
+	const uri = "file:///add.lox"
+	c.open(uri, lspSource)
+
+	labels := func(line, character int) map[string]bool {
+		var items []lspCompletionItem
+		c.call("textDocument/completion", at(uri, line, character), &items)
+		found := map[string]bool{}
+		for _, item := range items {
+			found[item.Label] = true
+		}
+		return found
+	}
+
+	inside := labels(8, 2)
+	for _, name := range []string{"inner", "total", "add", "len", "while"} {
+		if !inside[name] {
+			t.Errorf("%s not offered inside the block", name)
+		}
+	}
+	if inside["a"] {
+		t.Error("parameter a offered outside its function")
+	}
+	if outside := labels(10, 0); outside["inner"] {
+		t.Error("inner offered outside its block")
+	}
+}
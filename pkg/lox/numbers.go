@@ -0,0 +1,354 @@
+package lox
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Numbers in Lox are either integers or floats
+// Integers are stored as an int64, and fall back to a *big.Int when a value does not fit
+// Floats are stored as a float64
+//
+// Promotion rules for arithmetic and comparisons:
+//   - int and int gives an int. If the result overflows an int64 it becomes a *big.Int,
+//     and a *big.Int result that fits back into an int64 is turned back into one
+//   - Division between two ints truncates towards zero, and % takes the sign of the left side
+//   - If either side is a float, both sides are converted to float64 and the result is a float
+
+var errDivisionByZero = errors.New("division by zero")
+
+// Largest shift allowed on integers, and about the most bits ** can raise an integer
+// to, to avoid building enormous *big.Ints by accident
+const maxShift = 1 << 16
+
+// Converts the literal of a NUMBER token into an int64, *big.Int or float64
+// Supports 0x hex and 0b binary prefixes for integers, and _ between digits
+func parseNumber(text string) (interface{}, error) {
+
+	// Underscores are only there for readability
+	text = strings.ReplaceAll(text, "_", "")
+
+	// Work out the base from the prefix
+	base := 10
+	digits := text
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		base = 16
+		digits = text[2:]
+	} else if strings.HasPrefix(text, "0b") || strings.HasPrefix(text, "0B") {
+		base = 2
+		digits = text[2:]
+	} else if strings.Contains(text, ".") {
+		// Only decimal numbers can have a fractional part
+		return strconv.ParseFloat(text, 64)
+	}
+
+	// Try the fast int64 path first
+	if i, err := strconv.ParseInt(digits, base, 64); err == nil {
+		return i, nil
+	}
+
+	// The value is too big for an int64, so store it with arbitrary precision
+	if b, ok := new(big.Int).SetString(digits, base); ok {
+		return b, nil
+	}
+
+	return nil, errors.New("invalid number literal " + text)
+}
+
+// Converts an integer value into a *big.Int
+func toBig(v Value) *big.Int {
+	switch v.kind {
+	case intKind:
+		return big.NewInt(v.int())
+	case bigKind:
+		return v.big()
+	}
+	return new(big.Int)
+}
+
+// Converts any number into a float64
+func toFloat(v Value) float64 {
+	switch v.kind {
+	case intKind:
+		return float64(v.int())
+	case bigKind:
+		f, _ := new(big.Float).SetInt(v.big()).Float64()
+		return f
+	case floatKind:
+		return v.float()
+	}
+	return 0
+}
+
+// Returns an int64 if the *big.Int fits in one, otherwise the *big.Int itself
+func normalizeBig(b *big.Int) Value {
+	if b.IsInt64() {
+		return intValue(b.Int64())
+	}
+	return Value{kind: bigKind, object: b}
+}
+
+// Applies one of + - * / % to two numbers following the promotion rules
+func arithmetic(op TokenType, left, right Value) (Value, error) {
+
+	// If either side is a float, the whole operation is done on floats
+	if !left.isInteger() || !right.isInteger() {
+		l, r := toFloat(left), toFloat(right)
+		switch op {
+		case PLUS:
+			return floatValue(l + r), nil
+		case MINUS:
+			return floatValue(l - r), nil
+		case STAR:
+			return floatValue(l * r), nil
+		case SLASH:
+			return floatValue(l / r), nil
+		case PERCENT:
+			return floatValue(math.Mod(l, r)), nil
+		}
+		return Value{}, errors.New("unsupported numeric operator")
+	}
+
+	// Both sides are int64s, so try to stay on the fast path
+	if left.kind == intKind && right.kind == intKind {
+		l, r := left.int(), right.int()
+		if result, ok := intArithmetic(op, l, r); ok {
+			return intValue(result), nil
+		}
+		if (op == SLASH || op == PERCENT) && r == 0 {
+			return Value{}, errDivisionByZero
+		}
+	}
+
+	// Either a side is already a *big.Int or the int64 result overflowed
+	l, r := toBig(left), toBig(right)
+	result := new(big.Int)
+	switch op {
+	case PLUS:
+		result.Add(l, r)
+	case MINUS:
+		result.Sub(l, r)
+	case STAR:
+		result.Mul(l, r)
+	case SLASH:
+		if r.Sign() == 0 {
+			return Value{}, errDivisionByZero
+		}
+		// Quo truncates towards zero, the same as int64 division
+		result.Quo(l, r)
+	case PERCENT:
+		if r.Sign() == 0 {
+			return Value{}, errDivisionByZero
+		}
+		result.Rem(l, r)
+	default:
+		return Value{}, errors.New("unsupported numeric operator")
+	}
+
+	return normalizeBig(result), nil
+}
+
+// Applies an operator to two int64s
+// Returns false if the result does not fit in an int64 or cannot be computed
+func intArithmetic(op TokenType, l, r int64) (int64, bool) {
+	switch op {
+	case PLUS:
+		result := l + r
+		return result, (result > l) == (r > 0)
+	case MINUS:
+		result := l - r
+		return result, (result < l) == (r > 0)
+	case STAR:
+		if l == 0 || r == 0 {
+			return 0, true
+		}
+		result := l * r
+		if result/r != l || (l == -1 && r == math.MinInt64) || (r == -1 && l == math.MinInt64) {
+			return 0, false
+		}
+		return result, true
+	case SLASH:
+		if r == 0 || (l == math.MinInt64 && r == -1) {
+			return 0, false
+		}
+		return l / r, true
+	case PERCENT:
+		if r == 0 {
+			return 0, false
+		}
+		return l % r, true
+	}
+	return 0, false
+}
+
+// Raises left to the power of right
+// An int raised to a non-negative int stays an int, anything else is done with floats
+func power(left, right Value) (Value, error) {
+
+	if left.isInteger() && right.isInteger() && toBig(right).Sign() >= 0 {
+		base, exponent := toBig(left), toBig(right)
+
+		// The result has about (bits in the base - 1) * exponent bits, and 0, 1 and -1
+		// stay small whatever the exponent
+		if bits := int64(base.BitLen() - 1); bits > 0 {
+			if !exponent.IsInt64() || exponent.Int64() > maxShift/bits {
+				return Value{}, errors.New("exponent too large")
+			}
+		}
+		return normalizeBig(new(big.Int).Exp(base, exponent, nil)), nil
+	}
+
+	return floatValue(math.Pow(toFloat(left), toFloat(right))), nil
+}
+
+// Applies one of & | ^ << >> to two integers
+// Callers must check both sides are integers first
+func bitwise(op TokenType, left, right Value) (Value, error) {
+
+	// Stay on the fast path when both sides are int64s
+	if left.kind == intKind && right.kind == intKind {
+		l, r := left.int(), right.int()
+		switch op {
+		case AMPERSAND:
+			return intValue(l & r), nil
+		case PIPE:
+			return intValue(l | r), nil
+		case CARET:
+			return intValue(l ^ r), nil
+		case GREATER_GREATER:
+			if r >= 0 && r < 64 {
+				return intValue(l >> uint(r)), nil
+			}
+		case LESS_LESS:
+			// Only shift as an int64 if no bits can be lost
+			if r >= 0 && r < 63 && l >= 0 && l < (1<<(62-uint(r))) {
+				return intValue(l << uint(r)), nil
+			}
+		}
+	}
+
+	bl, br := toBig(left), toBig(right)
+	result := new(big.Int)
+	switch op {
+	case AMPERSAND:
+		result.And(bl, br)
+	case PIPE:
+		result.Or(bl, br)
+	case CARET:
+		result.Xor(bl, br)
+	case LESS_LESS, GREATER_GREATER:
+		if br.Sign() < 0 {
+			return Value{}, errors.New("negative shift count")
+		}
+		if !br.IsInt64() || br.Int64() > maxShift {
+			return Value{}, errors.New("shift count too large")
+		}
+		if op == LESS_LESS {
+			result.Lsh(bl, uint(br.Int64()))
+		} else {
+			// Rsh rounds towards negative infinity, the same as >> on an int64
+			result.Rsh(bl, uint(br.Int64()))
+		}
+	default:
+		return Value{}, errors.New("unsupported bitwise operator")
+	}
+
+	return normalizeBig(result), nil
+}
+
+// Returns the bitwise complement of an integer, which is -n - 1
+func complement(v Value) Value {
+	if v.kind == intKind {
+		return intValue(^v.int())
+	}
+	return normalizeBig(new(big.Int).Not(toBig(v)))
+}
+
+// Negates a number, promoting to a *big.Int if needed
+func negate(v Value) Value {
+	switch v.kind {
+	case intKind:
+		if v.int() == math.MinInt64 {
+			return normalizeBig(new(big.Int).Neg(big.NewInt(v.int())))
+		}
+		return intValue(-v.int())
+	case bigKind:
+		return normalizeBig(new(big.Int).Neg(v.big()))
+	case floatKind:
+		return floatValue(-v.float())
+	}
+	return Value{}
+}
+
+// Applies one of > >= < <= to two numbers
+// Integers are compared exactly, anything involving a float is compared as float64s
+func compareNumbers(op TokenType, left, right Value) bool {
+
+	if left.isInteger() && right.isInteger() {
+		var cmp int
+		if left.kind == intKind && right.kind == intKind {
+			l, r := left.int(), right.int()
+			if l < r {
+				cmp = -1
+			} else if l > r {
+				cmp = 1
+			}
+		} else {
+			cmp = toBig(left).Cmp(toBig(right))
+		}
+
+		switch op {
+		case GREATER:
+			return cmp > 0
+		case GREATER_EQUAL:
+			return cmp >= 0
+		case LESS:
+			return cmp < 0
+		case LESS_EQUAL:
+			return cmp <= 0
+		}
+		return false
+	}
+
+	// Comparing directly keeps NaN unordered
+	l, r := toFloat(left), toFloat(right)
+	switch op {
+	case GREATER:
+		return l > r
+	case GREATER_EQUAL:
+		return l >= r
+	case LESS:
+		return l < r
+	case LESS_EQUAL:
+		return l <= r
+	}
+	return false
+}
+
+// Checks two numbers for equality, so 1 == 1.0
+func numbersEqual(left, right Value) bool {
+	if left.kind == intKind && right.kind == intKind {
+		return left.int() == right.int()
+	}
+	if left.isInteger() && right.isInteger() {
+		return toBig(left).Cmp(toBig(right)) == 0
+	}
+	return toFloat(left) == toFloat(right)
+}
+
+// Formats a number for printing
+// Floats with no fractional part are printed without a decimal point
+func formatNumber(v Value) string {
+	switch v.kind {
+	case intKind:
+		return strconv.FormatInt(v.int(), 10)
+	case bigKind:
+		return v.big().String()
+	case floatKind:
+		return strconv.FormatFloat(v.float(), 'f', -1, 64)
+	}
+	return ""
+}
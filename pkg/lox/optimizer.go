@@ -0,0 +1,356 @@
+package lox
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// The optimizer rewrites a program into one that does less work when it runs but
+// prints the same things and fails with the same errors:
+//   - Operators whose operands are constants are worked out ahead of time, so
+//     60 * 60 * 24 becomes 86400 and "a" + "b" becomes "ab"
+//   - and, or, ?? and ?: with a constant on the left only keep the side that runs
+//   - if and while statements with a constant condition keep only the branch that
+//     runs, or go away
+//   - Statements after a return in the same block are dropped
+//   - !!x becomes x where only its truthiness matters, or where x is a bool anyway
+//
+// Constants are worked out by the interpreter itself, so the results are exactly
+// what running would give. An operator that would fail, like 1 / 0, is left for
+// the program to fail on when it gets there, with its usual error.
+
+// Rewrites syntax trees, keeping the result of each visit in a scratch field like
+// the interpreter does
+type optimizer struct {
+	// The expression a visited expression becomes
+	expr Expr
+	// The statement a visited statement becomes, or nil if it goes away
+	stmt Stmt
+	// Works out constant expressions
+	scratch *Interpreter
+}
+
+// RunOptimized runs the source like Run, optimizing it first
+// Returns ErrCompile if the source had errors, or the error that stopped the program
+func RunOptimized(source string, out io.Writer) error {
+	stmts, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+	return NewInterpreter(out).Interpret(optimize(stmts))
+}
+
+// Returns an optimized copy of the statements
+func optimize(stmts []Stmt) []Stmt {
+	o := &optimizer{scratch: NewInterpreter(ioutil.Discard)}
+	return o.statements(stmts)
+}
+
+func (o *optimizer) expression(expr Expr) Expr {
+	if expr == nil {
+		return nil
+	}
+	expr.Accept(o)
+	return o.expr
+}
+
+// Optimizes a list of statements, leaving out ones that go away and anything after
+// a return
+func (o *optimizer) statements(stmts []Stmt) []Stmt {
+	var result []Stmt
+	for _, stmt := range stmts {
+		stmt.Accept(o)
+		if o.stmt == nil {
+			continue
+		}
+		result = append(result, o.stmt)
+		if _, ok := o.stmt.(ReturnStmt); ok {
+			break
+		}
+	}
+	return result
+}
+
+// Optimizes a statement that has to stay, such as a loop body, putting an empty
+// block in its place if it goes away
+func (o *optimizer) body(stmt Stmt) Stmt {
+	stmt.Accept(o)
+	if o.stmt == nil {
+		return BlockStmt{brace: stmtToken(stmt), end: stmtToken(stmt)}
+	}
+	return o.stmt
+}
+
+// Optimizes an expression whose value is only used for its truthiness, such as the
+// condition of an if, where !!x is the same as x
+func (o *optimizer) condition(expr Expr) Expr {
+	expr = o.expression(expr)
+	for {
+		outer, ok := expr.(Unary)
+		if !ok || outer.operator.tType != BANG {
+			return expr
+		}
+		inner, ok := outer.right.(Unary)
+		if !ok || inner.operator.tType != BANG {
+			return expr
+		}
+		expr = inner.right
+	}
+}
+
+// Works out an expression whose operands are all constants
+// Returns the expression as it is if working it out fails, so the program fails
+// the same way when it runs
+func (o *optimizer) fold(expr Expr) Expr {
+	value, err := o.scratch.evaluate(expr)
+	if err != nil {
+		return expr
+	}
+	return Literal{value.unwrap()}
+}
+
+func isConstant(expr Expr) bool {
+	_, ok := expr.(Literal)
+	return ok
+}
+
+// Reports whether an expression always gives a bool
+func isBoolean(expr Expr) bool {
+	switch e := expr.(type) {
+	case Literal:
+		_, ok := e.value.(bool)
+		return ok
+	case Unary:
+		return e.operator.tType == BANG
+	case Binary:
+		switch e.operator.tType {
+		case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL, BANG_EQUAL, EQUAL_EQUAL:
+			return true
+		}
+	}
+	return false
+}
+
+func (o *optimizer) visitAssign(a Assign) error {
+	a.value = o.expression(a.value)
+	o.expr = a
+	return nil
+}
+
+func (o *optimizer) visitBinary(b Binary) error {
+	b.left, b.right = o.expression(b.left), o.expression(b.right)
+	o.expr = b
+	if isConstant(b.left) && isConstant(b.right) {
+		o.expr = o.fold(b)
+	}
+	return nil
+}
+
+func (o *optimizer) visitCall(c Call) error {
+	c.callee = o.expression(c.callee)
+	c.arguments = o.expressions(c.arguments)
+	o.expr = c
+	return nil
+}
+
+func (o *optimizer) expressions(exprs []Expr) []Expr {
+	var result []Expr
+	for _, expr := range exprs {
+		result = append(result, o.expression(expr))
+	}
+	return result
+}
+
+// Only the branch the condition picks is kept if the condition is constant
+func (o *optimizer) visitConditional(c Conditional) error {
+	c.condition = o.condition(c.condition)
+	if condition, ok := c.condition.(Literal); ok {
+		if valueOf(condition.value).truthy() {
+			o.expr = o.expression(c.thenBranch)
+		} else {
+			o.expr = o.expression(c.elseBranch)
+		}
+		return nil
+	}
+	c.thenBranch, c.elseBranch = o.expression(c.thenBranch), o.expression(c.elseBranch)
+	o.expr = c
+	return nil
+}
+
+// The parentheses have already shaped the tree, so only what's inside is needed
+func (o *optimizer) visitGrouping(g Grouping) error {
+	o.expr = o.expression(g.expression)
+	return nil
+}
+
+func (o *optimizer) visitInterpolation(in Interpolation) error {
+	in.parts = o.expressions(in.parts)
+	o.expr = in
+	for _, part := range in.parts {
+		if !isConstant(part) {
+			return nil
+		}
+	}
+	o.expr = o.fold(in)
+	return nil
+}
+
+func (o *optimizer) visitListLiteral(l ListLiteral) error {
+	l.elements = o.expressions(l.elements)
+	o.expr = l
+	return nil
+}
+
+func (o *optimizer) visitLiteral(l Literal) error {
+	o.expr = l
+	return nil
+}
+
+// With a constant on the left, either the left is the result or the right is
+func (o *optimizer) visitLogical(l Logical) error {
+
+	l.left, l.right = o.expression(l.left), o.expression(l.right)
+	o.expr = l
+
+	left, ok := l.left.(Literal)
+	if !ok {
+		return nil
+	}
+	var leftIsResult bool
+	switch l.operator.tType {
+	case QUESTION_QUESTION:
+		leftIsResult = left.value != nil
+	case OR:
+		leftIsResult = valueOf(left.value).truthy()
+	case AND:
+		leftIsResult = !valueOf(left.value).truthy()
+	}
+	if leftIsResult {
+		o.expr = left
+	} else {
+		o.expr = l.right
+	}
+	return nil
+}
+
+func (o *optimizer) visitMapLiteral(m MapLiteral) error {
+	m.keys, m.values = o.expressions(m.keys), o.expressions(m.values)
+	o.expr = m
+	return nil
+}
+
+func (o *optimizer) visitSpawn(s Spawn) error {
+	s.call.callee = o.expression(s.call.callee)
+	s.call.arguments = o.expressions(s.call.arguments)
+	o.expr = s
+	return nil
+}
+
+func (o *optimizer) visitUnary(u Unary) error {
+
+	// Only the truthiness of the operand of ! matters
+	if u.operator.tType == BANG {
+		u.right = o.condition(u.right)
+		// !!x is x when x is a bool anyway
+		if inner, ok := u.right.(Unary); ok && inner.operator.tType == BANG && isBoolean(inner.right) {
+			o.expr = inner.right
+			return nil
+		}
+	} else {
+		u.right = o.expression(u.right)
+	}
+
+	o.expr = u
+	if isConstant(u.right) {
+		o.expr = o.fold(u)
+	}
+	return nil
+}
+
+func (o *optimizer) visitVariable(v Variable) error {
+	o.expr = v
+	return nil
+}
+
+func (o *optimizer) visitBlockStmt(b BlockStmt) error {
+	b.statements = o.statements(b.statements)
+	o.stmt = b
+	return nil
+}
+
+func (o *optimizer) visitExprStmt(e ExprStmt) error {
+	e.expression = o.expression(e.expression)
+	o.stmt = e
+	return nil
+}
+
+func (o *optimizer) visitForInStmt(f ForInStmt) error {
+	f.iterable = o.expression(f.iterable)
+	f.body = o.body(f.body)
+	o.stmt = f
+	return nil
+}
+
+func (o *optimizer) visitFuncStmt(f FuncStmt) error {
+	f.body = o.statements(f.body)
+	o.stmt = f
+	return nil
+}
+
+// Only the branch the condition picks is kept if the condition is constant
+func (o *optimizer) visitIfStmt(ifStmt IfStmt) error {
+
+	ifStmt.condition = o.condition(ifStmt.condition)
+	if condition, ok := ifStmt.condition.(Literal); ok {
+		o.stmt = nil
+		if valueOf(condition.value).truthy() {
+			ifStmt.branch.Accept(o)
+		} else if ifStmt.elseStmt != nil {
+			ifStmt.elseStmt.Accept(o)
+		}
+		return nil
+	}
+
+	ifStmt.branch = o.body(ifStmt.branch)
+	if ifStmt.elseStmt != nil {
+		ifStmt.elseStmt = o.body(ifStmt.elseStmt)
+	}
+	o.stmt = ifStmt
+	return nil
+}
+
+func (o *optimizer) visitPrintStmt(p PrintStmt) error {
+	p.expression = o.expression(p.expression)
+	o.stmt = p
+	return nil
+}
+
+func (o *optimizer) visitReturnStmt(r ReturnStmt) error {
+	r.value = o.expression(r.value)
+	o.stmt = r
+	return nil
+}
+
+func (o *optimizer) visitVarStmt(v VarStmt) error {
+	v.initializer = o.expression(v.initializer)
+	o.stmt = v
+	return nil
+}
+
+// A loop whose condition is false from the start never runs
+func (o *optimizer) visitWhileStmt(w WhileStmt) error {
+	w.condition = o.condition(w.condition)
+	if condition, ok := w.condition.(Literal); ok && !valueOf(condition.value).truthy() {
+		o.stmt = nil
+		return nil
+	}
+	w.body = o.body(w.body)
+	o.stmt = w
+	return nil
+}
+
+func (o *optimizer) visitYieldStmt(y YieldStmt) error {
+	y.value = o.expression(y.value)
+	o.stmt = y
+	return nil
+}
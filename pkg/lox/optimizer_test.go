@@ -0,0 +1,93 @@
+package lox
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"print 60 * 60 * 24;", "(print 86400)"},
+		{`print "a" + "b" + x;`, `(print (+ "ab" x))`},
+		{"print (1 + 2) * x;", "(print (* 3 x))"},
+		{"print 1 < 2 and !false;", "(print true)"},
+		{"print false or x;", "(print x)"},
+		{"print nil ?? x;", "(print x)"},
+		{"print 1 > 2 ? x : y;", "(print y)"},
+		{`print "n = ${1 + 1}";`, `(print "n = 2")`},
+		{"print !!x;", "(print (! (! x)))"},
+		{"print !!(x < 1);", "(print (< x 1))"},
+		{"print !!!x;", "(print (! x))"},
+		{"if (!!x) print 1;", "(if x (print 1))"},
+		{"print 1 / 0;", "(print (/ 1 0))"},
+		{"print -\"a\";", `(print (- "a"))`},
+		{"if (false) print 1; else print 2;", "(print 2)"},
+		{"if (true) print 1;", "(print 1)"},
+		{"if (nil) print 1;", ""},
+		{"while (false) print 1;", ""},
+		{"fun f() { return 1; print 2; }", "(fun f () (return 1))"},
+		{"fun f() { { print 1; return; print 2; } }", "(fun f () (block (print 1) (return)))"},
+	}
+
+	for _, test := range tests {
+		stmts, err := parseSource(test.source)
+		if err != nil {
+			t.Fatalf("%s: %v", test.source, err)
+		}
+		var printed []string
+		for _, stmt := range optimize(stmts) {
+			printed = append(printed, (&AstPrinter{}).printStmt(stmt))
+		}
+		if got := strings.Join(printed, "\n"); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.source, test.want, got)
+		}
+	}
+}
+
+// Optimized programs have to do exactly what they did before
+func TestOptimizeTestdata(t *testing.T) {
+
+	deterministicTasks = true
+	defer func() { deterministicTasks = false }()
+	errorOutput = &bytes.Buffer{}
+	defer func() { errorOutput = os.Stderr }()
+
+	err := filepath.WalkDir("testdata", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".lox" {
+			return err
+		}
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var plain, optimized bytes.Buffer
+		plainErr := Run(string(source), &plain)
+		optimizedErr := RunOptimized(string(source), &optimized)
+		if plain.String() != optimized.String() {
+			t.Errorf("%s: expected the output\n%s\ngot\n%s", path, plain.String(), optimized.String())
+		}
+		if errorText(plainErr) != errorText(optimizedErr) {
+			t.Errorf("%s: expected the error %q, got %q", path, errorText(plainErr), errorText(optimizedErr))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
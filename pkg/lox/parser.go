@@ -2,7 +2,6 @@ package lox
 
 import (
 	"fmt"
-	"strconv"
 )
 
 type Parser struct {
@@ -10,6 +9,8 @@ type Parser struct {
 	current    int
 	statements []Stmt
 	hadError   bool
+	// One entry per function being parsed, set to true if the function contains a yield
+	generators []bool
 }
 
 // Main parsing loop
@@ -26,18 +27,34 @@ func (p *Parser) parse() ([]Stmt, error) {
 		p.statements = append(p.statements, stmt)
 	}
 
+	resolve(p.statements)
 	return p.statements, nil
 }
 
 func (p *Parser) declaration() (Stmt, error) {
 
+	// Any /// doc comment above a declaration is attached to its keyword by the scanner
+	doc := p.peek().doc
+
 	// If there's a function declaration, handle it
 	if p.match(FUN) {
-		return p.function("function")
+		stmt, err := p.function("function")
+		if err != nil {
+			return nil, err
+		}
+		f := stmt.(FuncStmt)
+		f.doc = doc
+		return f, nil
 	}
 	// If there's a variable declaration, handle it
 	if p.match(VAR) {
-		return p.varDeclaration()
+		stmt, err := p.varDeclaration()
+		if err != nil {
+			return nil, err
+		}
+		v := stmt.(VarStmt)
+		v.doc = doc
+		return v, nil
 	}
 	// Otherwise, handle the section as a statement
 	return p.statement()
@@ -82,12 +99,17 @@ func (p *Parser) function(kind string) (Stmt, error) {
 		return nil, err
 	}
 
+	// Track whether the body yields, which makes the function a generator
+	p.generators = append(p.generators, false)
 	body, err := p.block()
+	isGenerator := p.generators[len(p.generators)-1]
+	p.generators = p.generators[:len(p.generators)-1]
 	if err != nil {
 		return nil, err
 	}
+	end, _ := p.previous()
 
-	return FuncStmt{name: name, params: args, body: body}, nil
+	return FuncStmt{name: name, params: args, body: body, end: end, isGenerator: isGenerator, binding: &binding{}, locals: &locals{}}, nil
 }
 
 func (p *Parser) varDeclaration() (Stmt, error) {
@@ -113,7 +135,7 @@ func (p *Parser) varDeclaration() (Stmt, error) {
 
 	// Return as a Var Statement so the interpreter knows to
 	// track the variable with the value
-	return VarStmt{name: token, initializer: initalizer}, nil
+	return VarStmt{name: token, initializer: initalizer, binding: &binding{}}, nil
 }
 
 func (p *Parser) statement() (Stmt, error) {
@@ -138,19 +160,26 @@ func (p *Parser) statement() (Stmt, error) {
 		return p.returnStatement()
 	}
 
+	// If there's a yield statement, handle it
+	if p.match(YIELD) {
+		return p.yieldStatement()
+	}
+
 	// If there's a while statement, handle it
 	if p.match(WHILE) {
 		return p.whileStatement()
 	}
 	// If theres a {, build a BlockStmt with all the statements before }
 	if p.match(LEFT_BRACE) {
+		brace, _ := p.previous()
 		// Build the statement list by calling block()
 		stmts, err := p.block()
 		if err != nil {
 			return nil, err
 		}
+		end, _ := p.previous()
 		// Build the BlockStmt statment and return
-		return BlockStmt{statements: stmts}, nil
+		return BlockStmt{brace: brace, end: end, statements: stmts, locals: &locals{}}, nil
 	}
 
 	// Otherwise, handle the generic expression case
@@ -183,12 +212,20 @@ func (p *Parser) block() ([]Stmt, error) {
 
 func (p *Parser) forStatement() (Stmt, error) {
 
+	// The desugared statements are positioned at the for
+	keyword, _ := p.previous()
+
 	var err error
 	// Ensure there is a left parent after a "for"
 	if _, err = p.consume(LEFT_PAREN, "Expect ( after a for"); err != nil {
 		return nil, err
 	}
 
+	// Check for a for-in loop, i.e. "for (x in list)" or "for (k, v in map)"
+	if p.check(IDENTIFIER) && (p.checkNext(IN) || p.checkNext(COMMA)) {
+		return p.forInStatement()
+	}
+
 	// Example
 	// for (var i = 0; i < 5; i = i + 1)
 
@@ -225,6 +262,7 @@ func (p *Parser) forStatement() (Stmt, error) {
 
 	// Get the increment, i.e "i = i + 1" from the example
 	var increment Expr
+	incrementStart := p.peek()
 	if p.peek().tType != RIGHT_PAREN {
 		increment, err = p.expression()
 		if err != nil {
@@ -242,10 +280,11 @@ func (p *Parser) forStatement() (Stmt, error) {
 	if err != nil {
 		return nil, err
 	}
+	end, _ := p.previous()
 
 	// Create a new block with the body statement and the increment if there is one
 	if increment != nil {
-		body = BlockStmt{[]Stmt{body, ExprStmt{expression: increment}}}
+		body = BlockStmt{brace: keyword, end: end, statements: []Stmt{body, ExprStmt{start: incrementStart, expression: increment}}, locals: &locals{}}
 	}
 
 	// If there's no condition, default to true
@@ -255,19 +294,65 @@ func (p *Parser) forStatement() (Stmt, error) {
 
 	// Create a while statement with the condition and the body
 	// This is part of desugaring the for loop into a while loop
-	body = WhileStmt{condition: condition, body: body}
+	body = WhileStmt{keyword: keyword, condition: condition, body: body}
 
 	// If there's an initializer, build a block where that statement is executed before the
 	// while loop
 	if initializer != nil {
-		body = BlockStmt{[]Stmt{initializer, body}}
+		body = BlockStmt{brace: keyword, end: end, statements: []Stmt{initializer, body}, locals: &locals{}}
 	}
 
 	return body, nil
 }
 
+func (p *Parser) forInStatement() (Stmt, error) {
+
+	// Get the loop variables, the opening paren has already been consumed
+	var names []Token
+	for {
+		name, err := p.consume(IDENTIFIER, "Expect loop variable name")
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+
+		if !p.match(COMMA) {
+			break
+		}
+	}
+
+	if len(names) > 2 {
+		return nil, parseError(names[2], "Expect at most two loop variables")
+	}
+
+	keyword, err := p.consume(IN, "Expect in after loop variables")
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the value being looped over
+	iterable, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.consume(RIGHT_PAREN, "Expect ) after for-in clause"); err != nil {
+		return nil, err
+	}
+
+	body, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	end, _ := p.previous()
+
+	return ForInStmt{names: names, keyword: keyword, iterable: iterable, body: body, end: end, locals: &locals{}}, nil
+}
+
 func (p *Parser) ifStatement() (Stmt, error) {
 
+	keyword, _ := p.previous()
+
 	// Ensure there is a left paren after an "if"
 	if _, err := p.consume(LEFT_PAREN, "Expect ( after an if"); err != nil {
 		return nil, err
@@ -300,10 +385,13 @@ func (p *Parser) ifStatement() (Stmt, error) {
 	}
 
 	// Return an IfStatement with the condition, the expression and the else if there is one
-	return IfStmt{condition: condition, branch: thenStmt, elseStmt: elseStmt}, nil
+	return IfStmt{keyword: keyword, condition: condition, branch: thenStmt, elseStmt: elseStmt}, nil
 }
 
 func (p *Parser) printStatement() (Stmt, error) {
+
+	keyword, _ := p.previous()
+
 	// Expand the following espression to Pr out
 	value, err := p.expression()
 	if err != nil {
@@ -317,7 +405,7 @@ func (p *Parser) printStatement() (Stmt, error) {
 	}
 
 	// Return as a print statement so the interpreter knows to print
-	return PrintStmt{expression: value}, nil
+	return PrintStmt{keyword: keyword, expression: value}, nil
 }
 
 func (p *Parser) returnStatement() (Stmt, error) {
@@ -326,6 +414,12 @@ func (p *Parser) returnStatement() (Stmt, error) {
 	if !ok {
 		return nil, fmt.Errorf("Unexpected error")
 	}
+
+	// There's nothing to return from outside of a function
+	if len(p.generators) == 0 {
+		return nil, parseError(keyword, "Can't return from top-level code")
+	}
+
 	var value Expr
 	var err error
 	if !p.check(SEMICOLON) {
@@ -343,7 +437,36 @@ func (p *Parser) returnStatement() (Stmt, error) {
 	return ReturnStmt{keyword: keyword, value: value}, nil
 }
 
+func (p *Parser) yieldStatement() (Stmt, error) {
+
+	keyword, _ := p.previous()
+
+	// Yielding only makes sense inside a function, which becomes a generator
+	if len(p.generators) == 0 {
+		return nil, parseError(keyword, "Can't yield outside of a function")
+	}
+	p.generators[len(p.generators)-1] = true
+
+	// The value is optional, a bare yield produces nil
+	var value Expr
+	var err error
+	if !p.check(SEMICOLON) {
+		value, err = p.expression()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := p.consume(SEMICOLON, "Expect ; after yield value"); err != nil {
+		return nil, err
+	}
+
+	return YieldStmt{keyword: keyword, value: value}, nil
+}
+
 func (p *Parser) expressionStatement() (Stmt, error) {
+	start := p.peek()
+
 	// Expand the expression
 	value, err := p.expression()
 	if err != nil {
@@ -357,11 +480,13 @@ func (p *Parser) expressionStatement() (Stmt, error) {
 	}
 
 	// Return as a generic Expression
-	return ExprStmt{expression: value}, nil
+	return ExprStmt{start: start, expression: value}, nil
 }
 
 func (p *Parser) whileStatement() (Stmt, error) {
 
+	keyword, _ := p.previous()
+
 	// Ensure there is a left paren after a "while"
 	_, err := p.consume(LEFT_PAREN, "Expect ( after while")
 	if err != nil {
@@ -386,7 +511,7 @@ func (p *Parser) whileStatement() (Stmt, error) {
 	}
 
 	// Return a While statement with the condition and stmt body
-	return WhileStmt{condition: condition, body: body}, nil
+	return WhileStmt{keyword: keyword, condition: condition, body: body}, nil
 
 }
 
@@ -395,16 +520,25 @@ func (p *Parser) expression() (Expr, error) {
 	return p.assignment()
 }
 
+// Maps each compound assignment to the binary operator it applies
+var compoundOperators = map[TokenType]TokenType{
+	PLUS_EQUAL:    PLUS,
+	MINUS_EQUAL:   MINUS,
+	STAR_EQUAL:    STAR,
+	SLASH_EQUAL:   SLASH,
+	PERCENT_EQUAL: PERCENT,
+}
+
 func (p *Parser) assignment() (Expr, error) {
 
 	// Goes down the recursive tree to get the expression
-	expr, err := p.or()
+	expr, err := p.conditional()
 	if err != nil {
 		return nil, err
 	}
 
 	// If there's an assignment happening, handle it
-	if p.match(EQUAL) {
+	if p.match(EQUAL, PLUS_EQUAL, MINUS_EQUAL, STAR_EQUAL, SLASH_EQUAL, PERCENT_EQUAL) {
 		if equals, ok := p.previous(); ok {
 			// Evaluate the value to assign to the variable
 			value, err := p.assignment()
@@ -414,11 +548,17 @@ func (p *Parser) assignment() (Expr, error) {
 
 			// Ensure the left side is a variable that can be assigned
 			if v, ok := expr.(Variable); ok {
+				// Compound assignments are desugared, so "a += 1" becomes "a = a + 1"
+				if operator, ok := compoundOperators[equals.tType]; ok {
+					lexeme := equals.lexeme[:len(equals.lexeme)-1]
+					value = Binary{left: v, operator: Token{tType: operator, lexeme: lexeme, line: equals.line, column: equals.column}, right: value}
+				}
+
 				// Build the variable assignment expression
 				return Assign{variable: v, name: equals, value: value}, nil
 			}
 
-			return nil, fmt.Errorf("error at line %d: invalid assiment target", equals.line)
+			return nil, parseError(equals, "Invalid assignment target")
 		}
 	}
 
@@ -426,6 +566,67 @@ func (p *Parser) assignment() (Expr, error) {
 	return expr, nil
 }
 
+func (p *Parser) conditional() (Expr, error) {
+
+	// Get the condition
+	expr, err := p.coalesce()
+	if err != nil {
+		return nil, err
+	}
+
+	// If there's a ?, this is a ternary "condition ? then : else"
+	if p.match(QUESTION) {
+		question, _ := p.previous()
+
+		// The middle can be any expression, since it's bounded by the ? and :
+		thenBranch, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := p.consume(COLON, "Expect : after then branch of conditional expression"); err != nil {
+			return nil, err
+		}
+
+		// Recursing on the else branch makes the operator right associative
+		// so a ? b : c ? d : e is a ? b : (c ? d : e)
+		elseBranch, err := p.conditional()
+		if err != nil {
+			return nil, err
+		}
+
+		return Conditional{question: question, condition: expr, thenBranch: thenBranch, elseBranch: elseBranch}, nil
+	}
+
+	// Return the singular expression if there's no ?
+	return expr, nil
+}
+
+func (p *Parser) coalesce() (Expr, error) {
+
+	// Get the left expression
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	// If there is a "??", handle it
+	for p.match(QUESTION_QUESTION) {
+		if operator, ok := p.previous(); ok {
+			right, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+
+			// This is a Logical since the right side is only evaluated when needed
+			expr = Logical{left: expr, operator: operator, right: right}
+		}
+	}
+
+	// Return the singular expression if there's no "??"
+	return expr, nil
+}
+
 func (p *Parser) or() (Expr, error) {
 
 	// Get the left expression
@@ -443,8 +644,8 @@ func (p *Parser) or() (Expr, error) {
 				return nil, err
 			}
 
-			// Return a Logical "left or right"
-			return Logical{left: expr, operator: operator, right: right}, nil
+			// Build a Logical "left or right", which may be the left side of another "or"
+			expr = Logical{left: expr, operator: operator, right: right}
 		}
 
 	}
@@ -469,8 +670,8 @@ func (p *Parser) and() (Expr, error) {
 			if err != nil {
 				return nil, err
 			}
-			// Return a Logical "left and right"
-			return Logical{left: expr, operator: operator, right: right}, nil
+			// Build a Logical "left and right", which may be the left side of another "and"
+			expr = Logical{left: expr, operator: operator, right: right}
 		}
 	}
 
@@ -493,7 +694,7 @@ func (p *Parser) equality() (Expr, error) {
 			if err != nil {
 				return nil, err
 			}
-			return Binary{left: expr, operator: operator, right: right}, nil
+			expr = Binary{left: expr, operator: operator, right: right}
 		}
 	}
 
@@ -504,14 +705,53 @@ func (p *Parser) equality() (Expr, error) {
 func (p *Parser) comparison() (Expr, error) {
 
 	//
-	expr, err := p.term()
+	expr, err := p.bitOr()
 	if err != nil {
 		return nil, err
 	}
 
 	for p.match(GREATER, GREATER_EQUAL, LESS, LESS_EQUAL) {
 		if operator, ok := p.previous(); ok {
-			right, err := p.term()
+			right, err := p.bitOr()
+			if err != nil {
+				return nil, err
+			}
+			expr = Binary{left: expr, operator: operator, right: right}
+		}
+	}
+
+	return expr, nil
+}
+
+// Bitwise operators bind tighter than comparisons, in the order | then ^ then & then shifts
+// example: a & 1 == 0 is (a & 1) == 0
+func (p *Parser) bitOr() (Expr, error) {
+	return p.binaryLevel(p.bitXor, PIPE)
+}
+
+func (p *Parser) bitXor() (Expr, error) {
+	return p.binaryLevel(p.bitAnd, CARET)
+}
+
+func (p *Parser) bitAnd() (Expr, error) {
+	return p.binaryLevel(p.shift, AMPERSAND)
+}
+
+func (p *Parser) shift() (Expr, error) {
+	return p.binaryLevel(p.term, LESS_LESS, GREATER_GREATER)
+}
+
+// Parses a left associative chain of binary operators, where each operand is parsed by next
+func (p *Parser) binaryLevel(next func() (Expr, error), operators ...TokenType) (Expr, error) {
+
+	expr, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.match(operators...) {
+		if operator, ok := p.previous(); ok {
+			right, err := next()
 			if err != nil {
 				return nil, err
 			}
@@ -549,7 +789,7 @@ func (p *Parser) factor() (Expr, error) {
 		return nil, err
 	}
 
-	for p.match(SLASH, STAR) {
+	for p.match(SLASH, STAR, PERCENT) {
 		if operator, ok := p.previous(); ok {
 			right, err := p.unary()
 			if err != nil {
@@ -564,7 +804,22 @@ func (p *Parser) factor() (Expr, error) {
 
 func (p *Parser) unary() (Expr, error) {
 
-	if p.match(BANG, MINUS) {
+	// spawn must be followed by a call, which is run as a new task
+	if p.match(SPAWN) {
+		keyword, _ := p.previous()
+		expr, err := p.call()
+		if err != nil {
+			return nil, err
+		}
+
+		call, ok := expr.(Call)
+		if !ok {
+			return nil, parseError(keyword, "Expect a function call after spawn")
+		}
+		return Spawn{keyword: keyword, call: call}, nil
+	}
+
+	if p.match(BANG, MINUS, TILDE) {
 		if operator, ok := p.previous(); ok {
 			right, err := p.unary()
 			if err != nil {
@@ -574,7 +829,30 @@ func (p *Parser) unary() (Expr, error) {
 		}
 	}
 
-	return p.call()
+	return p.exponent()
+}
+
+// Exponents bind tighter than unary operators on the left, so -2 ** 2 is -(2 ** 2)
+// They are right associative, so 2 ** 3 ** 2 is 2 ** (3 ** 2)
+func (p *Parser) exponent() (Expr, error) {
+
+	expr, err := p.call()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.match(STAR_STAR) {
+		if operator, ok := p.previous(); ok {
+			// Parsing the right side as a unary allows 2 ** -1 and handles the associativity
+			right, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return Binary{left: expr, operator: operator, right: right}, nil
+		}
+	}
+
+	return expr, nil
 }
 
 func (p *Parser) call() (Expr, error) {
@@ -634,9 +912,9 @@ func (p *Parser) primary() (Expr, error) {
 	}
 	if p.match(NUMBER) {
 		if token, ok := p.previous(); ok {
-			value, err := strconv.ParseFloat(token.literal, 64)
+			value, err := parseNumber(token.literal)
 			if err != nil {
-				return nil, err
+				return nil, parseError(token, err.Error())
 			}
 			return Literal{value}, nil
 		}
@@ -646,9 +924,12 @@ func (p *Parser) primary() (Expr, error) {
 			return Literal{token.literal}, nil
 		}
 	}
+	if p.match(INTERPOLATION) {
+		return p.interpolation()
+	}
 	if p.match(IDENTIFIER) {
 		if token, ok := p.previous(); ok {
-			return Variable{token}, nil
+			return Variable{token: token, binding: &binding{}}, nil
 		}
 	}
 	if p.match(LEFT_PAREN) {
@@ -662,8 +943,115 @@ func (p *Parser) primary() (Expr, error) {
 
 		return Grouping{expr}, nil
 	}
+	if p.match(LEFT_BRACKET) {
+		return p.listLiteral()
+	}
+	// A { where an expression is expected starts a map, at the start of a statement it's a block
+	if p.match(LEFT_BRACE) {
+		return p.mapLiteral()
+	}
 
-	return nil, fmt.Errorf("error at line %d: unexpected token '%v'", p.peek().line, p.peek().lexeme)
+	return nil, parseError(p.peek(), "Expect expression")
+}
+
+// Builds an Interpolation out of the token sequence the scanner produces for a string
+// containing ${}. The sequence is always
+// INTERPOLATION expr (INTERPOLATION expr)* STRING
+// where the INTERPOLATION tokens hold the text before each ${ and the STRING holds the
+// text after the final }
+func (p *Parser) interpolation() (Expr, error) {
+
+	var parts []Expr
+	for {
+		// Add the text before the ${, skipping empty pieces
+		if token, ok := p.previous(); ok && token.literal != "" {
+			parts = append(parts, Literal{token.literal})
+		}
+
+		// Get the embedded expression
+		expr, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, expr)
+
+		// If there's another ${ in the string, keep going
+		if !p.match(INTERPOLATION) {
+			break
+		}
+	}
+
+	// The rest of the string after the last } is a normal string token
+	end, err := p.consume(STRING, "Expect } after interpolated expression")
+	if err != nil {
+		return nil, err
+	}
+	if end.literal != "" {
+		parts = append(parts, Literal{end.literal})
+	}
+
+	return Interpolation{parts: parts}, nil
+}
+
+func (p *Parser) listLiteral() (Expr, error) {
+
+	bracket, _ := p.previous()
+
+	// Get the comma separated elements, allowing a trailing comma
+	var elements []Expr
+	for !p.check(RIGHT_BRACKET) {
+		element, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+
+		if !p.match(COMMA) {
+			break
+		}
+	}
+
+	if _, err := p.consume(RIGHT_BRACKET, "Expect ] after list elements"); err != nil {
+		return nil, err
+	}
+
+	return ListLiteral{bracket: bracket, elements: elements}, nil
+}
+
+func (p *Parser) mapLiteral() (Expr, error) {
+
+	brace, _ := p.previous()
+
+	// Get the comma separated key: value pairs, allowing a trailing comma
+	var keys, values []Expr
+	for !p.check(RIGHT_BRACE) {
+		key, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := p.consume(COLON, "Expect : after map key"); err != nil {
+			return nil, err
+		}
+
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+		values = append(values, value)
+
+		if !p.match(COMMA) {
+			break
+		}
+	}
+
+	if _, err := p.consume(RIGHT_BRACE, "Expect } after map entries"); err != nil {
+		return nil, err
+	}
+
+	return MapLiteral{brace: brace, keys: keys, values: values}, nil
 }
 
 func (p *Parser) match(tokenType ...TokenType) bool {
@@ -681,7 +1069,7 @@ func (p *Parser) consume(tokenType TokenType, message string) (Token, error) {
 	token := p.peek()
 
 	if token.tType != tokenType {
-		return Token{}, fmt.Errorf(message)
+		return Token{}, parseError(token, message)
 	}
 
 	p.advance()
@@ -705,6 +1093,15 @@ func (p *Parser) check(t TokenType) bool {
 	return p.peek().tType == t
 }
 
+// Checks the type of the token after the next one, without consuming anything
+func (p *Parser) checkNext(t TokenType) bool {
+	if p.isAtEnd() || p.tokens[p.current+1].tType == EOF {
+		return false
+	}
+
+	return p.tokens[p.current+1].tType == t
+}
+
 func (p *Parser) peek() Token {
 	return p.tokens[p.current]
 }
@@ -0,0 +1,493 @@
+package lox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The profiler measures where a program spends its time. It instruments the
+// interpreter rather than sampling it: the interpreter says when each statement
+// starts and when each function is entered and left, and the time between two of
+// those events is charged to the line that was running and the calls that led to it.
+//
+// Times are wall-clock, so a task blocked on a channel is charged for the time it
+// waits. A generator isn't charged while it's waiting at a yield.
+//
+// A profile can be written as a report of the functions and lines, in the pprof
+// format read by go tool pprof, or as folded stacks for flame graph tools, where
+// each frame is a function and the line it was running, such as add:3.
+
+// Formats a profile can be written in
+var profileFormats = []string{"text", "pprof", "folded"}
+
+// A function in the profile, told apart from others with the same name by the line
+// it's declared on
+// The program itself is <script>, declared on line 0
+type profileFunction struct {
+	name string
+	line int
+}
+
+var scriptFunction = profileFunction{"<script>", 0}
+
+// A function that is running and the line it's on
+type profileFrame struct {
+	function profileFunction
+	line     int
+}
+
+// What was measured for one stack of frames
+type stackSample struct {
+	// Outermost frame first
+	frames []profileFrame
+	// Times the innermost function was called, and a statement on the innermost line ran
+	calls, hits int
+	nanos       int64
+}
+
+type functionStats struct {
+	calls int
+	// Time from entering the function to leaving it, and the part of that spent in the
+	// function itself rather than in the functions it calls
+	inclusive, exclusive time.Duration
+}
+
+type lineStats struct {
+	hits int
+	time time.Duration
+}
+
+// What the profiler has measured, shared by the interpreters of a program's tasks and
+// generators
+type profile struct {
+	mu sync.Mutex
+	// The clock, which tests replace to make times predictable
+	now      func() time.Time
+	start    time.Time
+	duration time.Duration
+	// Path of the script and its lines, for the reports
+	path  string
+	lines []string
+
+	samples   map[string]*stackSample
+	functions map[profileFunction]*functionStats
+	lineStats map[int]*lineStats
+}
+
+// Profiles one interpreter
+type profiler struct {
+	profile *profile
+	// Innermost frame last, and when each frame was entered
+	stack   []profileFrame
+	entered []time.Time
+	// When the last event was, the time since which is charged at the next one
+	last time.Time
+	// Frames of each function on the stack, so a recursive function's time is only
+	// counted once
+	active map[profileFunction]int
+}
+
+// RunProfiled runs the source like Run, then writes a profile of where the program
+// spent its time to profile in the format, which is text, pprof or folded
+// The profile is written even if the program fails, which is still reported
+// Path is the script's name in the profile
+// Returns ErrCompile if the source had errors, or the error that stopped the program
+func RunProfiled(source, path string, out, profileOut io.Writer, format string) error {
+
+	if !validProfileFormat(format) {
+		return fmt.Errorf("unknown profile format %q, expected one of %s", format, strings.Join(profileFormats, ", "))
+	}
+
+	stmts, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+
+	p, err := profileRun(stmts, path, source, out, time.Now)
+	if writeErr := p.write(profileOut, format); err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+// Runs the statements, profiling them with the clock
+func profileRun(stmts []Stmt, path, source string, out io.Writer, now func() time.Time) (*profile, error) {
+	p := newProfile(path, source, now)
+	i := NewInterpreter(out)
+	i.profiler = p.profiler()
+	i.profiler.enter(scriptFunction)
+	err := i.Interpret(stmts)
+	i.profiler.leave()
+	p.duration = p.now().Sub(p.start)
+	return p, err
+}
+
+func validProfileFormat(format string) bool {
+	for _, f := range profileFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func newProfile(path, source string, now func() time.Time) *profile {
+	return &profile{
+		now:       now,
+		start:     now(),
+		path:      path,
+		lines:     strings.Split(source, "\n"),
+		samples:   map[string]*stackSample{},
+		functions: map[profileFunction]*functionStats{},
+		lineStats: map[int]*lineStats{},
+	}
+}
+
+// Returns a profiler for a new interpreter, with nothing on its stack
+func (p *profile) profiler() *profiler {
+	return &profiler{profile: p, last: p.now(), active: map[profileFunction]int{}}
+}
+
+// Returns a profiler for another interpreter of the same program, such as a task's
+// Returns nil if the program isn't being profiled
+func (p *profiler) fork() *profiler {
+	if p == nil {
+		return nil
+	}
+	return p.profile.profiler()
+}
+
+// Called before each statement runs
+func (p *profiler) statement(stmt Stmt) {
+
+	// A block isn't a step of its own, the statements in it are
+	if _, ok := stmt.(BlockStmt); ok || len(p.stack) == 0 {
+		return
+	}
+	line := startLine(stmtToken(stmt))
+
+	p.profile.mu.Lock()
+	defer p.profile.mu.Unlock()
+
+	p.charge()
+	p.stack[len(p.stack)-1].line = line
+	p.sample().hits++
+	p.profile.lineStat(line).hits++
+}
+
+// Called when a function starts running
+func (p *profiler) enter(function profileFunction) {
+
+	p.profile.mu.Lock()
+	defer p.profile.mu.Unlock()
+
+	p.charge()
+	p.stack = append(p.stack, profileFrame{function, function.line})
+	p.entered = append(p.entered, p.last)
+	p.active[function]++
+	p.profile.functionStat(function).calls++
+	p.sample().calls++
+}
+
+// Called when a function returns
+func (p *profiler) leave() {
+
+	p.profile.mu.Lock()
+	defer p.profile.mu.Unlock()
+
+	p.charge()
+	top := len(p.stack) - 1
+	function, entered := p.stack[top].function, p.entered[top]
+	p.stack, p.entered = p.stack[:top], p.entered[:top]
+
+	p.active[function]--
+	if p.active[function] == 0 {
+		p.profile.functionStat(function).inclusive += p.last.Sub(entered)
+	}
+}
+
+// Called when a generator stops at a yield, so the time until it resumes isn't charged
+func (p *profiler) suspend() {
+	p.profile.mu.Lock()
+	p.charge()
+	p.profile.mu.Unlock()
+}
+
+// Called when a generator carries on from a yield
+func (p *profiler) resume() {
+	p.last = p.profile.now()
+}
+
+// Charges the time since the last event to the innermost frame and its line
+// Called with the profile's lock held
+func (p *profiler) charge() {
+
+	now := p.profile.now()
+	elapsed := now.Sub(p.last)
+	p.last = now
+	if len(p.stack) == 0 {
+		return
+	}
+
+	top := p.stack[len(p.stack)-1]
+	p.sample().nanos += elapsed.Nanoseconds()
+	p.profile.functionStat(top.function).exclusive += elapsed
+	if top.line > 0 {
+		p.profile.lineStat(top.line).time += elapsed
+	}
+}
+
+// Returns the sample for the stack as it is now, creating it if needed
+// Called with the profile's lock held
+func (p *profiler) sample() *stackSample {
+	key := stackKey(p.stack)
+	s, ok := p.profile.samples[key]
+	if !ok {
+		s = &stackSample{frames: append([]profileFrame(nil), p.stack...)}
+		p.profile.samples[key] = s
+	}
+	return s
+}
+
+// Returns a folded stack, such as <script>:8;add:3, outermost frame first
+func stackKey(frames []profileFrame) string {
+	var b strings.Builder
+	for n, frame := range frames {
+		if n > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(frame.function.name)
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(frame.line))
+	}
+	return b.String()
+}
+
+func (p *profile) functionStat(function profileFunction) *functionStats {
+	s, ok := p.functions[function]
+	if !ok {
+		s = &functionStats{}
+		p.functions[function] = s
+	}
+	return s
+}
+
+func (p *profile) lineStat(line int) *lineStats {
+	s, ok := p.lineStats[line]
+	if !ok {
+		s = &lineStats{}
+		p.lineStats[line] = s
+	}
+	return s
+}
+
+// Returns the folded stacks of the samples, sorted
+func (p *profile) stackKeys() []string {
+	var keys []string
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p *profile) write(out io.Writer, format string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch format {
+	case "pprof":
+		return p.writePprof(out)
+	case "folded":
+		return p.writeFolded(out)
+	}
+	return p.writeReport(out)
+}
+
+// Writes the functions, slowest first, and then each line that ran
+func (p *profile) writeReport(out io.Writer) error {
+
+	var functions []profileFunction
+	for function := range p.functions {
+		functions = append(functions, function)
+	}
+	sort.Slice(functions, func(a, b int) bool {
+		sa, sb := p.functions[functions[a]], p.functions[functions[b]]
+		if sa.exclusive != sb.exclusive {
+			return sa.exclusive > sb.exclusive
+		}
+		return functions[a].line < functions[b].line
+	})
+
+	fmt.Fprintf(out, "%8s %12s %12s  %s\n", "calls", "inclusive", "exclusive", "function")
+	for _, function := range functions {
+		s := p.functions[function]
+		name := function.name
+		if function != scriptFunction {
+			name = fmt.Sprintf("%s (line %d)", function.name, function.line)
+		}
+		fmt.Fprintf(out, "%8d %12s %12s  %s\n", s.calls, s.inclusive, s.exclusive, name)
+	}
+
+	var lines []int
+	for line := range p.lineStats {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+
+	fmt.Fprintf(out, "\n%8s %12s  %s\n", "hits", "time", "line")
+	for _, line := range lines {
+		s := p.lineStats[line]
+		source := ""
+		if line <= len(p.lines) {
+			source = strings.TrimSpace(p.lines[line-1])
+		}
+		fmt.Fprintf(out, "%8d %12s  %4d | %s\n", s.hits, s.time, line, source)
+	}
+	return nil
+}
+
+// Writes a line per stack with the nanoseconds spent in it
+func (p *profile) writeFolded(out io.Writer) error {
+	for _, key := range p.stackKeys() {
+		if nanos := p.samples[key].nanos; nanos > 0 {
+			if _, err := fmt.Fprintf(out, "%s %d\n", key, nanos); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Writes the profile as a gzipped profile.proto message, the format go tool pprof
+// reads, with calls, hits and time for each stack
+func (p *profile) writePprof(out io.Writer) error {
+
+	var b protoBuffer
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) uint64 {
+		n, ok := strs[s]
+		if !ok {
+			n = len(table)
+			strs[s] = n
+			table = append(table, s)
+		}
+		return uint64(n)
+	}
+	valueType := func(kind, unit string) []byte {
+		var v protoBuffer
+		v.varint(1, str(kind))
+		v.varint(2, str(unit))
+		return v.Bytes()
+	}
+
+	b.message(1, valueType("calls", "count"))
+	b.message(1, valueType("hits", "count"))
+	b.message(1, valueType("time", "nanoseconds"))
+
+	// Functions and locations are numbered from 1 in the order they're first seen
+	functionIDs := map[profileFunction]uint64{}
+	locationIDs := map[profileFrame]uint64{}
+	var functions, locations protoBuffer
+	for _, key := range p.stackKeys() {
+		s := p.samples[key]
+		var ids []uint64
+		for n := len(s.frames) - 1; n >= 0; n-- {
+			frame := s.frames[n]
+			function, ok := functionIDs[frame.function]
+			if !ok {
+				function = uint64(len(functionIDs) + 1)
+				functionIDs[frame.function] = function
+				var f protoBuffer
+				// pprof drops anything in angle brackets from names, so <script> is script
+				name := strings.Trim(frame.function.name, "<>")
+				f.varint(1, function)
+				f.varint(2, str(name))
+				f.varint(3, str(name))
+				f.varint(4, str(p.path))
+				f.varint(5, uint64(frame.function.line))
+				functions.message(5, f.Bytes())
+			}
+			location, ok := locationIDs[frame]
+			if !ok {
+				location = uint64(len(locationIDs) + 1)
+				locationIDs[frame] = location
+				var line, l protoBuffer
+				line.varint(1, function)
+				line.varint(2, uint64(frame.line))
+				l.varint(1, location)
+				l.message(4, line.Bytes())
+				locations.message(4, l.Bytes())
+			}
+			ids = append(ids, location)
+		}
+
+		var sample protoBuffer
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{uint64(s.calls), uint64(s.hits), uint64(s.nanos)})
+		b.message(2, sample.Bytes())
+	}
+	b.Write(locations.Bytes())
+	b.Write(functions.Bytes())
+
+	b.varint(9, uint64(p.start.UnixNano()))
+	b.varint(10, uint64(p.duration.Nanoseconds()))
+	b.message(11, valueType("time", "nanoseconds"))
+	b.varint(12, 1)
+	// The string table is added last, once every string has been seen
+	for _, s := range table {
+		b.message(6, []byte(s))
+	}
+
+	zw := gzip.NewWriter(out)
+	if _, err := zw.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Builds a protocol buffer message, for the few field types profiles use
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) uvarint(v uint64) {
+	for v >= 0x80 {
+		b.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	b.WriteByte(byte(v))
+}
+
+// Adds a varint field, leaving it out if it's zero
+func (b *protoBuffer) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.uvarint(uint64(field)<<3 | 0)
+	b.uvarint(v)
+}
+
+// Adds a length-delimited field, such as a string or an embedded message
+func (b *protoBuffer) message(field int, data []byte) {
+	b.uvarint(uint64(field)<<3 | 2)
+	b.uvarint(uint64(len(data)))
+	b.Write(data)
+}
+
+// Adds a repeated varint field in packed form
+func (b *protoBuffer) packed(field int, values []uint64) {
+	var p protoBuffer
+	for _, v := range values {
+		p.uvarint(v)
+	}
+	b.message(field, p.Bytes())
+}
@@ -0,0 +1,136 @@
+package lox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Profiles the source with a clock that moves on a millisecond each time it's read
+func testProfile(t *testing.T, source string) *profile {
+	stmts, err := parseSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Unix(0, 0)
+	now := func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+	p, err := profileRun(stmts, "test.lox", source, ioutil.Discard, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+const profileSource = `fun square(n) {
+  return n * n;
+}
+var total = 0;
+for (var i = 0; i < 3; i = i + 1) {
+  total = total + square(i);
+}
+`
+
+func TestProfile(t *testing.T) {
+
+	p := testProfile(t, profileSource)
+
+	square := p.functions[profileFunction{"square", 1}]
+	if square == nil || square.calls != 3 {
+		t.Fatalf("expected square to be called 3 times, got %+v", square)
+	}
+	if square.inclusive != square.exclusive || square.exclusive <= 0 {
+		t.Errorf("expected square to spend all its time in itself, got %+v", square)
+	}
+	script := p.functions[scriptFunction]
+	if script.inclusive > p.duration || script.exclusive+square.exclusive != script.inclusive {
+		t.Errorf("expected the script's time to add up, got %+v and %v in all", script, p.duration)
+	}
+
+	for line, hits := range map[int]int{2: 3, 4: 1, 5: 5, 6: 3} {
+		if s := p.lineStats[line]; s == nil || s.hits != hits {
+			t.Errorf("expected %d hits on line %d, got %+v", hits, line, s)
+		}
+	}
+
+	var folded bytes.Buffer
+	if err := p.write(&folded, "folded"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(folded.String(), "\n<script>:6;square:2 ") {
+		t.Errorf("expected a folded stack for the body of square, got\n%s", folded.String())
+	}
+
+	var report bytes.Buffer
+	if err := p.write(&report, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "square (line 1)") || !strings.Contains(report.String(), "   6 | total = total + square(i);") {
+		t.Errorf("expected the report to list functions and lines, got\n%s", report.String())
+	}
+}
+
+func TestProfilePprof(t *testing.T) {
+
+	var out bytes.Buffer
+	if err := testProfile(t, profileSource).write(&out, "pprof"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Walk the top level fields of the message, collecting the string table
+	var strs []string
+	for len(data) > 0 {
+		key, n := protoVarint(data)
+		data = data[n:]
+		if key&7 == 0 {
+			_, n = protoVarint(data)
+			data = data[n:]
+			continue
+		}
+		if key&7 != 2 {
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		length, n := protoVarint(data)
+		if key>>3 == 6 {
+			strs = append(strs, string(data[n:n+int(length)]))
+		}
+		data = data[n+int(length):]
+	}
+
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("expected the string table to start with an empty string, got %q", strs)
+	}
+	for _, want := range []string{"square", "script", "test.lox", "nanoseconds"} {
+		found := false
+		for _, s := range strs {
+			found = found || s == want
+		}
+		if !found {
+			t.Errorf("expected %q in the string table %q", want, strs)
+		}
+	}
+}
+
+func protoVarint(data []byte) (uint64, int) {
+	var v uint64
+	for n, b := range data {
+		v |= uint64(b&0x7f) << (7 * uint(n))
+		if b < 0x80 {
+			return v, n + 1
+		}
+	}
+	return v, len(data)
+}
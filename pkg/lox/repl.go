@@ -0,0 +1,358 @@
+package lox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Repl is an interactive session
+// Everything entered runs on the same interpreter, so variables and functions
+// defined by one entry can be used by the next
+type Repl struct {
+	interpreter *Interpreter
+	reader      lineReader
+	history     *history
+	out         io.Writer
+}
+
+// Returns a REPL reading from in and writing to out
+// When in is a terminal, lines can be edited, the history is saved between
+// sessions and tab completes names
+func NewRepl(in *os.File, out io.Writer) *Repl {
+	r := &Repl{interpreter: newSession(out), out: out}
+
+	if isTerminal(int(in.Fd())) {
+		r.history = loadHistory(historyPath())
+		r.reader = newEditor(int(in.Fd()), in, out, r.history, r.completions)
+	} else {
+		// Input piped in isn't worth remembering
+		r.history = &history{}
+		r.reader = &plainReader{in: bufio.NewReader(in), out: out}
+	}
+
+	return r
+}
+
+// Returns an interpreter for a REPL session, which keeps its generators open between
+// entries so a later entry can resume them
+func newSession(out io.Writer) *Interpreter {
+	i := NewInterpreter(out)
+	i.session = true
+	return i
+}
+
+// Reads and runs entries until the input ends
+func (r *Repl) Run() {
+	defer func() { r.interpreter.scheduler.closeGenerators() }()
+
+	for {
+		source, err := r.readEntry()
+		if err == errInterrupted {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(r.out, err)
+			}
+			return
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(source), ":") {
+			if quit := r.command(strings.TrimSpace(source)); quit {
+				return
+			}
+			continue
+		}
+
+		if err := r.eval(source); err != nil && err != ErrCompile {
+			fmt.Fprintln(r.out, err)
+		}
+	}
+}
+
+// Reads lines until they make up a complete entry
+// An entry with unclosed brackets, strings or comments carries on to the next line
+func (r *Repl) readEntry() (string, error) {
+
+	var lines []string
+	prompt := "> "
+	for {
+		line, err := r.reader.readLine(prompt)
+		if err != nil {
+			return "", err
+		}
+		r.history.add(line)
+
+		// Commands are always a single line
+		if len(lines) == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			return line, nil
+		}
+
+		lines = append(lines, line)
+		source := strings.Join(lines, "\n")
+		if !incomplete(source) {
+			return source, nil
+		}
+		prompt = "... "
+	}
+}
+
+// Runs an entry on the session's interpreter
+// A bare expression doesn't need a semicolon, and its value is shown
+func (r *Repl) eval(source string) error {
+
+	expr, stmts, err := parseEntry(source)
+	if err != nil {
+		return err
+	}
+
+	if expr != nil {
+		return r.echo(expr)
+	}
+	return r.interpreter.Interpret(stmts)
+}
+
+// Scans and parses an entry, reporting any errors
+// If the entry is a single expression, with or without a semicolon, it is returned
+// on its own. Otherwise the statements are returned
+func parseEntry(source string) (Expr, []Stmt, error) {
+
+	// Reset the error flag from any previous entry
+	hadErr = false
+
+	s := NewScanner(source)
+	s.scanTokens()
+	if hadErr {
+		return nil, nil, ErrCompile
+	}
+
+	// Try the whole entry as an expression first, so 1 + 2 works without a semicolon
+	p := Parser{tokens: s.tokens}
+	if expr, err := p.expression(); err == nil && p.isAtEnd() {
+		return expr, nil, nil
+	}
+
+	p = Parser{tokens: s.tokens}
+	stmts, err := p.parse()
+	if err != nil {
+		fmt.Fprintln(errorOutput, err)
+		return nil, nil, ErrCompile
+	}
+
+	if len(stmts) == 1 {
+		if stmt, ok := stmts[0].(ExprStmt); ok {
+			return stmt.expression, nil, nil
+		}
+	}
+	return nil, stmts, nil
+}
+
+// Evaluates an expression and shows its value
+// Assignments and nil values aren't shown, they would just be noise
+func (r *Repl) echo(expr Expr) error {
+	value, err := r.interpreter.InterpretExpr(expr)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := expr.(Assign); !ok && value.kind != nilKind {
+		fmt.Fprintln(r.interpreter.out, quoted(value))
+	}
+	return nil
+}
+
+// Reports whether more input could complete the source, because it ends inside
+// brackets, a string or a comment
+func incomplete(source string) bool {
+
+	// Scan quietly, any errors are reported when the entry is run
+	output, err := errorOutput, hadErr
+	errorOutput = ioutil.Discard
+	s := NewScanner(source)
+	s.scanTokens()
+	errorOutput, hadErr = output, err
+
+	if s.unterminated {
+		return true
+	}
+
+	depth := 0
+	for _, token := range s.tokens {
+		switch token.tType {
+		case LEFT_PAREN, LEFT_BRACE, LEFT_BRACKET:
+			depth++
+		case RIGHT_PAREN, RIGHT_BRACE, RIGHT_BRACKET:
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// Returns the keywords and defined names that start with the prefix, sorted
+func (r *Repl) completions(prefix string) []string {
+
+	seen := make(map[string]bool)
+	for keyword := range keywords {
+		seen[keyword] = true
+	}
+	for env := r.interpreter.environment; env != nil; env = env.enclosing {
+		for _, name := range env.names() {
+			seen[name] = true
+		}
+	}
+
+	var matches []string
+	for name := range seen {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// A command that can be entered at the REPL, such as :env
+type replCommand struct {
+	name string
+	// Describes the argument the command takes, if any
+	usage string
+	help  string
+	run   func(r *Repl, argument string) error
+}
+
+// Set up in init, since :help lists the commands
+var replCommands []replCommand
+
+func init() {
+	replCommands = []replCommand{
+		{"help", "", "show this list", (*Repl).help},
+		{"tokens", "<code>", "show the tokens the code scans into", (*Repl).tokens},
+		{"ast", "<code>", "show the syntax tree the code parses into", (*Repl).ast},
+		{"env", "", "show the variables defined in each scope", (*Repl).env},
+		{"load", "<file>", "run a file in this session", (*Repl).load},
+		{"reset", "", "start over with a fresh interpreter", (*Repl).reset},
+		{"time", "<code>", "run the code and show how long it took", (*Repl).timeCode},
+		{"type", "<expr>", "show the type of an expression's value", (*Repl).typeOf},
+		{"quit", "", "end the session", nil},
+	}
+}
+
+// Runs a command like :ast 1 + 2
+// Returns true if the session should end
+func (r *Repl) command(line string) bool {
+
+	name, argument := line[1:], ""
+	if space := strings.IndexAny(name, " \t"); space >= 0 {
+		name, argument = name[:space], strings.TrimSpace(name[space+1:])
+	}
+
+	for _, command := range replCommands {
+		if command.name != name {
+			continue
+		}
+		if command.run == nil {
+			return true
+		}
+		if command.usage != "" && argument == "" {
+			fmt.Fprintf(r.out, "Usage: :%s %s\n", command.name, command.usage)
+			return false
+		}
+		if err := command.run(r, argument); err != nil && err != ErrCompile {
+			fmt.Fprintln(r.out, err)
+		}
+		return false
+	}
+
+	fmt.Fprintf(r.out, "Unknown command :%s, try :help\n", name)
+	return false
+}
+
+func (r *Repl) help(argument string) error {
+	for _, command := range replCommands {
+		fmt.Fprintf(r.out, "  %-18s %s\n", ":"+strings.TrimSpace(command.name+" "+command.usage), command.help)
+	}
+	return nil
+}
+
+func (r *Repl) tokens(code string) error {
+	return WriteTokens(code, r.out)
+}
+
+func (r *Repl) ast(code string) error {
+
+	expr, stmts, err := parseEntry(code)
+	if err != nil {
+		return err
+	}
+
+	printer := &AstPrinter{}
+	if expr != nil {
+		fmt.Fprintln(r.out, printer.print(expr))
+	}
+	for _, stmt := range stmts {
+		fmt.Fprintln(r.out, printer.printStmt(stmt))
+	}
+	return nil
+}
+
+// Shows the variables of each scope, from the innermost out to the globals
+func (r *Repl) env(argument string) error {
+	for env := r.interpreter.environment; env != nil; env = env.enclosing {
+		if env == r.interpreter.globals {
+			fmt.Fprintln(r.out, "globals:")
+		} else {
+			fmt.Fprintln(r.out, "scope:")
+		}
+
+		for _, name := range env.names() {
+			value, _ := env.Get(Variable{token: Token{lexeme: name}})
+			fmt.Fprintf(r.out, "  %s = %s\n", name, quoted(value))
+		}
+	}
+	return nil
+}
+
+func (r *Repl) load(path string) error {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return r.eval(string(source))
+}
+
+func (r *Repl) reset(argument string) error {
+	r.interpreter.scheduler.closeGenerators()
+	r.interpreter = newSession(r.out)
+	return nil
+}
+
+func (r *Repl) timeCode(code string) error {
+	start := time.Now()
+	err := r.eval(code)
+	fmt.Fprintf(r.out, "took %v\n", time.Since(start))
+	return err
+}
+
+func (r *Repl) typeOf(code string) error {
+
+	expr, _, err := parseEntry(code)
+	if err != nil {
+		return err
+	}
+	if expr == nil {
+		return fmt.Errorf(":type needs an expression")
+	}
+
+	value, err := r.interpreter.InterpretExpr(expr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(r.out, typeName(value))
+	return nil
+}
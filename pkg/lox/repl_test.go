@@ -0,0 +1,91 @@
+package lox
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Runs the input through a REPL session and returns what it printed
+func runRepl(input string) string {
+	var out bytes.Buffer
+	r := &Repl{
+		interpreter: newSession(&out),
+		reader:      &plainReader{in: bufio.NewReader(strings.NewReader(input)), out: &out},
+		history:     &history{},
+		out:         &out,
+	}
+	r.Run()
+	return out.String()
+}
+
+func TestReplKeepsState(t *testing.T) {
+	input := "var a = 1;\nfun f(x) { return x + a; }\nf(2)\n"
+	want := "> > > 3\n> "
+	if got := runRepl(input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReplMultiLine(t *testing.T) {
+	input := "if (true) {\n  print \"yes\";\n}\nvar s = \"a\nb\";\ns\n"
+	want := "> ... ... yes\n> ... > \"a\\nb\"\n> "
+	if got := runRepl(input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReplEcho(t *testing.T) {
+	input := "1 + 2;\nvar x;\nx = 4\nx\nnil\n"
+	want := "> 3\n> > > 4\n> > "
+	if got := runRepl(input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReplKeepsGenerators(t *testing.T) {
+	input := "fun nat() { var n = 0; while (true) { yield n; n = n + 1; } }\nvar g = nat();\nnext(g)\nnext(g)\n"
+	want := "> > > 0\n> 1\n> "
+	if got := runRepl(input); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	tests := map[string]bool{
+		"print 1;":           false,
+		"fun f() {":          true,
+		"print (1 +":         true,
+		"var l = [1,":        true,
+		"print \"abc":        true,
+		"/* comment":         true,
+		"print \"${1 + ":     true,
+		"}":                  false,
+		"fun f() { return }": false,
+	}
+	for source, want := range tests {
+		if got := incomplete(source); got != want {
+			t.Errorf("incomplete(%q) = %v, want %v", source, got, want)
+		}
+	}
+}
+
+func TestReplCommands(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{":ast print 1 + 2 * 3;\n", "> (print (+ 1 (* 2 3)))\n> "},
+		{":ast for (k, v in m) print k;\n", "> (for-in (k v) m (print k))\n> "},
+		{":type 1.5\n", "> float\n> "},
+		{"var a = 1;\n:reset\na\n", "> > > error at line 1: undefined variable a\n> "},
+		{":quit\nprint 1;\n", "> "},
+		{":nope\n", "> Unknown command :nope, try :help\n> "},
+	}
+	for _, test := range tests {
+		if got := runRepl(test.input); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
@@ -2,10 +2,30 @@ package lox
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strings"
 )
 
 var hadErr bool = false
 
+// A problem found while scanning or parsing
+type compileError struct {
+	line int
+	// Column of the token the problem is at, or 0 if only the line is known
+	column int
+	// Length of the token the problem is at
+	length  int
+	message string
+}
+
+// Errors reported since parseSource last started, for tools that show them
+// somewhere other than errorOutput
+var compileErrors []compileError
+
+// Where errors found while scanning and parsing are written
+var errorOutput io.Writer = os.Stderr
+
 func errorReport(line int, message string) {
 
 	report(line, "", message)
@@ -13,42 +33,54 @@ func errorReport(line int, message string) {
 
 func report(line int, where, message string) {
 
-	fmt.Printf("[line %d] Error %s: %s", line, where, message)
+	fmt.Fprintf(errorOutput, "[line %d] Error%s: %s", line, where, message)
 	hadErr = true
+	compileErrors = append(compileErrors, compileError{line: line, message: strings.TrimSpace(message)})
 }
 
 func errorToken(t Token, message string) {
-	if t.tType == EOF {
-		report(t.line, " at end", message)
-	} else {
-		report(t.line, "at '"+t.lexeme+"'", message)
-	}
+	report(t.line, errorLocation(t), message)
 }
 
-// Test AST Printer to test the Visitor pattern
-type AstPrinter struct{}
-
-func (a AstPrinter) VisitBinary(b Binary) error {
-	fmt.Printf("(%s %v %v)", b.operator.lexeme, b.left, b.right)
+// An error for a problem with a token found while parsing
+type tokenError struct {
+	token   Token
+	message string
+}
 
-	return nil
+// Uses the same format as report()
+func (e tokenError) Error() string {
+	return fmt.Sprintf("[line %d] Error%s: %s", e.token.line, errorLocation(e.token), e.message)
 }
 
-func (a AstPrinter) VisitGrouping(g Grouping) error {
-	fmt.Printf("(group %v)", g.expression)
+// Builds an error for a problem with a token found while parsing
+func parseError(t Token, message string) error {
+	return tokenError{t, message}
+}
 
-	return nil
+// An error that stopped a running program, with the line it happened on
+type runtimeError struct {
+	line int
+	err  error
 }
 
-func (a AstPrinter) VisitLiteral(l Literal) error {
-	str := fmt.Sprintf("%v", l.value)
-	fmt.Printf("(%v\n)", str)
+// Builds a runtime error on a line, formatting the message like fmt.Errorf
+func runtimeErrorf(line int, format string, a ...interface{}) error {
+	return &runtimeError{line: line, err: fmt.Errorf(format, a...)}
+}
 
-	return nil
+func (e *runtimeError) Error() string {
+	return fmt.Sprintf("error at line %d: %v", e.line, e.err)
 }
 
-func (a AstPrinter) VisitUnary(u Unary) error {
-	fmt.Printf("(%s %v)", u.operator.lexeme, u.right)
+func (e *runtimeError) Unwrap() error {
+	return e.err
+}
 
-	return nil
+// Describes where in the source an error with a token happened
+func errorLocation(t Token) string {
+	if t.tType == EOF {
+		return " at end"
+	}
+	return " at '" + t.lexeme + "'"
 }
@@ -0,0 +1,295 @@
+package lox
+
+// The resolver works out where each variable lives before the program runs, so
+// the interpreter can find it without searching for its name.
+//
+// Blocks, function calls and the iterations of for-in loops each run in a frame
+// whose variables are kept in numbered slots, in the order they're declared. A
+// variable inside one of them is found by how many frames out it was declared and
+// its slot there. Variables declared at the top level, and names that aren't
+// declared anywhere the use can see, such as builtins, are global and looked up by
+// name when they're used, since the script or the next line of the REPL can
+// define them later.
+//
+// Like the scopes the interpreter used to search, a use sees the declarations
+// above it in its own block and in the blocks around it. A function body also sees
+// the functions declared further down the blocks around it, since by the time it's
+// called they may have been declared, as with local functions calling each other.
+
+// Where a variable lives, filled in by the resolver
+// The zero value is a global, looked up by name from the current environment
+type binding struct {
+	// Whether the variable is in a slot of a frame rather than global
+	local bool
+	// How many frames out from the current one the variable's frame is, or for a
+	// global, how many frames out the top level is
+	depth int
+	// The index of the variable in its frame
+	slot int
+}
+
+// The variables declared in a block, function or for-in loop, in slot order
+// Every frame of the same scope shares them, for its size and for the debugger
+// to name its slots
+type locals struct {
+	names []string
+}
+
+// A scope being resolved
+type resolverScope struct {
+	locals *locals
+	// The slot of each name declared so far, the last one for a name declared twice
+	slots map[string]int
+	// The slots set aside for the functions declared in the scope, which the bodies
+	// of functions in it can see before the declarations are reached
+	functions map[string]int
+	// Whether the scope is a function's body
+	body bool
+}
+
+// Walks syntax trees filling in the bindings of variables and the locals of scopes
+type resolver struct {
+	// The scopes around the code being resolved, innermost last
+	// Empty at the top level
+	scopes []*resolverScope
+}
+
+// Fills in where the variables of a program live
+func resolve(stmts []Stmt) {
+	r := &resolver{}
+	r.statements(stmts)
+}
+
+func (r *resolver) statements(stmts []Stmt) {
+	for _, stmt := range stmts {
+		stmt.Accept(r)
+	}
+}
+
+func (r *resolver) expression(expr Expr) {
+	if expr != nil {
+		expr.Accept(r)
+	}
+}
+
+func (r *resolver) expressions(exprs []Expr) {
+	for _, expr := range exprs {
+		r.expression(expr)
+	}
+}
+
+// Starts a scope whose variables go in the frame described by locals
+func (r *resolver) begin(locals *locals) {
+	locals.names = nil
+	r.scopes = append(r.scopes, &resolverScope{locals: locals, slots: map[string]int{}, functions: map[string]int{}})
+}
+
+// Sets aside slots in the innermost scope for the functions the statements declare
+func (r *resolver) hoist(stmts []Stmt) {
+	scope := r.scopes[len(r.scopes)-1]
+	for _, stmt := range stmts {
+		if f, ok := stmt.(FuncStmt); ok {
+			scope.functions[f.name.lexeme] = len(scope.locals.names)
+			scope.locals.names = append(scope.locals.names, f.name.lexeme)
+		}
+	}
+}
+
+func (r *resolver) end() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+// Declares a variable in the innermost scope, or as a global at the top level
+func (r *resolver) declare(name Token, b *binding) {
+	if len(r.scopes) == 0 {
+		*b = binding{}
+		return
+	}
+	scope := r.scopes[len(r.scopes)-1]
+	slot := len(scope.locals.names)
+	scope.locals.names = append(scope.locals.names, name.lexeme)
+	scope.slots[name.lexeme] = slot
+	*b = binding{local: true, slot: slot}
+}
+
+// Declares a function in the slot set aside for it, if there is one
+func (r *resolver) declareFunction(name Token, b *binding) {
+	if len(r.scopes) > 0 {
+		scope := r.scopes[len(r.scopes)-1]
+		if slot, ok := scope.functions[name.lexeme]; ok {
+			scope.slots[name.lexeme] = slot
+			*b = binding{local: true, slot: slot}
+			return
+		}
+	}
+	r.declare(name, b)
+}
+
+// Finds the innermost declaration of a name that a use can see
+func (r *resolver) lookup(name Token, b *binding) {
+	// Set once the search has left a function body for the scopes around it
+	inFunction := false
+	for depth := 0; depth < len(r.scopes); depth++ {
+		scope := r.scopes[len(r.scopes)-1-depth]
+		if slot, ok := scope.slots[name.lexeme]; ok {
+			*b = binding{local: true, depth: depth, slot: slot}
+			return
+		}
+		if slot, ok := scope.functions[name.lexeme]; ok && inFunction {
+			*b = binding{local: true, depth: depth, slot: slot}
+			return
+		}
+		if scope.body {
+			inFunction = true
+		}
+	}
+	*b = binding{depth: len(r.scopes)}
+}
+
+func (r *resolver) visitAssign(a Assign) error {
+	r.expression(a.value)
+	r.lookup(a.variable.token, a.variable.binding)
+	return nil
+}
+
+func (r *resolver) visitBinary(b Binary) error {
+	r.expression(b.left)
+	r.expression(b.right)
+	return nil
+}
+
+func (r *resolver) visitCall(c Call) error {
+	r.expression(c.callee)
+	r.expressions(c.arguments)
+	return nil
+}
+
+func (r *resolver) visitConditional(c Conditional) error {
+	r.expression(c.condition)
+	r.expression(c.thenBranch)
+	r.expression(c.elseBranch)
+	return nil
+}
+
+func (r *resolver) visitGrouping(g Grouping) error {
+	r.expression(g.expression)
+	return nil
+}
+
+func (r *resolver) visitInterpolation(in Interpolation) error {
+	r.expressions(in.parts)
+	return nil
+}
+
+func (r *resolver) visitListLiteral(l ListLiteral) error {
+	r.expressions(l.elements)
+	return nil
+}
+
+func (r *resolver) visitLiteral(l Literal) error {
+	return nil
+}
+
+func (r *resolver) visitLogical(l Logical) error {
+	r.expression(l.left)
+	r.expression(l.right)
+	return nil
+}
+
+func (r *resolver) visitMapLiteral(m MapLiteral) error {
+	r.expressions(m.keys)
+	r.expressions(m.values)
+	return nil
+}
+
+func (r *resolver) visitSpawn(s Spawn) error {
+	return r.visitCall(s.call)
+}
+
+func (r *resolver) visitUnary(u Unary) error {
+	r.expression(u.right)
+	return nil
+}
+
+func (r *resolver) visitVariable(v Variable) error {
+	r.lookup(v.token, v.binding)
+	return nil
+}
+
+func (r *resolver) visitBlockStmt(b BlockStmt) error {
+	r.begin(b.locals)
+	r.hoist(b.statements)
+	r.statements(b.statements)
+	r.end()
+	return nil
+}
+
+func (r *resolver) visitExprStmt(e ExprStmt) error {
+	r.expression(e.expression)
+	return nil
+}
+
+// The loop variables are the first slots of the frame each iteration runs in
+func (r *resolver) visitForInStmt(f ForInStmt) error {
+	r.expression(f.iterable)
+	r.begin(f.locals)
+	for _, name := range f.names {
+		r.declare(name, &binding{})
+	}
+	f.body.Accept(r)
+	r.end()
+	return nil
+}
+
+// The function is declared before its body is resolved so it can call itself, and
+// the parameters are the first slots of the frame each call runs in
+func (r *resolver) visitFuncStmt(f FuncStmt) error {
+	r.declareFunction(f.name, f.binding)
+	r.begin(f.locals)
+	r.scopes[len(r.scopes)-1].body = true
+	for _, param := range f.params {
+		r.declare(param, &binding{})
+	}
+	r.hoist(f.body)
+	r.statements(f.body)
+	r.end()
+	return nil
+}
+
+func (r *resolver) visitIfStmt(i IfStmt) error {
+	r.expression(i.condition)
+	i.branch.Accept(r)
+	if i.elseStmt != nil {
+		i.elseStmt.Accept(r)
+	}
+	return nil
+}
+
+func (r *resolver) visitPrintStmt(p PrintStmt) error {
+	r.expression(p.expression)
+	return nil
+}
+
+func (r *resolver) visitReturnStmt(rs ReturnStmt) error {
+	r.expression(rs.value)
+	return nil
+}
+
+// The initializer is resolved first, so a variable named in its own initializer
+// is the one from further out
+func (r *resolver) visitVarStmt(v VarStmt) error {
+	r.expression(v.initializer)
+	r.declare(v.name, v.binding)
+	return nil
+}
+
+func (r *resolver) visitWhileStmt(w WhileStmt) error {
+	r.expression(w.condition)
+	w.body.Accept(r)
+	return nil
+}
+
+func (r *resolver) visitYieldStmt(y YieldStmt) error {
+	r.expression(y.value)
+	return nil
+}
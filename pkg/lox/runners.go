@@ -1,65 +1,79 @@
 package lox
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"strings"
 )
 
-// RunFile runs a supplied file
-func RunFile(path string) {
-	fmt.Printf("Running file %s\n", path)
-	out, err := ioutil.ReadFile(path)
+// RunPrompt begins an interactive session, which ends at the end of input (Ctrl-D)
+func RunPrompt() {
+	NewRepl(os.Stdin, os.Stdout).Run()
+}
+
+// ErrCompile is returned when the source could not be scanned or parsed
+// The details have already been written to errorOutput
+var ErrCompile = errors.New("compile error")
+
+// Run scans, parses and interprets the source, writing anything the program prints to out
+// Returns ErrCompile if the source had errors, or the error that stopped the program
+func Run(source string, out io.Writer) error {
+	stmts, err := parseSource(source)
 	if err != nil {
-		fmt.Printf("%n", err)
-		return
+		return err
 	}
-	run(string(out))
+	return NewInterpreter(out).Interpret(stmts)
 }
 
-// RunPrompt begins an interactive session
-func RunPrompt() {
-
-	reader := bufio.NewReader(os.Stdin)
+// Check scans and parses the source without running it
+// Returns ErrCompile if the source had errors
+func Check(source string) error {
+	_, err := parseSource(source)
+	return err
+}
 
-	for {
-		fmt.Print("> ")
-		text, _ := reader.ReadString('\n')
-		if text == "\n" || text == "" {
-			fmt.Println("Recieved blank line, qutting")
-			break
-		}
-		// convert CRLF to LF
-		text = strings.Replace(text, "\n", "", -1)
-		//fmt.Printf("Confiming message: %s\n", text)
-		run(text)
+// WriteTokens writes the tokens the source scans into to out, one per line
+// Returns ErrCompile if the source had errors
+func WriteTokens(source string, out io.Writer) error {
+	hadErr = false
+	s := NewScanner(source)
+	s.scanTokens()
+	for _, token := range s.tokens {
+		fmt.Fprintln(out, token)
 	}
+	if hadErr {
+		return ErrCompile
+	}
+	return nil
 }
 
-func run(source string) {
-	// Create Scanner with the input as a []rune
-	s := Scanner{source: []rune(source)}
+// Scans and parses the source, reporting any errors to errorOutput
+// Returns ErrCompile if there were errors
+func parseSource(source string) ([]Stmt, error) {
+	// Reset the error flag from any previous run
+	hadErr = false
+	compileErrors = nil
+
+	// Create Scanner with the input
+	s := NewScanner(source)
 	// Generate token list
 	s.scanTokens()
 
-	// Iterate through all tokens
-	/*for _, token := range s.tokens {
-		fmt.Printf("TOKEN: %+v\n", token)
-	}*/
-
 	p := Parser{tokens: s.tokens}
-	stms, err := p.parse()
+	stmts, err := p.parse()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(errorOutput, err)
+		hadErr = true
+		if e, ok := err.(tokenError); ok {
+			length := len([]rune(e.token.lexeme))
+			compileErrors = append(compileErrors, compileError{e.token.line, e.token.column, length, e.message})
+		}
 	}
 
-	if !p.hadError {
-		var i Interpreter
-		err = i.Interpret(stms)
-		if err != nil {
-			fmt.Println(err)
-		}
+	// Don't return anything if there were errors in the scanner or parser
+	if hadErr {
+		return nil, ErrCompile
 	}
+	return stmts, nil
 }
@@ -1,11 +1,39 @@
 package lox
 
+import "strings"
+
 type Scanner struct {
 	source  []rune
 	tokens  []Token
 	start   int
 	current int
 	line    int
+	// Index of the first rune of the current line, for working out columns
+	lineStart int
+	// Column of the token being scanned
+	column int
+	// Stack of string interpolations currently being scanned
+	// Used to find the } that closes a ${
+	interpolations []interpolation
+	// Lines of /// doc comments waiting to be attached to the next token
+	docLines []string
+	// Set if the source ended inside a string or comment, so more input could complete it
+	unterminated bool
+	// Set to add comments to the tokens as COMMENT tokens, which the parser doesn't accept
+	keepComments bool
+}
+
+// Tracks a ${ that has not been closed yet
+type interpolation struct {
+	// Number of unclosed { inside the interpolation
+	braces int
+	// Line the ${ is on
+	line int
+}
+
+// Returns a new scanner over the source, starting at line 1
+func NewScanner(source string) *Scanner {
+	return &Scanner{source: []rune(source), line: 1}
 }
 
 func (s *Scanner) scanTokens() {
@@ -13,11 +41,18 @@ func (s *Scanner) scanTokens() {
 	for ok := true; ok; ok = !s.isAtEnd() {
 		// Set start of a new lexeme
 		s.start = s.current
+		s.column = s.current - s.lineStart + 1
 		s.scanToken()
 	}
 
+	// If an interpolation was never closed, the string it started in is not terminated
+	if len(s.interpolations) > 0 {
+		errorReport(s.interpolations[0].line, "Unterminated string interpolation\n")
+		s.unterminated = true
+	}
+
 	// Add EOF to the end of token list
-	s.tokens = append(s.tokens, Token{tType: EOF, lexeme: "", literal: "", line: s.line})
+	s.tokens = append(s.tokens, Token{tType: EOF, lexeme: "", literal: "", line: s.line, column: s.current - s.lineStart + 1})
 }
 
 // Check if all runes have been checked
@@ -36,21 +71,75 @@ func (s *Scanner) scanToken() {
 	case ')':
 		s.addToken(RIGHT_PAREN, "")
 	case '{':
+		// Track nested braces inside an interpolation so the closing } can be found
+		if len(s.interpolations) > 0 {
+			s.interpolations[len(s.interpolations)-1].braces++
+		}
 		s.addToken(LEFT_BRACE, "")
 	case '}':
+		if len(s.interpolations) > 0 {
+			top := len(s.interpolations) - 1
+			// If this brace closes the interpolation, go back to scanning the rest of the string
+			if s.interpolations[top].braces == 0 {
+				s.interpolations = s.interpolations[:top]
+				s.string()
+				break
+			}
+			s.interpolations[top].braces--
+		}
 		s.addToken(RIGHT_BRACE, "")
+	case '[':
+		s.addToken(LEFT_BRACKET, "")
+	case ']':
+		s.addToken(RIGHT_BRACKET, "")
 	case ',':
 		s.addToken(COMMA, "")
 	case '.':
 		s.addToken(DOT, "")
+	case ':':
+		s.addToken(COLON, "")
+	case '?':
+		if s.match('?') {
+			s.addToken(QUESTION_QUESTION, "")
+		} else {
+			s.addToken(QUESTION, "")
+		}
 	case '-':
-		s.addToken(MINUS, "")
+		if s.match('=') {
+			s.addToken(MINUS_EQUAL, "")
+		} else {
+			s.addToken(MINUS, "")
+		}
 	case '+':
-		s.addToken(PLUS, "")
+		if s.match('=') {
+			s.addToken(PLUS_EQUAL, "")
+		} else {
+			s.addToken(PLUS, "")
+		}
 	case ';':
 		s.addToken(SEMICOLON, "")
 	case '*':
-		s.addToken(STAR, "")
+		if s.match('*') {
+			s.addToken(STAR_STAR, "")
+		} else if s.match('=') {
+			s.addToken(STAR_EQUAL, "")
+		} else {
+			s.addToken(STAR, "")
+		}
+	case '%':
+		if s.match('=') {
+			s.addToken(PERCENT_EQUAL, "")
+		} else {
+			s.addToken(PERCENT, "")
+		}
+	case '&':
+		s.addToken(AMPERSAND, "")
+	case '|':
+		s.addToken(PIPE, "")
+	case '^':
+		s.addToken(CARET, "")
+	case '~':
+		s.addToken(TILDE, "")
 	case '!':
 		if s.match('=') {
 			s.addToken(BANG_EQUAL, "")
@@ -66,20 +155,35 @@ func (s *Scanner) scanToken() {
 	case '<':
 		if s.match('=') {
 			s.addToken(LESS_EQUAL, "")
+		} else if s.match('<') {
+			s.addToken(LESS_LESS, "")
 		} else {
 			s.addToken(LESS, "")
 		}
 	case '>':
 		if s.match('=') {
 			s.addToken(GREATER_EQUAL, "")
+		} else if s.match('>') {
+			s.addToken(GREATER_GREATER, "")
 		} else {
 			s.addToken(GREATER, "")
 		}
 	case '/':
 		if s.match('/') {
+			// Three slashes (but not four or more) start a doc comment
+			isDoc := s.peek() == '/' && s.peekNext() != '/'
 			for s.peek() != '\n' && !s.isAtEnd() {
 				s.advance()
 			}
+			if isDoc {
+				s.docComment()
+			}
+			s.addComment()
+		} else if s.match('*') {
+			s.blockComment()
+			s.addComment()
+		} else if s.match('=') {
+			s.addToken(SLASH_EQUAL, "")
 		} else {
 			s.addToken(SLASH, "")
 		}
@@ -90,7 +194,7 @@ func (s *Scanner) scanToken() {
 		break
 	// Increase line count for each newline
 	case '\n':
-		s.line++
+		s.newline()
 	// Handle strings encased in ""
 	case '"':
 		s.string()
@@ -113,7 +217,23 @@ func (s *Scanner) addToken(tokenType TokenType, literal string) {
 	// Get the textual representation of the token
 	text := s.source[s.start:s.current]
 	// Create token with tokentype, string, string literal provided and line number
-	s.tokens = append(s.tokens, Token{tType: tokenType, lexeme: string(text), literal: literal, line: s.line})
+	token := Token{tType: tokenType, lexeme: string(text), literal: literal, line: s.line, column: s.column}
+
+	// Attach any doc comments seen since the last token
+	if len(s.docLines) > 0 {
+		token.doc = strings.Join(s.docLines, "\n")
+		s.docLines = nil
+	}
+
+	s.tokens = append(s.tokens, token)
+}
+
+// Adds the comment just scanned as a token, if the scanner is keeping comments
+// Unlike addToken, this leaves any doc comment for the next real token
+func (s *Scanner) addComment() {
+	if s.keepComments {
+		s.tokens = append(s.tokens, Token{tType: COMMENT, lexeme: string(s.source[s.start:s.current]), line: s.line, column: s.column})
+	}
 }
 
 // Consume the next rune
@@ -124,6 +244,12 @@ func (s *Scanner) advance() rune {
 	return s.source[s.current-1]
 }
 
+// Move on to the next line, after consuming a newline
+func (s *Scanner) newline() {
+	s.line++
+	s.lineStart = s.current
+}
+
 // Check the following rune to see if its expected
 // Used for multi-length tokens like != == <= >=
 func (s *Scanner) match(expected rune) bool {
@@ -162,16 +288,41 @@ func (s *Scanner) peekNext() rune {
 }
 
 // Handle strings encased by ""
+// Strings containing ${expr} are split up: each piece of text before a ${ is added
+// as an INTERPOLATION token, followed by the tokens of the expression. The text after
+// the last interpolation is added as a normal STRING token
 func (s *Scanner) string() {
 
-	// Look for the closing "
+	// Remember where the string started so an unterminated one can be reported there
+	startLine := s.line
+
+	// Look for the closing " or the start of an interpolation
 	for s.peek() != '"' && !s.isAtEnd() {
-		s.advance()
+		if s.peek() == '$' && s.peekNext() == '{' {
+			// Get the text before the interpolation, sans the opening " or }
+			text := string(s.source[s.start+1 : s.current])
+
+			// Consume the ${
+			s.advance()
+			s.advance()
+
+			// Start tracking braces for this interpolation and go back to scanning
+			// regular tokens until the matching } is found
+			s.interpolations = append(s.interpolations, interpolation{line: s.line})
+			s.addToken(INTERPOLATION, text)
+			return
+		}
+
+		// Strings can span multiple lines
+		if s.advance() == '\n' {
+			s.newline()
+		}
 	}
 
 	// If the end is reached, the string is not properly terminated
 	if s.isAtEnd() {
-		errorReport(s.line, "Unterminated string\n")
+		errorReport(startLine, "Unterminated string\n")
+		s.unterminated = true
 		return
 	}
 
@@ -182,26 +333,96 @@ func (s *Scanner) string() {
 	s.addToken(STRING, string(s.source[s.start+1:s.current-1]))
 }
 
+// Handle a /// doc comment that has been scanned to the end of the line
+// The text is kept so the parser can attach it to the declaration that follows
+func (s *Scanner) docComment() {
+
+	// Strip the slashes and a single leading space
+	text := string(s.source[s.start+3 : s.current])
+	text = strings.TrimPrefix(text, " ")
+	text = strings.TrimRight(text, "\r")
+
+	s.docLines = append(s.docLines, text)
+}
+
+// Handle /* */ comments, which may be nested
+func (s *Scanner) blockComment() {
+
+	// The opening /* has already been consumed
+	// Remember where the comment started so an unterminated one can be reported there
+	startLine := s.line
+	depth := 1
+	for depth > 0 {
+		if s.isAtEnd() {
+			errorReport(startLine, "Unterminated block comment\n")
+			s.unterminated = true
+			return
+		}
+
+		if s.peek() == '/' && s.peekNext() == '*' {
+			// Another comment opens inside this one
+			s.advance()
+			s.advance()
+			depth++
+		} else if s.peek() == '*' && s.peekNext() == '/' {
+			// Close the innermost comment
+			s.advance()
+			s.advance()
+			depth--
+		} else {
+			// Comments can span multiple lines
+			if s.advance() == '\n' {
+				s.newline()
+			}
+		}
+	}
+}
+
 // Handle number literals
+// Integers can be written in decimal, hex (0x) or binary (0b), and any number can
+// use _ between digits as a separator
 func (s *Scanner) number() {
 
-	// Keep going until there are no more numbers
-	for isDigit(s.peek()) {
+	// Check for a hex or binary prefix after a leading 0
+	if s.source[s.start] == '0' && (s.peek() == 'x' || s.peek() == 'X') {
 		s.advance()
-	}
-
-	// If there's a dot with numbers following, treat it as a decimal
-	if s.peek() == '.' && isDigit(s.peekNext()) {
-		// Keep going until there are no more numbers
+		s.digits(isHexDigit)
+	} else if s.source[s.start] == '0' && (s.peek() == 'b' || s.peek() == 'B') {
 		s.advance()
-		for isDigit(s.peek()) {
+		s.digits(isBinaryDigit)
+	} else {
+		// The first digit has already been consumed, so keep going until there are no more
+		s.digits(isDigit)
+
+		// If there's a dot with numbers following, treat it as a decimal
+		if s.peek() == '.' && isDigit(s.peekNext()) {
 			s.advance()
+			s.digits(isDigit)
 		}
 	}
 
-	// Add the token with the literal
-	// Not sure when this will get converted to an actual number
-	s.addToken(NUMBER, string(s.source[s.start:s.current]))
+	// A prefix with no digits after it is not a number
+	text := string(s.source[s.start:s.current])
+	if text == "0x" || text == "0X" || text == "0b" || text == "0B" {
+		errorReport(s.line, "Expect digits after number prefix\n")
+		return
+	}
+
+	// Add the token with the literal, the parser converts it into an actual number
+	s.addToken(NUMBER, text)
+}
+
+// Consume digits accepted by isValid, allowing single underscores between them
+func (s *Scanner) digits(isValid func(rune) bool) {
+	for {
+		if isValid(s.peek()) {
+			s.advance()
+		} else if s.peek() == '_' && isValid(s.peekNext()) && isValid(s.source[s.current-1]) {
+			s.advance()
+		} else {
+			return
+		}
+	}
 }
 
 // Handle identifiers
@@ -227,6 +448,14 @@ func isDigit(r rune) bool {
 	return r >= '0' && r <= '9'
 }
 
+func isHexDigit(r rune) bool {
+	return isDigit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+func isBinaryDigit(r rune) bool {
+	return r == '0' || r == '1'
+}
+
 func isAlpha(r rune) bool {
 	return (r >= 'a' && r <= 'z') ||
 		r >= 'A' && r <= 'Z' ||
@@ -8,16 +8,24 @@ type Stmt interface {
 type StmtVisitor interface {
 	visitBlockStmt(BlockStmt) error
 	visitExprStmt(ExprStmt) error
+	visitForInStmt(ForInStmt) error
 	visitFuncStmt(FuncStmt) error
 	visitIfStmt(IfStmt) error
 	visitPrintStmt(PrintStmt) error
 	visitReturnStmt(ReturnStmt) error
 	visitVarStmt(VarStmt) error
 	visitWhileStmt(WhileStmt) error
+	visitYieldStmt(YieldStmt) error
 }
 
 type BlockStmt struct {
+	// The opening brace, or the for of a desugared for loop
+	brace Token
+	// The closing brace, or the last token of a desugared for loop
+	end        Token
 	statements []Stmt
+	// The variables declared in the block, filled in by the resolver
+	locals *locals
 }
 
 func (b BlockStmt) Accept(visitor StmtVisitor) error {
@@ -25,6 +33,8 @@ func (b BlockStmt) Accept(visitor StmtVisitor) error {
 }
 
 type ExprStmt struct {
+	// First token of the expression, for the statement's position
+	start      Token
 	expression Expr
 }
 
@@ -32,11 +42,39 @@ func (e ExprStmt) Accept(visitor StmtVisitor) error {
 	return visitor.visitExprStmt(e)
 }
 
+// Represents a loop over the values of an iterable
+// example: for (x in list) or for (k, v in map)
+type ForInStmt struct {
+	// The loop variables, either just the value or a key and a value
+	names    []Token
+	keyword  Token
+	iterable Expr
+	body     Stmt
+	// Last token of the body
+	end Token
+	// The loop variables and any declared in the body, filled in by the resolver
+	locals *locals
+}
+
+func (f ForInStmt) Accept(visitor StmtVisitor) error {
+	return visitor.visitForInStmt(f)
+}
+
 type FuncStmt struct {
-	name    Token
-	params  []Token
-	body    []Stmt
+	name   Token
+	params []Token
+	body   []Stmt
+	// The closing brace of the body
+	end     Token
 	closure *Environment
+	// Doc comment written above the declaration, if any
+	doc string
+	// Set if the body contains a yield, so calling the function creates a Generator
+	isGenerator bool
+	// Where the function is declared, and the parameters and variables declared in
+	// the body, filled in by the resolver
+	binding *binding
+	locals  *locals
 }
 
 func (f FuncStmt) Accept(visitor StmtVisitor) error {
@@ -44,6 +82,7 @@ func (f FuncStmt) Accept(visitor StmtVisitor) error {
 }
 
 type IfStmt struct {
+	keyword   Token
 	condition Expr
 	branch    Stmt
 	elseStmt  Stmt
@@ -54,6 +93,7 @@ func (i IfStmt) Accept(visitor StmtVisitor) error {
 }
 
 type PrintStmt struct {
+	keyword    Token
 	expression Expr
 }
 
@@ -73,6 +113,10 @@ func (r ReturnStmt) Accept(visitor StmtVisitor) error {
 type VarStmt struct {
 	name        Token
 	initializer Expr
+	// Doc comment written above the declaration, if any
+	doc string
+	// Where the variable is declared, filled in by the resolver
+	binding *binding
 }
 
 func (v VarStmt) Accept(visitor StmtVisitor) error {
@@ -80,6 +124,8 @@ func (v VarStmt) Accept(visitor StmtVisitor) error {
 }
 
 type WhileStmt struct {
+	// The while, or the for of a desugared for loop
+	keyword   Token
 	condition Expr
 	body      Stmt
 }
@@ -87,3 +133,14 @@ type WhileStmt struct {
 func (w WhileStmt) Accept(visitor StmtVisitor) error {
 	return visitor.visitWhileStmt(w)
 }
+
+// Represents handing a value out of a generator
+// example: yield i;
+type YieldStmt struct {
+	keyword Token
+	value   Expr
+}
+
+func (y YieldStmt) Accept(visitor StmtVisitor) error {
+	return visitor.visitYieldStmt(y)
+}
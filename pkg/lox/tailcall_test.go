@@ -0,0 +1,70 @@
+package lox
+
+import (
+	"io/ioutil"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+// Recursion in tail position has to run in constant stack space
+func TestTailCallStack(t *testing.T) {
+
+	// Far too little stack for 100000 nested calls, going over it crashes the test
+	defer debug.SetMaxStack(debug.SetMaxStack(4 << 20))
+
+	source := `fun loop(n) {
+  if (n == 0) return "done";
+  {
+    return loop(n - 1);
+  }
+}
+print loop(100000);
+`
+	var out strings.Builder
+	if err := Run(source, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "done\n" {
+		t.Errorf("expected done, got %q", out.String())
+	}
+}
+
+// Calls in either arm of ?: and on the right of ??, and and or are in tail position too
+func TestTailCallBranches(t *testing.T) {
+
+	defer debug.SetMaxStack(debug.SetMaxStack(4 << 20))
+
+	tests := map[string]string{
+		"conditional": "return n > 0 ? loop(n - 1) : \"done\";",
+		"coalesce":    "return (n == 0 ? \"done\" : nil) ?? loop(n - 1);",
+		"or":          "return n == 0 and \"done\" or loop(n - 1);",
+	}
+	for name, body := range tests {
+		source := "fun loop(n) {\n  " + body + "\n}\nprint loop(100000);\n"
+		var out strings.Builder
+		if err := Run(source, &out); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if out.String() != "done\n" {
+			t.Errorf("%s: expected done, got %q", name, out.String())
+		}
+	}
+}
+
+// Traces still show tail calls nested in their callers
+func TestTailCallTrace(t *testing.T) {
+
+	source := `fun f(n) {
+  if (n == 0) return 0;
+  return f(n - 1);
+}
+f(1);
+`
+	var trace strings.Builder
+	if err := RunTraced(source, ioutil.Discard, &trace, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(trace.String(), "\n  call f(0)\n") {
+		t.Errorf("expected the call f(0) nested in f(1), got\n%s", trace.String())
+	}
+}
@@ -0,0 +1,504 @@
+package lox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Tasks are Lox functions started with spawn. Each one runs on its own goroutine with
+// its own Interpreter, so they don't share the environment pointer or literal scratch
+// space. Tasks talk to each other over channels.
+//
+// The Scheduler has two modes:
+//   - Concurrent, where every task runs on its goroutine as soon as it is spawned
+//   - Deterministic, where only one task runs at a time. A task keeps running until it
+//     blocks on a channel, joins another task or finishes, and then the task that has been
+//     waiting to run the longest goes next. Output is the same every run, which is what
+//     the tests use
+//
+// In both modes, if every task is blocked the blocked tasks fail with errDeadlock
+
+// Set to run programs with the deterministic scheduler
+var deterministicTasks = false
+
+var errDeadlock = errors.New("deadlock: all tasks are blocked")
+
+// Scheduler tracks the tasks of a program and guards the state of every channel
+type Scheduler struct {
+	// Guards everything in the scheduler, tasks and channels
+	// A single lock keeps select across several channels simple
+	mu            sync.Mutex
+	deterministic bool
+	// Number of tasks that are not blocked or finished
+	running int
+	// Tasks that are blocked, so they can be failed on deadlock
+	blocked map[*Task]*waiter
+	// Deterministic mode only: tasks waiting for their turn to run, oldest first
+	ready []*Task
+	// Every task spawned, to find failures nobody joined
+	tasks  []*Task
+	nextID int
+	// Generators that have started and not finished, to close when the program ends
+	generators map[*Generator]bool
+	// Set once the program spawns a task, and never cleared, after which the program's
+	// environments are locked
+	spawned int32
+}
+
+// A task started with spawn, or the main program
+type Task struct {
+	id   int
+	name string
+	// Receives a signal when the task can run again
+	wake chan struct{}
+	// Set if the task was woken up because of a deadlock
+	wakeErr error
+
+	done    bool
+	result  Value
+	err     error
+	joined  bool
+	joiners []*waiter
+}
+
+// Something a blocked task is waiting for
+// In a select the same waiter sits in the queue of several channels, and the first one
+// to fire it wins
+type waiter struct {
+	task  *Task
+	fired bool
+	// Which channel of a select fired the waiter
+	index int
+	// The value received, or sent by a blocked sender
+	value Value
+	// Set if a blocked sender's channel was closed
+	closed bool
+}
+
+// Returns a new scheduler with the main program as its first, running task
+func NewScheduler(deterministic bool) (*Scheduler, *Task) {
+	s := &Scheduler{deterministic: deterministic, blocked: make(map[*Task]*waiter), generators: make(map[*Generator]bool)}
+	main := s.newTask("main")
+	s.running = 1
+	return s, main
+}
+
+// Reports whether the program has spawned a task
+// Read without s.mu, since every variable access asks
+func (s *Scheduler) tasksSpawned() bool {
+	return atomic.LoadInt32(&s.spawned) != 0
+}
+
+// Called with s.mu held
+func (s *Scheduler) newTask(name string) *Task {
+	t := &Task{id: s.nextID, name: name, wake: make(chan struct{}, 1)}
+	s.nextID++
+	s.tasks = append(s.tasks, t)
+	return t
+}
+
+// Starts running the function with the arguments as a new task
+func (s *Scheduler) spawn(parent *Interpreter, function LoxCallable, arguments []Value, name string) *Task {
+
+	// From here on the task can share environments with the code that spawned it
+	atomic.StoreInt32(&s.spawned, 1)
+
+	s.mu.Lock()
+	t := s.newTask(name)
+	s.running++
+	if s.deterministic {
+		// The new task waits its turn behind everything else that can run
+		s.ready = append(s.ready, t)
+	}
+	s.mu.Unlock()
+
+	// Each task gets its own interpreter sharing the program's globals
+	interpreter := &Interpreter{
+		out:         parent.out,
+		globals:     parent.globals,
+		environment: parent.globals,
+		scheduler:   s,
+		task:        t,
+		debugger:    parent.debugger,
+		tracer:      parent.tracer.fork(),
+		profiler:    parent.profiler.fork(),
+		coverage:    parent.coverage,
+	}
+
+	go func() {
+		if s.deterministic {
+			<-t.wake
+		}
+
+		result, err := function.call(interpreter, arguments)
+		s.finish(t, result, err)
+	}()
+
+	return t
+}
+
+// Records the result of a task, wakes anything joining it and lets another task run
+func (s *Scheduler) finish(t *Task, result Value, err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t.done, t.result, t.err = true, result, err
+	for _, w := range t.joiners {
+		// Skip joiners already woken by a deadlock
+		if !w.fired {
+			s.fire(w, 0, result)
+		}
+	}
+
+	s.running--
+	s.handOff()
+}
+
+// Blocks the task until a channel operation or join fires its waiter
+// Called with s.mu held, which is released while blocked
+func (s *Scheduler) block(w *waiter) error {
+
+	t := w.task
+	s.running--
+	s.blocked[t] = w
+	s.handOff()
+
+	s.mu.Unlock()
+	<-t.wake
+	s.mu.Lock()
+
+	err := t.wakeErr
+	t.wakeErr = nil
+	return err
+}
+
+// Marks a waiter as done and makes its task runnable again
+// Called with s.mu held
+func (s *Scheduler) fire(w *waiter, index int, value Value) {
+	w.fired, w.index, w.value = true, index, value
+	s.wakeTask(w.task)
+}
+
+// Called with s.mu held
+func (s *Scheduler) wakeTask(t *Task) {
+	delete(s.blocked, t)
+	s.running++
+	if s.deterministic {
+		s.ready = append(s.ready, t)
+	} else {
+		t.wake <- struct{}{}
+	}
+}
+
+// Called with s.mu held when the current task stops running
+// In deterministic mode the next ready task is started. In both modes, if nothing can run
+// but tasks are blocked, they are woken with errDeadlock
+func (s *Scheduler) handOff() {
+
+	if s.running == 0 && len(s.blocked) > 0 {
+		// Wake them in the order they were spawned, so the deterministic mode stays deterministic
+		var deadlocked []*Task
+		for t := range s.blocked {
+			deadlocked = append(deadlocked, t)
+		}
+		sort.Slice(deadlocked, func(a, b int) bool { return deadlocked[a].id < deadlocked[b].id })
+
+		for _, t := range deadlocked {
+			s.blocked[t].fired = true
+			t.wakeErr = errDeadlock
+			s.wakeTask(t)
+		}
+	}
+
+	if s.deterministic && len(s.ready) > 0 {
+		next := s.ready[0]
+		s.ready = s.ready[1:]
+		next.wake <- struct{}{}
+	}
+}
+
+// Returns the first error from a task that failed without anyone joining it
+func (s *Scheduler) unjoinedError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tasks {
+		if t.done && t.err != nil && !t.joined {
+			// Only report it once, when the interpreter is reused
+			t.joined = true
+			return t.err
+		}
+	}
+	return nil
+}
+
+// Waits for the task to finish and returns its result
+func (s *Scheduler) join(current *Task, t *Task) (Value, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t.joined = true
+	if !t.done {
+		w := &waiter{task: current}
+		t.joiners = append(t.joiners, w)
+		if err := s.block(w); err != nil {
+			return Value{}, err
+		}
+	}
+
+	return t.result, t.err
+}
+
+// Waits for every task spawned so far to finish, so a program doesn't end while its
+// tasks still have work to do. Tasks stuck on a deadlock finish with errDeadlock
+func (s *Scheduler) wait(current *Task) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Tasks spawned while waiting are added to s.tasks, so check the length each time
+	for n := 0; n < len(s.tasks); n++ {
+		t := s.tasks[n]
+		// A deadlock wakes this task as well as the blocked ones, so keep waiting
+		// until they have finished with the error
+		for t != current && !t.done {
+			w := &waiter{task: current}
+			t.joiners = append(t.joiners, w)
+			s.block(w)
+		}
+	}
+}
+
+// Called when a generator's body starts running
+func (s *Scheduler) openGenerator(g *Generator) {
+	s.mu.Lock()
+	s.generators[g] = true
+	s.mu.Unlock()
+}
+
+// Called when a generator's body has finished
+func (s *Scheduler) closedGenerator(g *Generator) {
+	s.mu.Lock()
+	delete(s.generators, g)
+	s.mu.Unlock()
+}
+
+// Closes every generator left paused, so their goroutines don't outlive the program
+func (s *Scheduler) closeGenerators() {
+
+	s.mu.Lock()
+	var open []*Generator
+	for g := range s.generators {
+		open = append(open, g)
+	}
+	s.mu.Unlock()
+
+	// Closing a generator can close others its body was looping over, which is fine
+	// since closing twice does nothing
+	for _, g := range open {
+		g.close()
+	}
+}
+
+func (t *Task) String() string {
+	return fmt.Sprintf("<task %s>", t.name)
+}
+
+// A channel for passing values between tasks, created with channel() or channel(capacity)
+// Without a capacity, a send waits until a receiver takes the value
+type Channel struct {
+	scheduler *Scheduler
+	capacity  int
+	buffer    []Value
+	closed    bool
+	receivers []receiver
+	senders   []*waiter
+}
+
+// A task waiting to receive from a channel
+type receiver struct {
+	w *waiter
+	// Position of the channel in a select, reported back when this channel fires
+	index int
+}
+
+// Returns the first receiver that hasn't already been fired by another channel in a select
+// Called with s.mu held
+func (c *Channel) popReceiver() (receiver, bool) {
+	for len(c.receivers) > 0 {
+		r := c.receivers[0]
+		c.receivers = c.receivers[1:]
+		if !r.w.fired {
+			return r, true
+		}
+	}
+	return receiver{}, false
+}
+
+// Called with s.mu held
+func (c *Channel) popSender() *waiter {
+	for len(c.senders) > 0 {
+		w := c.senders[0]
+		c.senders = c.senders[1:]
+		if !w.fired {
+			return w
+		}
+	}
+	return nil
+}
+
+// Sends a value, waiting if the channel is full or has no receiver
+func (c *Channel) send(current *Task, value Value) error {
+
+	s := c.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.closed {
+		return errors.New("send on closed channel")
+	}
+
+	// Hand the value straight to a waiting receiver
+	if r, ok := c.popReceiver(); ok {
+		s.fire(r.w, r.index, value)
+		return nil
+	}
+
+	// Otherwise buffer it if there's room
+	if len(c.buffer) < c.capacity {
+		c.buffer = append(c.buffer, value)
+		return nil
+	}
+
+	// Otherwise wait for a receiver to take it
+	w := &waiter{task: current, value: value}
+	c.senders = append(c.senders, w)
+	if err := s.block(w); err != nil {
+		return err
+	}
+	if w.closed {
+		return errors.New("send on closed channel")
+	}
+	return nil
+}
+
+// Takes a value if one is available without waiting
+// Returns false if the receive would have to wait
+// Called with s.mu held
+func (c *Channel) tryRecv() (Value, bool) {
+
+	// Take from the buffer first, then let a waiting sender refill it
+	if len(c.buffer) > 0 {
+		value := c.buffer[0]
+		c.buffer = c.buffer[1:]
+		if w := c.popSender(); w != nil {
+			c.buffer = append(c.buffer, w.value)
+			c.scheduler.fire(w, 0, w.value)
+		}
+		return value, true
+	}
+
+	// Take directly from a waiting sender
+	if w := c.popSender(); w != nil {
+		c.scheduler.fire(w, 0, w.value)
+		return w.value, true
+	}
+
+	// A closed, empty channel always gives nil
+	if c.closed {
+		return Value{}, true
+	}
+
+	return Value{}, false
+}
+
+// Receives a value, waiting for one to be sent
+// Returns nil once the channel is closed and empty
+func (c *Channel) recv(current *Task) (Value, error) {
+
+	s := c.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value, ok := c.tryRecv(); ok {
+		return value, nil
+	}
+
+	w := &waiter{task: current}
+	c.receivers = append(c.receivers, receiver{w: w})
+	if err := s.block(w); err != nil {
+		return Value{}, err
+	}
+	return w.value, nil
+}
+
+// Closes the channel, waking any receivers with nil
+func (c *Channel) close() error {
+
+	s := c.scheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.closed {
+		return errors.New("close of closed channel")
+	}
+	c.closed = true
+
+	for r, ok := c.popReceiver(); ok; r, ok = c.popReceiver() {
+		s.fire(r.w, r.index, Value{})
+	}
+	// Blocked senders fail, the same as sending on a closed channel
+	for w := c.popSender(); w != nil; w = c.popSender() {
+		w.closed = true
+		s.fire(w, 0, w.value)
+	}
+
+	return nil
+}
+
+func (c *Channel) String() string {
+	return "<channel>"
+}
+
+// Waits until any of the channels can be received from
+// Returns the index of that channel and the value received
+// If several are ready, the first one in the list wins
+func selectRecv(s *Scheduler, current *Task, channels []*Channel) (int, Value, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for index, c := range channels {
+		if value, ok := c.tryRecv(); ok {
+			return index, value, nil
+		}
+	}
+
+	// Wait on all of them at once, the first channel to fire the waiter wins
+	w := &waiter{task: current}
+	for index, c := range channels {
+		c.receivers = append(c.receivers, receiver{w: w, index: index})
+	}
+	if err := s.block(w); err != nil {
+		return 0, Value{}, err
+	}
+	return w.index, w.value, nil
+}
+
+// Makes writes from several tasks safe to interleave
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,26 @@
+package lox
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// Only the program that spawned a task locks its environments
+func TestLockingPerProgram(t *testing.T) {
+
+	stmts, err := parseSource("fun work() { return 1; }\njoin(spawn work());\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spawner := NewInterpreter(ioutil.Discard)
+	if err := spawner.Interpret(stmts); err != nil {
+		t.Fatal(err)
+	}
+	if !spawner.environment.shared() {
+		t.Error("expected the program that spawned a task to lock its environments")
+	}
+
+	if NewInterpreter(ioutil.Discard).environment.shared() {
+		t.Error("expected a later program to start without locking")
+	}
+}
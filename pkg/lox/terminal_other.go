@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package lox
+
+import "errors"
+
+// Line editing is only supported on Linux, elsewhere the REPL reads plain lines
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
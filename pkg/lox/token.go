@@ -6,10 +6,14 @@ import (
 
 // Token contains the Type, Lexeme, Literal and Line Number
 type Token struct {
-	tType   TokenType
-	lexeme  string
-	line    int
+	tType  TokenType
+	lexeme string
+	line   int
+	// Column the token starts at, counting runes from 1
+	column  int
 	literal string
+	// Text of any /// doc comments directly preceding the token
+	doc string
 }
 
 func (t Token) String() string {
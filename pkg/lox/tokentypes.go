@@ -1,5 +1,7 @@
 package lox
 
+import "fmt"
+
 type TokenType int
 
 const (
@@ -7,13 +9,31 @@ const (
 	RIGHT_PAREN
 	LEFT_BRACE
 	RIGHT_BRACE
+	LEFT_BRACKET
+	RIGHT_BRACKET
 	COMMA
 	DOT
+	COLON
+	QUESTION
+	QUESTION_QUESTION
 	MINUS
 	PLUS
 	SEMICOLON
 	SLASH
 	STAR
+	PERCENT
+	AMPERSAND
+	PIPE
+	CARET
+	TILDE
+	STAR_STAR
+	LESS_LESS
+	GREATER_GREATER
+	PLUS_EQUAL
+	MINUS_EQUAL
+	STAR_EQUAL
+	SLASH_EQUAL
+	PERCENT_EQUAL
 	BANG
 	BANG_EQUAL
 	EQUAL
@@ -24,6 +44,7 @@ const (
 	LESS_EQUAL
 	IDENTIFIER
 	STRING
+	INTERPOLATION
 	NUMBER
 	AND
 	CLASS
@@ -32,15 +53,20 @@ const (
 	FUN
 	FOR
 	IF
+	IN
 	NIL
 	OR
 	PRINT
 	RETURN
+	SPAWN
 	SUPER
 	THIS
 	TRUE
 	VAR
 	WHILE
+	YIELD
+	// Only produced when the scanner is keeping comments, for the formatter
+	COMMENT
 	EOF
 )
 
@@ -52,13 +78,89 @@ var keywords = map[string]TokenType{
 	"fun":    FUN,
 	"for":    FOR,
 	"if":     IF,
+	"in":     IN,
 	"nil":    NIL,
 	"or":     OR,
 	"print":  PRINT,
 	"return": RETURN,
+	"spawn":  SPAWN,
 	"super":  SUPER,
 	"this":   THIS,
 	"true":   TRUE,
 	"var":    VAR,
 	"while":  WHILE,
+	"yield":  YIELD,
+}
+
+// Names of the token types, for printing tokens
+var tokenTypeNames = [...]string{
+	LEFT_PAREN:        "LEFT_PAREN",
+	RIGHT_PAREN:       "RIGHT_PAREN",
+	LEFT_BRACE:        "LEFT_BRACE",
+	RIGHT_BRACE:       "RIGHT_BRACE",
+	LEFT_BRACKET:      "LEFT_BRACKET",
+	RIGHT_BRACKET:     "RIGHT_BRACKET",
+	COMMA:             "COMMA",
+	DOT:               "DOT",
+	COLON:             "COLON",
+	QUESTION:          "QUESTION",
+	QUESTION_QUESTION: "QUESTION_QUESTION",
+	MINUS:             "MINUS",
+	PLUS:              "PLUS",
+	SEMICOLON:         "SEMICOLON",
+	SLASH:             "SLASH",
+	STAR:              "STAR",
+	PERCENT:           "PERCENT",
+	AMPERSAND:         "AMPERSAND",
+	PIPE:              "PIPE",
+	CARET:             "CARET",
+	TILDE:             "TILDE",
+	STAR_STAR:         "STAR_STAR",
+	LESS_LESS:         "LESS_LESS",
+	GREATER_GREATER:   "GREATER_GREATER",
+	PLUS_EQUAL:        "PLUS_EQUAL",
+	MINUS_EQUAL:       "MINUS_EQUAL",
+	STAR_EQUAL:        "STAR_EQUAL",
+	SLASH_EQUAL:       "SLASH_EQUAL",
+	PERCENT_EQUAL:     "PERCENT_EQUAL",
+	BANG:              "BANG",
+	BANG_EQUAL:        "BANG_EQUAL",
+	EQUAL:             "EQUAL",
+	EQUAL_EQUAL:       "EQUAL_EQUAL",
+	GREATER:           "GREATER",
+	GREATER_EQUAL:     "GREATER_EQUAL",
+	LESS:              "LESS",
+	LESS_EQUAL:        "LESS_EQUAL",
+	IDENTIFIER:        "IDENTIFIER",
+	STRING:            "STRING",
+	INTERPOLATION:     "INTERPOLATION",
+	NUMBER:            "NUMBER",
+	AND:               "AND",
+	CLASS:             "CLASS",
+	ELSE:              "ELSE",
+	FALSE:             "FALSE",
+	FUN:               "FUN",
+	FOR:               "FOR",
+	IF:                "IF",
+	IN:                "IN",
+	NIL:               "NIL",
+	OR:                "OR",
+	PRINT:             "PRINT",
+	RETURN:            "RETURN",
+	SPAWN:             "SPAWN",
+	SUPER:             "SUPER",
+	THIS:              "THIS",
+	TRUE:              "TRUE",
+	VAR:               "VAR",
+	WHILE:             "WHILE",
+	YIELD:             "YIELD",
+	COMMENT:           "COMMENT",
+	EOF:               "EOF",
+}
+
+func (t TokenType) String() string {
+	if int(t) < len(tokenTypeNames) {
+		return tokenTypeNames[t]
+	}
+	return fmt.Sprintf("TokenType(%d)", int(t))
 }
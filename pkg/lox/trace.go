@@ -0,0 +1,282 @@
+package lox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Tracing logs what a program does as it runs: each statement before it runs, each
+// function call with its arguments and what it returned, and each variable that is
+// defined or assigned. Lines are indented by how deep in calls the program is.
+//
+// As text, a call and its return bracket the lines of the body, which are indented
+// one level further. As JSON, each line is an object with an "event" of "statement",
+// "call", "return", "define" or "assign", the "depth" of calls, and the details of
+// the event. Values are written the way print shows them, with strings quoted.
+// Events from spawned tasks say which task they came from.
+
+// Formats the trace can be written in
+var traceFormats = []string{"text", "json"}
+
+// Where the trace of a program goes, shared by the interpreters of its tasks and
+// generators
+type traceLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	asJSON bool
+	// Lines and tokens of the source, to show the statement that runs
+	lines  []string
+	tokens []Token
+	// Index of each token in tokens, by where it is in the source
+	tokenAt map[[2]int]int
+	// Source of each statement shown so far, by where its first token is
+	sources map[[2]int]string
+}
+
+// Traces one interpreter, keeping track of how deep in calls it is
+type tracer struct {
+	log   *traceLog
+	depth int
+}
+
+// An event in the trace, as written in JSON
+type traceEvent struct {
+	Event     string   `json:"event"`
+	Depth     int      `json:"depth"`
+	Task      string   `json:"task,omitempty"`
+	Line      int      `json:"line,omitempty"`
+	Column    int      `json:"column,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	Function  string   `json:"function,omitempty"`
+	Arguments []string `json:"arguments,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Value     string   `json:"value,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// RunTraced runs the source like Run, writing a trace of what the program does to
+// trace in the format, which is text or json
+// Returns ErrCompile if the source had errors, or the error that stopped the program
+func RunTraced(source string, out, trace io.Writer, format string) error {
+
+	if !validTraceFormat(format) {
+		return fmt.Errorf("unknown trace format %q, expected one of %s", format, strings.Join(traceFormats, ", "))
+	}
+
+	stmts, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+
+	i := NewInterpreter(out)
+	i.tracer = &tracer{log: newTraceLog(source, trace, format == "json")}
+	return i.Interpret(stmts)
+}
+
+func newTraceLog(source string, out io.Writer, asJSON bool) *traceLog {
+
+	s := NewScanner(source)
+	s.scanTokens()
+
+	log := &traceLog{
+		out:     out,
+		asJSON:  asJSON,
+		lines:   strings.Split(source, "\n"),
+		tokens:  s.tokens,
+		tokenAt: map[[2]int]int{},
+		sources: map[[2]int]string{},
+	}
+	for n, t := range s.tokens {
+		log.tokenAt[[2]int{t.line, t.column}] = n
+	}
+	return log
+}
+
+// Returns the source of a statement as it was written, on one line
+// Statements with a body only show what comes before it, such as an if's condition,
+// since the statements in the body are shown as they run
+// Called with l.mu held
+func (l *traceLog) source(stmt Stmt) string {
+
+	first := stmtToken(stmt)
+	key := [2]int{first.line, first.column}
+	if text, ok := l.sources[key]; ok {
+		return text
+	}
+	start, ok := l.tokenAt[key]
+	if !ok {
+		return ""
+	}
+
+	// Declarations and for-in loops are found by a token part way in
+	switch stmt.(type) {
+	case VarStmt, FuncStmt, ForInStmt:
+		for start > 0 && l.tokens[start].tType != VAR && l.tokens[start].tType != FUN && l.tokens[start].tType != FOR {
+			start--
+		}
+	}
+
+	end := start
+	switch stmt.(type) {
+	case IfStmt, WhileStmt, ForInStmt, FuncStmt:
+		// Up to the ) that closes the first (
+		for end < len(l.tokens)-1 && l.tokens[end].tType != LEFT_PAREN {
+			end++
+		}
+		for depth := 0; end < len(l.tokens)-1; end++ {
+			switch l.tokens[end].tType {
+			case LEFT_PAREN:
+				depth++
+			case RIGHT_PAREN:
+				depth--
+			}
+			if depth == 0 {
+				break
+			}
+		}
+	default:
+		// Up to the ; that ends it, or the ) that ends the increment of a for
+		for depth := 0; end < len(l.tokens)-1; end++ {
+			t := l.tokens[end].tType
+			if t == SEMICOLON && depth == 0 {
+				break
+			}
+			switch t {
+			case LEFT_PAREN, LEFT_BRACKET, LEFT_BRACE:
+				depth++
+			case RIGHT_PAREN, RIGHT_BRACKET, RIGHT_BRACE:
+				depth--
+			}
+			if depth < 0 {
+				end--
+				break
+			}
+		}
+	}
+
+	text := l.span(start, end)
+	l.sources[key] = text
+	return text
+}
+
+// Returns the source from one token to another, with line breaks made into spaces
+func (l *traceLog) span(start, end int) string {
+
+	var text strings.Builder
+	for n := start; n <= end; n++ {
+		t := l.tokens[n]
+		if n > start {
+			prev := l.tokens[n-1]
+			if startLine(t) == prev.line {
+				// Keep the spacing between tokens on the same line
+				line := []rune(l.lines[startLine(t)-1])
+				if from, to := endColumn(prev)-1, t.column-1; from <= to && to <= len(line) {
+					text.WriteString(string(line[from:to]))
+				}
+			} else {
+				text.WriteString(" ")
+			}
+		}
+		text.WriteString(strings.ReplaceAll(t.lexeme, "\n", " "))
+	}
+	return text.String()
+}
+
+// Returns the column just after a token, on the line it ends on
+func endColumn(t Token) int {
+	if n := strings.LastIndex(t.lexeme, "\n"); n >= 0 {
+		return len([]rune(t.lexeme[n+1:])) + 1
+	}
+	return t.column + len([]rune(t.lexeme))
+}
+
+func validTraceFormat(format string) bool {
+	for _, f := range traceFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a tracer for another interpreter of the same program, such as a task's,
+// starting at the current depth
+// Returns nil if the program isn't being traced
+func (t *tracer) fork() *tracer {
+	if t == nil {
+		return nil
+	}
+	return &tracer{log: t.log, depth: t.depth}
+}
+
+// Called before each statement runs
+func (t *tracer) statement(i *Interpreter, stmt Stmt) {
+
+	// A block isn't a step of its own, the statements in it are
+	if _, ok := stmt.(BlockStmt); ok {
+		return
+	}
+
+	first := stmtToken(stmt)
+	line := startLine(first)
+	t.log.mu.Lock()
+	source := t.log.source(stmt)
+	t.log.mu.Unlock()
+	t.write(i, traceEvent{Event: "statement", Line: line, Column: first.column, Source: source}, fmt.Sprintf("line %d: %s", line, source))
+}
+
+// Called when a function starts running, once its arguments are evaluated
+func (t *tracer) call(i *Interpreter, name string, arguments []Value) {
+
+	values := make([]string, len(arguments))
+	for n, argument := range arguments {
+		values[n] = quoted(argument)
+	}
+	t.write(i, traceEvent{Event: "call", Function: name, Arguments: values}, fmt.Sprintf("call %s(%s)", name, strings.Join(values, ", ")))
+	t.depth++
+}
+
+// Called when a function returns a value or fails with an error
+func (t *tracer) leave(i *Interpreter, name string, value Value, err error) {
+
+	t.depth--
+	if err != nil {
+		t.write(i, traceEvent{Event: "return", Function: name, Error: err.Error()}, fmt.Sprintf("error from %s: %v", name, err))
+		return
+	}
+	t.write(i, traceEvent{Event: "return", Function: name, Value: quoted(value)}, fmt.Sprintf("return from %s: %s", name, quoted(value)))
+}
+
+// Called when a variable is defined
+func (t *tracer) define(i *Interpreter, name Token, value Value) {
+	t.write(i, traceEvent{Event: "define", Line: name.line, Name: name.lexeme, Value: quoted(value)}, fmt.Sprintf("define %s = %s", name.lexeme, quoted(value)))
+}
+
+// Called when a variable is assigned
+func (t *tracer) assign(i *Interpreter, name Token, value Value) {
+	t.write(i, traceEvent{Event: "assign", Line: name.line, Name: name.lexeme, Value: quoted(value)}, fmt.Sprintf("assign %s = %s", name.lexeme, quoted(value)))
+}
+
+// Writes an event as JSON or as the text, indented by depth
+func (t *tracer) write(i *Interpreter, event traceEvent, text string) {
+
+	event.Depth = t.depth
+	if i.task != nil && i.task.id != 0 {
+		event.Task = fmt.Sprintf("%s#%d", i.task.name, i.task.id)
+		text = "[" + event.Task + "] " + text
+	}
+
+	t.log.mu.Lock()
+	defer t.log.mu.Unlock()
+
+	if t.log.asJSON {
+		encoder := json.NewEncoder(t.log.out)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(event)
+		return
+	}
+	fmt.Fprintf(t.log.out, "%s%s\n", strings.Repeat("  ", t.depth), text)
+}
@@ -0,0 +1,107 @@
+package lox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+
+	source := `fun double(n) {
+  return n * 2;
+}
+var x = double(2);
+x = x + 1;
+for (s in ["a"]) print s;
+`
+	want := `line 1: fun double(n)
+define double = <fn double>
+line 4: var x = double(2);
+call double(2)
+  line 2: return n * 2;
+return from double: 4
+define x = 4
+line 5: x = x + 1;
+assign x = 5
+line 6: for (s in ["a"])
+define s = "a"
+line 6: print s;
+`
+	var trace strings.Builder
+	if err := RunTraced(source, ioutil.Discard, &trace, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if trace.String() != want {
+		t.Errorf("expected the trace\n%s\ngot\n%s", want, trace.String())
+	}
+
+	if err := RunTraced(source, ioutil.Discard, &trace, "xml"); err == nil {
+		t.Error("expected an error for an unknown trace format")
+	}
+}
+
+// Each statement shows its own source, not the whole line it's on
+func TestTraceStatementsOnOneLine(t *testing.T) {
+
+	source := "var a = 1; fun f(x) { print x; } f(a); for (var i = 0; i < 1; i = i + 1) {}\n"
+	want := `line 1: var a = 1;
+define a = 1
+line 1: fun f(x)
+define f = <fn f>
+line 1: f(a);
+call f(1)
+  line 1: print x;
+return from f: nil
+line 1: var i = 0;
+define i = 0
+line 1: for (var i = 0; i < 1; i = i + 1)
+line 1: i = i + 1
+assign i = 1
+`
+	var trace strings.Builder
+	if err := RunTraced(source, ioutil.Discard, &trace, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if trace.String() != want {
+		t.Errorf("expected the trace\n%s\ngot\n%s", want, trace.String())
+	}
+}
+
+func TestTraceJSON(t *testing.T) {
+
+	var trace strings.Builder
+	err := RunTraced("fun f(a, b) { return a / b; }\nf(1, nil);", ioutil.Discard, &trace, "json")
+	if err == nil {
+		t.Fatal("expected the division by nil to fail")
+	}
+
+	var events []traceEvent
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		var event traceEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("%v in %s", err, line)
+		}
+		events = append(events, event)
+	}
+
+	kinds := []string{"statement", "define", "statement", "call", "statement", "return"}
+	if len(events) != len(kinds) {
+		t.Fatalf("expected %d events, got %+v", len(kinds), events)
+	}
+	for n, kind := range kinds {
+		if events[n].Event != kind {
+			t.Errorf("expected event %d to be %s, got %+v", n, kind, events[n])
+		}
+	}
+	if call := events[3]; call.Function != "f" || strings.Join(call.Arguments, ",") != "1,nil" || call.Depth != 0 {
+		t.Errorf("unexpected call %+v", call)
+	}
+	if body := events[4]; body.Depth != 1 || body.Line != 1 {
+		t.Errorf("expected the body one call deep, got %+v", body)
+	}
+	if ret := events[5]; ret.Error == "" || ret.Value != "" {
+		t.Errorf("expected the return to carry the error, got %+v", ret)
+	}
+}
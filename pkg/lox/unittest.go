@@ -0,0 +1,493 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Test scripts are Lox files whose names end in _test.lox. Every top level function
+// whose name starts with test_ is a test, and they run in the order they're declared.
+//
+// Each test gets an interpreter of its own, so nothing one test does to the globals
+// is seen by the next. The top level of the script runs first, then setup() if the
+// script declares it, then the test, then teardown() if the script declares it,
+// which runs even if the test failed.
+//
+// A test fails when an assertion such as assertEqual fails, and is an error when
+// anything else goes wrong. What a test prints is kept, and shown if it doesn't pass.
+
+// How a test ended
+const (
+	testPassed = "pass"
+	testFailed = "fail"
+	testError  = "error"
+)
+
+// Returned by the assert builtins when an assertion fails
+type assertionError struct {
+	message string
+}
+
+func (e assertionError) Error() string {
+	return e.message
+}
+
+// The result of one test
+type testResult struct {
+	name     string
+	status   string
+	message  string
+	output   string
+	duration time.Duration
+}
+
+// The results of a test script
+type testFile struct {
+	path  string
+	tests []testResult
+	// Set if the script failed to compile or its top level failed with no tests to run
+	err      error
+	duration time.Duration
+}
+
+// TestSuite runs test scripts and keeps their results
+type TestSuite struct {
+	// Records what the tests ran, if set
+	Coverage *Coverage
+	// Reports passing tests as well as the rest
+	Verbose bool
+
+	files []testFile
+}
+
+// RunFile runs the tests in a script, writing how they went to out
+func (s *TestSuite) RunFile(path, source string, out io.Writer) {
+
+	start := time.Now()
+	file := s.runFile(path, source)
+	file.duration = time.Since(start)
+	s.files = append(s.files, file)
+	file.report(out, s.Verbose)
+}
+
+func (s *TestSuite) runFile(path, source string) testFile {
+
+	file := testFile{path: path}
+
+	// Compile errors are reported with the results rather than to errorOutput
+	previous := errorOutput
+	errorOutput = ioutil.Discard
+	stmts, err := parseSource(source)
+	errorOutput = previous
+	if err != nil {
+		var messages []string
+		for _, e := range compileErrors {
+			messages = append(messages, fmt.Sprintf("[line %d] %s", e.line, e.message))
+		}
+		file.err = fmt.Errorf("%s", strings.Join(messages, "\n"))
+		return file
+	}
+
+	var coverage *fileCoverage
+	if s.Coverage != nil {
+		coverage = s.Coverage.file(path, source, stmts)
+	}
+
+	var names []string
+	for _, stmt := range stmts {
+		if f, ok := stmt.(FuncStmt); ok && strings.HasPrefix(f.name.lexeme, "test_") {
+			names = append(names, f.name.lexeme)
+		}
+	}
+
+	// A script without tests still has to run cleanly
+	if len(names) == 0 {
+		i := NewInterpreter(ioutil.Discard)
+		i.coverage = coverage
+		file.err = i.Interpret(stmts)
+		return file
+	}
+
+	for _, name := range names {
+		file.tests = append(file.tests, runTest(name, stmts, coverage))
+	}
+	return file
+}
+
+// Runs a test in an interpreter of its own
+func runTest(name string, stmts []Stmt, coverage *fileCoverage) testResult {
+
+	start := time.Now()
+	var output bytes.Buffer
+	i := NewInterpreter(&output)
+	i.coverage = coverage
+	// Interpret closes the generators the script leaves open, this closes the test's
+	defer i.scheduler.closeGenerators()
+
+	err := i.Interpret(stmts)
+	if err == nil {
+		err = i.callFunction("setup")
+		if err == nil {
+			err = i.callFunction(name)
+			if teardownErr := i.callFunction("teardown"); err == nil {
+				err = teardownErr
+			}
+		}
+	}
+
+	result := testResult{name: name, status: testPassed, output: output.String(), duration: time.Since(start)}
+	if err != nil {
+		result.status, result.message = testError, err.Error()
+		if errors.As(err, &assertionError{}) {
+			result.status = testFailed
+		}
+	}
+	return result
+}
+
+// Calls a top level function of the script that takes no arguments, such as a test or
+// setup, and waits for any tasks it started
+// Does nothing if the script doesn't declare the function
+func (i *Interpreter) callFunction(name string) error {
+
+	value, err := i.environment.Get(Variable{token: Token{lexeme: name}})
+	if err != nil {
+		return nil
+	}
+	function, ok := value.object.(FuncStmt)
+	if !ok {
+		return nil
+	}
+	if function.arity() != 0 {
+		return runtimeErrorf(function.name.line, "%s can't take arguments", name)
+	}
+
+	result, err := function.call(i, nil)
+	if err != nil {
+		return err
+	}
+	// Calling a function with a yield only creates a generator, so run it to the end
+	if g, ok := result.object.(*Generator); ok {
+		for more := true; more; {
+			if _, more, err = g.next(i); err != nil {
+				return err
+			}
+		}
+	}
+	i.scheduler.wait(i.task)
+	return i.scheduler.unjoinedError()
+}
+
+// Writes the tests that didn't pass, or every test when verbose, then a summary
+func (f testFile) report(out io.Writer, verbose bool) {
+
+	if f.err != nil {
+		fmt.Fprintf(out, "FAIL %s\n%s\n", f.path, indent(f.err.Error()))
+		return
+	}
+
+	failed := 0
+	for _, t := range f.tests {
+		if t.status != testPassed {
+			failed++
+		} else if !verbose {
+			continue
+		}
+		fmt.Fprintf(out, "--- %s: %s (%.3fs)\n", strings.ToUpper(t.status), t.name, t.duration.Seconds())
+		if t.message != "" {
+			fmt.Fprintln(out, indent(t.message))
+		}
+		if t.output != "" && t.status != testPassed {
+			fmt.Fprintf(out, "    output:\n%s\n", indent(indent(strings.TrimSuffix(t.output, "\n"))))
+		}
+	}
+
+	switch {
+	case len(f.tests) == 0:
+		fmt.Fprintf(out, "ok   %s (no tests, %.3fs)\n", f.path, f.duration.Seconds())
+	case failed > 0:
+		fmt.Fprintf(out, "FAIL %s (%d of %s failed, %.3fs)\n", f.path, failed, plural(len(f.tests), "test"), f.duration.Seconds())
+	default:
+		fmt.Fprintf(out, "ok   %s (%s, %.3fs)\n", f.path, plural(len(f.tests), "test"), f.duration.Seconds())
+	}
+}
+
+// Indents each line of text by four spaces
+func indent(text string) string {
+	return "    " + strings.Replace(text, "\n", "\n    ", -1)
+}
+
+// Failed reports whether any script or test run so far didn't pass
+func (s *TestSuite) Failed() bool {
+	for _, f := range s.files {
+		if f.err != nil {
+			return true
+		}
+		for _, t := range f.tests {
+			if t.status != testPassed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The JUnit XML report, as read by CI servers
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Details string `xml:",chardata"`
+}
+
+// WriteJUnit writes the results in the JUnit XML format, with a testsuite for each
+// script
+// A script that failed before its tests could run is a testsuite with one errored
+// testcase named <script>
+func (s *TestSuite) WriteJUnit(out io.Writer) error {
+
+	seconds := func(d time.Duration) string { return fmt.Sprintf("%.3f", d.Seconds()) }
+
+	var report junitTestSuites
+	var total time.Duration
+	for _, f := range s.files {
+		suite := junitTestSuite{Name: f.path, Time: seconds(f.duration)}
+
+		results := f.tests
+		if f.err != nil {
+			results = []testResult{{name: "<script>", status: testError, message: f.err.Error(), duration: f.duration}}
+		}
+		for _, t := range results {
+			c := junitTestCase{Name: t.name, ClassName: f.path, Time: seconds(t.duration), SystemOut: t.output}
+			// The message attribute gets the first line, the body all of it
+			problem := &junitProblem{Message: strings.SplitN(t.message, "\n", 2)[0], Details: t.message}
+			switch t.status {
+			case testFailed:
+				c.Failure = problem
+				suite.Failures++
+			case testError:
+				c.Error = problem
+				suite.Errors++
+			}
+			suite.Tests++
+			suite.Cases = append(suite.Cases, c)
+		}
+
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Errors += suite.Errors
+		total += f.duration
+		report.Suites = append(report.Suites, suite)
+	}
+	report.Time = seconds(total)
+
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+// assert(condition) or assert(condition, message)
+// Fails the test if the condition is false or nil
+type Assert struct{}
+
+func (a Assert) arity() int {
+	return 2
+}
+
+func (a Assert) arityRange() (int, int) {
+	return 1, 2
+}
+
+func (a Assert) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+	if arguments[0].truthy() {
+		return Value{}, nil
+	}
+	if len(arguments) == 2 {
+		return Value{}, assertionError{"assertion failed: " + arguments[1].String()}
+	}
+	return Value{}, assertionError{"assertion failed"}
+}
+
+func (a Assert) String() string {
+	return "<native fn>"
+}
+
+// assertEqual(actual, expected)
+// Fails the test if the values differ, comparing lists and maps by what's in them
+// Values that don't fit on a line are shown as a diff
+type AssertEqual struct{}
+
+func (a AssertEqual) arity() int {
+	return 2
+}
+
+func (a AssertEqual) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+
+	actual, expected := arguments[0], arguments[1]
+	if deepEqual(actual, expected) {
+		return Value{}, nil
+	}
+
+	want, got := diffFormat(expected, ""), diffFormat(actual, "")
+	if !strings.Contains(want, "\n") && !strings.Contains(got, "\n") {
+		return Value{}, assertionError{fmt.Sprintf("assertEqual failed: expected %s, got %s", want, got)}
+	}
+	return Value{}, assertionError{"assertEqual failed:\n" + strings.TrimSuffix(Diff("expected", "actual", want+"\n", got+"\n"), "\n")}
+}
+
+func (a AssertEqual) String() string {
+	return "<native fn>"
+}
+
+// assertThrows(function) or assertThrows(function, text)
+// Calls the function with no arguments, failing the test unless it raises an error,
+// whose message has to contain the text if there is one
+// Returns the error message
+type AssertThrows struct{}
+
+func (a AssertThrows) arity() int {
+	return 2
+}
+
+func (a AssertThrows) arityRange() (int, int) {
+	return 1, 2
+}
+
+func (a AssertThrows) call(interpreter *Interpreter, arguments []Value) (Value, error) {
+
+	function, ok := arguments[0].object.(LoxCallable)
+	if !ok {
+		return Value{}, fmt.Errorf("assertThrows expects a function, got %s", typeName(arguments[0]))
+	}
+	if err := checkArity(function, 0, 0); err != nil {
+		return Value{}, fmt.Errorf("assertThrows expects a function that takes no arguments")
+	}
+
+	_, err := function.call(interpreter, nil)
+	// A failed assertion inside the function fails the test rather than counting
+	if err == nil || errors.As(err, &assertionError{}) {
+		if err == nil {
+			err = assertionError{"assertThrows failed: expected an error, but there wasn't one"}
+		}
+		return Value{}, err
+	}
+
+	if len(arguments) == 2 {
+		text := arguments[1].String()
+		if !strings.Contains(err.Error(), text) {
+			return Value{}, assertionError{fmt.Sprintf("assertThrows failed: expected an error containing %q, got %q", text, err.Error())}
+		}
+	}
+	return stringValue(err.Error()), nil
+}
+
+func (a AssertThrows) String() string {
+	return "<native fn>"
+}
+
+// Reports whether two values are equal, comparing lists and maps by what's in them
+func deepEqual(a, b Value) bool {
+	switch x := a.object.(type) {
+	case *LoxList:
+		y, ok := b.object.(*LoxList)
+		if !ok || len(x.elements) != len(y.elements) {
+			return false
+		}
+		for n := range x.elements {
+			if !deepEqual(x.elements[n], y.elements[n]) {
+				return false
+			}
+		}
+		return true
+	case *LoxMap:
+		y, ok := b.object.(*LoxMap)
+		if !ok || len(x.keys) != len(y.keys) {
+			return false
+		}
+		for _, key := range x.keys {
+			xv, _ := x.Get(key)
+			yv, ok := y.Get(key)
+			if !ok || !deepEqual(xv, yv) {
+				return false
+			}
+		}
+		return true
+	}
+	return a.equals(b)
+}
+
+// Formats a value for a failed assertion
+// Lists and maps that don't fit in 60 characters, and strings with newlines in them,
+// are spread over several lines so a diff shows just what changed
+func diffFormat(value Value, prefix string) string {
+
+	if value.kind == stringKind && strings.Contains(value.str, "\n") {
+		return value.str
+	}
+	if short := quoted(value); len(short) <= 60 {
+		return short
+	}
+
+	var parts []string
+	open, close := "[", "]"
+	switch v := value.object.(type) {
+	case *LoxList:
+		for _, element := range v.elements {
+			parts = append(parts, diffFormat(element, prefix+"  "))
+		}
+	case *LoxMap:
+		open, close = "{", "}"
+		for _, key := range v.keys {
+			entry, _ := v.Get(key)
+			parts = append(parts, quoted(key)+": "+diffFormat(entry, prefix+"  "))
+		}
+	default:
+		return quoted(value)
+	}
+
+	var b strings.Builder
+	b.WriteString(open + "\n")
+	for _, part := range parts {
+		b.WriteString(prefix + "  " + part + ",\n")
+	}
+	b.WriteString(prefix + close)
+	return b.String()
+}
@@ -0,0 +1,158 @@
+package lox
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+const unitTestSource = `var calls = 0;
+
+fun setup() {
+  calls = calls + 1;
+}
+
+fun test_isolated() {
+  assertEqual(calls, 1);
+  calls = 100;
+}
+
+fun test_still_isolated() {
+  assertEqual(calls, 1);
+}
+
+fun test_assert() {
+  assert(false, "the message");
+}
+
+fun test_throws() {
+  fun divide() { return 1 / nil; }
+  assertEqual(assertThrows(divide, "bad operand"), "error at line 21: bad operand for binary /: int, nil");
+  assertThrows(fun_without_error);
+}
+
+fun fun_without_error() {}
+
+fun test_error() {
+  print "before";
+  missing();
+}
+`
+
+func TestTestSuite(t *testing.T) {
+
+	suite := &TestSuite{}
+	var out strings.Builder
+	suite.RunFile("unit_test.lox", unitTestSource, &out)
+
+	want := map[string]string{
+		"test_isolated":       testPassed,
+		"test_still_isolated": testPassed,
+		"test_assert":         testFailed,
+		"test_throws":         testFailed,
+		"test_error":          testError,
+	}
+	tests := suite.files[0].tests
+	if len(tests) != len(want) {
+		t.Fatalf("expected %d tests, got %+v", len(want), tests)
+	}
+	for _, test := range tests {
+		if test.status != want[test.name] {
+			t.Errorf("expected %s to %s, got %+v", test.name, want[test.name], test)
+		}
+	}
+	if !suite.Failed() {
+		t.Error("expected the suite to have failed")
+	}
+
+	for _, line := range []string{
+		"--- FAIL: test_assert",
+		"    error at line 17: assertion failed: the message",
+		"    error at line 23: assertThrows failed: expected an error, but there wasn't one",
+		"--- ERROR: test_error",
+		"    output:\n        before\n",
+		"FAIL unit_test.lox (3 of 5 tests failed, ",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in the report, got\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "test_isolated") {
+		t.Errorf("expected passing tests to be left out, got\n%s", out.String())
+	}
+
+	var junit strings.Builder
+	if err := suite.WriteJUnit(&junit); err != nil {
+		t.Fatal(err)
+	}
+	var report junitTestSuites
+	if err := xml.Unmarshal([]byte(junit.String()), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Tests != 5 || report.Failures != 2 || report.Errors != 1 || len(report.Suites) != 1 {
+		t.Errorf("unexpected JUnit report %+v", report)
+	}
+	if c := report.Suites[0].Cases[4]; c.Error == nil || c.SystemOut != "before\n" {
+		t.Errorf("expected test_error to be an error with its output, got %+v", c)
+	}
+}
+
+// A test with a yield runs to the end rather than passing without running
+func TestTestSuiteGenerators(t *testing.T) {
+
+	source := `fun test_yields() {
+  yield 1;
+  assert(true);
+}
+
+fun test_fails_after_yield() {
+  yield 1;
+  assert(false, "reached");
+}
+`
+	suite := &TestSuite{}
+	var out strings.Builder
+	suite.RunFile("gen_test.lox", source, &out)
+
+	want := map[string]string{"test_yields": testPassed, "test_fails_after_yield": testFailed}
+	for _, test := range suite.files[0].tests {
+		if test.status != want[test.name] {
+			t.Errorf("expected %s to %s, got %+v", test.name, want[test.name], test)
+		}
+	}
+	if !strings.Contains(out.String(), "assertion failed: reached") {
+		t.Errorf("expected the failure after the yield to be reported, got\n%s", out.String())
+	}
+}
+
+func TestTestSuiteCompileError(t *testing.T) {
+	suite := &TestSuite{}
+	var out strings.Builder
+	suite.RunFile("broken_test.lox", "fun test_x() {", &out)
+	if !suite.Failed() || !strings.HasPrefix(out.String(), "FAIL broken_test.lox\n    [line 1] ") {
+		t.Errorf("expected the compile error to be reported, got\n%s", out.String())
+	}
+}
+
+func TestAssertEqualDiff(t *testing.T) {
+
+	list := func(values ...interface{}) Value {
+		l := &LoxList{}
+		for _, v := range values {
+			l.elements = append(l.elements, valueOf(v))
+		}
+		return objectValue(l)
+	}
+
+	if _, err := (AssertEqual{}).call(nil, []Value{list(int64(1), 2.0), list(1.0, int64(2))}); err != nil {
+		t.Errorf("expected lists with equal numbers to be equal, got %v", err)
+	}
+
+	long := []interface{}{"one", "two", "three", "four", "five", "six", "seven", "eight"}
+	changed := append([]interface{}{}, long...)
+	changed[4] = "FIVE"
+	_, err := (AssertEqual{}).call(nil, []Value{list(changed...), list(long...)})
+	if err == nil || !strings.Contains(err.Error(), "\n-  \"five\",\n+  \"FIVE\",\n") {
+		t.Errorf("expected a diff of the lists, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Values are what a program works with while it runs, kept apart from the Literal
+// nodes of the syntax tree that constants are parsed into.
+//
+// A value's kind says which of its fields holds it. Bools, ints, floats and strings
+// are held in the value itself, so working with them doesn't allocate. Ints too big
+// for an int64 are held as a *big.Int, and lists, maps, functions and the other
+// objects are held as they are. The zero Value is nil.
+
+// The kind of a value
+type valueKind uint8
+
+const (
+	nilKind valueKind = iota
+	boolKind
+	intKind
+	bigKind
+	floatKind
+	stringKind
+	objectKind
+	// Fills the slots of a frame until their variables are defined, programs never see it
+	undefinedKind
+)
+
+type Value struct {
+	kind valueKind
+	// An int64, the bits of a float64, or 1 for true
+	bits uint64
+	str  string
+	// A *big.Int, or an object such as a list, a map or a function
+	object interface{}
+}
+
+var undefined = Value{kind: undefinedKind}
+
+func boolValue(b bool) Value {
+	if b {
+		return Value{kind: boolKind, bits: 1}
+	}
+	return Value{kind: boolKind}
+}
+
+func intValue(n int64) Value {
+	return Value{kind: intKind, bits: uint64(n)}
+}
+
+func floatValue(f float64) Value {
+	return Value{kind: floatKind, bits: math.Float64bits(f)}
+}
+
+func stringValue(s string) Value {
+	return Value{kind: stringKind, str: s}
+}
+
+// Returns a value holding an object, such as a list, a map or a function
+func objectValue(object interface{}) Value {
+	return Value{kind: objectKind, object: object}
+}
+
+// Converts a Go value, such as the value of a Literal, into a Value
+func valueOf(v interface{}) Value {
+	switch v := v.(type) {
+	case nil:
+		return Value{}
+	case bool:
+		return boolValue(v)
+	case int64:
+		return intValue(v)
+	case *big.Int:
+		return Value{kind: bigKind, object: v}
+	case float64:
+		return floatValue(v)
+	case string:
+		return stringValue(v)
+	case Value:
+		return v
+	}
+	return objectValue(v)
+}
+
+// Returns the value as a Go value, the inverse of valueOf
+func (v Value) unwrap() interface{} {
+	switch v.kind {
+	case boolKind:
+		return v.boolean()
+	case intKind:
+		return v.int()
+	case floatKind:
+		return v.float()
+	case stringKind:
+		return v.str
+	case bigKind, objectKind:
+		return v.object
+	}
+	return nil
+}
+
+func (v Value) boolean() bool {
+	return v.bits != 0
+}
+
+func (v Value) int() int64 {
+	return int64(v.bits)
+}
+
+func (v Value) float() float64 {
+	return math.Float64frombits(v.bits)
+}
+
+func (v Value) big() *big.Int {
+	return v.object.(*big.Int)
+}
+
+// Checks if the value is any kind of number
+func (v Value) isNumber() bool {
+	return v.kind == intKind || v.kind == bigKind || v.kind == floatKind
+}
+
+// Checks if the value is an int, of either size
+func (v Value) isInteger() bool {
+	return v.kind == intKind || v.kind == bigKind
+}
+
+// Only false and nil are falsey, every other value is truthy
+func (v Value) truthy() bool {
+	switch v.kind {
+	case nilKind:
+		return false
+	case boolKind:
+		return v.boolean()
+	}
+	return true
+}
+
+// Reports whether two values are equal with ==
+func (v Value) equals(other Value) bool {
+
+	// Numbers are compared by value, so an int can equal a float
+	if v.isNumber() && other.isNumber() {
+		return numbersEqual(v, other)
+	}
+
+	// Everything else has to be the same kind and value
+	if v.kind != other.kind {
+		return false
+	}
+	switch v.kind {
+	case nilKind:
+		return true
+	case boolKind:
+		return v.bits == other.bits
+	case stringKind:
+		return v.str == other.str
+	}
+
+	// Functions are equal when they come from the same declaration and close over the
+	// same variables, every other object only equals itself
+	if f, ok := v.object.(FuncStmt); ok {
+		g, ok := other.object.(FuncStmt)
+		return ok && f.locals == g.locals && f.closure == g.closure
+	}
+	return v.object == other.object
+}
+
+// Formats the value the way print shows it
+func (v Value) String() string {
+	switch v.kind {
+	case nilKind:
+		return "nil"
+	case boolKind:
+		return fmt.Sprintf("%t", v.boolean())
+	case intKind, bigKind, floatKind:
+		return formatNumber(v)
+	case stringKind:
+		return v.str
+	}
+	return fmt.Sprintf("%v", v.object)
+}
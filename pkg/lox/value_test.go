@@ -0,0 +1,61 @@
+package lox
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Going through valueOf and back has to give the same Go value
+func TestValueRoundTrip(t *testing.T) {
+
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	list := &LoxList{}
+
+	for _, v := range []interface{}{nil, true, false, int64(-7), huge, 2.5, "", "text", list} {
+		if got := valueOf(v).unwrap(); got != v {
+			t.Errorf("expected %v to round trip, got %v", v, got)
+		}
+	}
+}
+
+func TestValueEquals(t *testing.T) {
+
+	list := objectValue(&LoxList{})
+	function := objectValue(FuncStmt{locals: &locals{}})
+
+	tests := []struct {
+		a, b Value
+		want bool
+	}{
+		{Value{}, Value{}, true},
+		{Value{}, boolValue(false), false},
+		{boolValue(true), boolValue(true), true},
+		{intValue(1), floatValue(1), true},
+		{intValue(0), boolValue(false), false},
+		{stringValue("1"), intValue(1), false},
+		{stringValue("a"), stringValue("a"), true},
+		{list, list, true},
+		{list, objectValue(&LoxList{}), false},
+		{function, function, true},
+		{function, objectValue(FuncStmt{locals: &locals{}}), false},
+	}
+
+	for _, test := range tests {
+		if got := test.a.equals(test.b); got != test.want {
+			t.Errorf("%s == %s: expected %t, got %t", quoted(test.a), quoted(test.b), test.want, got)
+		}
+	}
+}
+
+func TestValueTruthy(t *testing.T) {
+	for _, v := range []Value{{}, boolValue(false)} {
+		if v.truthy() {
+			t.Errorf("expected %s to be falsey", v)
+		}
+	}
+	for _, v := range []Value{boolValue(true), intValue(0), floatValue(0), stringValue(""), objectValue(&LoxList{})} {
+		if !v.truthy() {
+			t.Errorf("expected %s to be truthy", quoted(v))
+		}
+	}
+}